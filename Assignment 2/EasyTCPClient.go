@@ -14,10 +14,16 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -27,9 +33,39 @@ const (
 	BUFFER_SIZE            int    = 1024
 	ERR_SEND               int    = 1
 	ERR_REC                int    = 2
+	UNSUB_MSG              string = "Unsubscribed"
+
+	BATCH_COMMANDS string        = "12345" // command #6 subscription is interactive only
+	BATCH_TIMEOUT  time.Duration = 3 * time.Second
+	INVALID_CMD    string        = "invalid command"
+
+	// LAN discovery (see discoverServer)
+	DISCOVERY_GROUP      string        = "239.255.20.45"
+	DISCOVERY_PORT       int           = 20455
+	DISCOVERY_QUERY      string        = "DISCOVER"
+	DISCOVERY_REPLY      string        = "SERVICE"
+	DISCOVERY_QUERY_SIZE int           = 64
+	DISCOVERY_TIMEOUT    time.Duration = time.Second
+	SERVICE_TYPE         string        = "command-tcp"
+	NO_SERVER_DISCOVERED string        = "no server discovered"
+	INVALID_SELECTION    string        = "invalid selection"
 )
 
+/**
+ * result of one command in batch mode, printed as one JSON line.
+**/
+type batchResult struct {
+	Command string  `json:"command"`
+	Data    string  `json:"data,omitempty"`
+	Reply   string  `json:"reply,omitempty"`
+	RTT     float64 `json:"rtt_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
 var (
+	DISCOVERY_TARGETS []string = []string{DISCOVERY_GROUP, "255.255.255.255", "127.255.255.255"}
+	discoverMode      bool
+
 	buffer               []byte = make([]byte, BUFFER_SIZE)
 	conn                 net.Conn
 	scanner              bufio.Scanner = *bufio.NewScanner(os.Stdin)
@@ -40,15 +76,33 @@ var (
 )
 
 func main() {
+	script, batch := readScript()
+
 	// make tcp connection with server.
 	// when fails, print error message and stop program.
-	conn, err = net.Dial("tcp", serverName+":"+serverPort)
+	serverAddr := serverName + ":" + serverPort
+	if discoverMode { // in batch mode, first discovered server is used
+		serverAddr, err = discoverServer(!batch)
+	}
+	if err == nil {
+		conn, err = net.Dial("tcp", serverAddr)
+	}
 	if err != nil {
+		if batch {
+			json.NewEncoder(os.Stdout).Encode(batchResult{Error: err.Error()})
+			os.Exit(1)
+		}
 		fmt.Println("Can't find server")
 		return
 	}
 
 	initCtrlCHandler() // ctrl-c handler
+	if batch {
+		exitCode := runBatch(script)
+		conn.Write([]byte("5"))
+		conn.Close()
+		os.Exit(exitCode)
+	}
 	fmt.Printf("Client is running on port %d\n", conn.LocalAddr().(*net.TCPAddr).Port)
 	for {
 		cleanBuffer()
@@ -110,12 +164,166 @@ func main() {
 			printRTT()
 		case "5": // command #5: exit program.
 			cleanupAndExit()
+		case "6": // command #6: subscribes server status, and prints pushed updates until enter is pressed.
+			fmt.Print("Input update interval in seconds: ")
+			str_to_send = getLine()
+
+			if tmp_cnt, err = conn.Write([]byte("6" + str_to_send)); err != nil {
+				errorHandle(ERR_SEND)
+			}
+			fmt.Println("\nPress enter to unsubscribe")
+			go func() {
+				getLine()
+				conn.Write([]byte("7"))
+			}()
+
+			tail := "" // end of previous read, as UNSUB_MSG can be split across reads
+			for {      // server's updates are separated by newline, and several of them can be read at once
+				cleanBuffer()
+				if tmp_cnt, err = conn.Read(buffer); err != nil {
+					errorHandle(ERR_REC)
+				}
+				msg := string(buffer[:tmp_cnt])
+				fmt.Print(msg)
+				if strings.Contains(tail+msg, UNSUB_MSG) {
+					break
+				}
+				tail += msg
+				tail = tail[max(0, len(tail)-len(UNSUB_MSG)+1):]
+			}
+			fmt.Println()
 		default: // error handling: not defined command.
 			fmt.Println("\nInvalid instruction")
 		}
 	}
 }
 
+/**
+ * batch mode is used when script file(-f, "-" for stdin) or commands
+ * are given as arguments. each command is "<command> <data>",
+ * e.g. EasyTCPClient -f script.txt, EasyTCPClient "1 hello" 3 4
+ * with -d, server is discovered on LAN instead of serverName.
+**/
+func readScript() (lines []string, batch bool) {
+	scriptFile := flag.String("f", "", "script file of commands, one \"<command> <data>\" per line")
+	flag.BoolVar(&discoverMode, "d", false, "discover server on LAN, and select it")
+	flag.Parse()
+
+	if *scriptFile != "" {
+		var content []byte
+		var err error
+		if *scriptFile == "-" {
+			content, err = io.ReadAll(os.Stdin)
+		} else {
+			content, err = os.ReadFile(*scriptFile)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Can't read script:", err)
+			os.Exit(1)
+		}
+		lines = strings.Split(string(content), "\n")
+	}
+	lines = append(lines, flag.Args()...)
+	return lines, *scriptFile != "" || flag.NArg() > 0
+}
+
+/**
+ * finds servers of SERVICE_TYPE on LAN and this host, and lets user pick one.
+ * query is sent to multicast group and broadcast addresses,
+ * and replies are collected for DISCOVERY_TIMEOUT.
+ * when pick is false, first found server is used. returns "host:port".
+**/
+func discoverServer(pick bool) (string, error) {
+	pc, err := net.ListenPacket("udp4", ":")
+	if err != nil {
+		return "", err
+	}
+	defer pc.Close()
+
+	query := DISCOVERY_QUERY + " " + SERVICE_TYPE
+	query += strings.Repeat(" ", DISCOVERY_QUERY_SIZE-len(query)) // server ignores query shorter than its reply
+	for _, target := range DISCOVERY_TARGETS {
+		pc.WriteTo([]byte(query), &net.UDPAddr{IP: net.ParseIP(target), Port: DISCOVERY_PORT}) // unreachable one is ignored
+	}
+
+	servers, seen := []string{}, map[string]bool{}
+	buf := make([]byte, BUFFER_SIZE)
+	pc.SetReadDeadline(time.Now().Add(DISCOVERY_TIMEOUT))
+	for {
+		cnt, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		reply := strings.Fields(string(buf[:cnt])) // "SERVICE" <type> <version> <port> <instance id>
+		if len(reply) != 5 || reply[0] != DISCOVERY_REPLY || reply[1] != SERVICE_TYPE || seen[reply[4]] {
+			continue
+		}
+		seen[reply[4]] = true // same server answers through every interface query has reached
+		servers = append(servers, net.JoinHostPort(addr.(*net.UDPAddr).IP.String(), reply[3]))
+		if pick {
+			fmt.Printf("%d) %s (version %s)\n", len(servers), servers[len(servers)-1], reply[2])
+		}
+	}
+
+	if len(servers) == 0 {
+		return "", errors.New(NO_SERVER_DISCOVERED)
+	} else if !pick {
+		return servers[0], nil
+	}
+	fmt.Print("Select server: ")
+	idx, err := strconv.Atoi(getLine())
+	if err != nil || idx < 1 || idx > len(servers) {
+		return "", errors.New(INVALID_SELECTION)
+	}
+	return servers[idx-1], nil
+}
+
+/**
+ * runs commands non-interactively, and prints each result as JSON line.
+ * blank lines and lines starting with '#' are skipped.
+ * reply is waited until BATCH_TIMEOUT, and timed out command is reported as error.
+ * stops at command #5, connection error or timeout, since late reply would be
+ * read as reply of next command. returns exit code of program.
+**/
+func runBatch(lines []string) int {
+	encoder := json.NewEncoder(os.Stdout)
+	exitCode := 0
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		cmd, data, _ := strings.Cut(line, " ")
+		result := batchResult{Command: cmd, Data: data}
+		if len(cmd) != 1 || !strings.Contains(BATCH_COMMANDS, cmd) {
+			result.Error = INVALID_CMD
+			encoder.Encode(result)
+			exitCode = 1
+			continue
+		} else if cmd == "5" { // disconnection is sent by caller
+			encoder.Encode(result)
+			break
+		}
+
+		start := time.Now()
+		if tmp_cnt, err = conn.Write([]byte(cmd + data)); err == nil {
+			conn.SetReadDeadline(time.Now().Add(BATCH_TIMEOUT))
+			tmp_cnt, err = conn.Read(buffer)
+			conn.SetReadDeadline(time.Time{})
+		}
+		result.RTT = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil { // connection is broken or out of sync, so following commands can't be run
+			result.Error = err.Error()
+			encoder.Encode(result)
+			return 1
+		}
+		result.Reply = string(buffer[:tmp_cnt])
+		encoder.Encode(result)
+	}
+	return exitCode
+}
+
 /**
  * prints available options
 **/
@@ -126,6 +334,7 @@ func printCommand() {
 	fmt.Println("3) get server request count")
 	fmt.Println("4) get server running time")
 	fmt.Println("5) exit")
+	fmt.Println("6) subscribe server status")
 	fmt.Print("Input option: ")
 }
 
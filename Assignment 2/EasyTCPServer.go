@@ -19,6 +19,8 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -26,22 +28,46 @@ import (
 const (
 	serverPort  string = "20454"
 	BUFFER_SIZE int    = 1024
+
+	SUB_MIN_INTERVAL time.Duration = time.Second
+	SUB_MAX_INTERVAL time.Duration = time.Minute
+	UNSUB_MSG        string        = "Unsubscribed"
+
+	// LAN discovery (see serveDiscovery)
+	DISCOVERY_GROUP      string = "239.255.20.45"
+	DISCOVERY_PORT       int    = 20455
+	DISCOVERY_QUERY      string = "DISCOVER"
+	DISCOVERY_REPLY      string = "SERVICE"
+	DISCOVERY_QUERY_SIZE int    = 64
+	SERVICE_TYPE         string = "command-tcp"
+	SERVICE_VERSION      string = "1.0.0"
 )
 
+/**
+ * status subscription of connected client.
+ * stop is closed to end pushing, and done is closed
+ * by pushing goroutine after its last write.
+**/
+type subscription struct {
+	stop, done chan bool
+}
+
 var (
-	buffer           []byte = make([]byte, BUFFER_SIZE)
-	listener         net.Listener
-	conn             net.Conn
-	count, req_serve int
-	start_t          time.Time
-	dura             time.Duration
-	err              error
+	buffer    []byte = make([]byte, BUFFER_SIZE)
+	listener  net.Listener
+	conn      net.Conn
+	count     int
+	req_serve int32 // read by subscription goroutine, thus atomic
+	start_t   time.Time
+	sub       *subscription
+	err       error
 )
 
 func main() {
 	start_t = time.Now()                              // runtime calculation start
 	listener, err = net.Listen("tcp", ":"+serverPort) // tcp init
 	initCtrlCHandler()                                //ctrl-c handler init
+	go serveDiscovery()
 
 	fmt.Printf("Server is ready to receive on port %s\n", serverPort)
 	for {
@@ -62,29 +88,125 @@ func main() {
 				conn.Write([]byte(conn.RemoteAddr().String()))
 			case '3': // command #3: returns the number of requests served before this command.
 				fmt.Println("Command " + string(buffer[0]))
-				conn.Write([]byte(strconv.Itoa(req_serve)))
+				conn.Write([]byte(strconv.Itoa(int(atomic.LoadInt32(&req_serve)))))
 			case '4': // command #4: returns server's running time.
 				fmt.Println("Command " + string(buffer[0]))
-				dura = time.Since(start_t)
-				hh, mm, ss := getRuntime()
+				hh, mm, ss := getRuntime(time.Since(start_t))
 				conn.Write([]byte(fmt.Sprintf("%02d:%02d:%02d", hh, mm, ss)))
 			case '5': // command #5: receives client's disconnection message, and waits for new connection.
 				fmt.Println("Client has disconnected, waiting for new connection...")
+				stopSubscription()
 				break TASK
+			case '6': // command #6: subscribes server status, pushed every <data> seconds until command #7.
+				fmt.Println("Command " + string(buffer[0]))
+				stopSubscription()
+				interval := parseInterval(string(buffer[1:count]))
+				conn.Write([]byte(fmt.Sprintf("Subscribed every %d seconds\n", interval/time.Second)))
+				sub = &subscription{stop: make(chan bool), done: make(chan bool)}
+				go pushStatus(conn, interval, sub)
+			case '7': // command #7: unsubscribes server status.
+				fmt.Println("Command " + string(buffer[0]))
+				stopSubscription()
+				conn.Write([]byte(UNSUB_MSG + "\n"))
 			default: // error handling: not defined messages
 				conn.Write([]byte("Wrong command"))
 			}
 
-			req_serve++
+			atomic.AddInt32(&req_serve, 1)
 		}
 		conn.Close()
 	}
 }
 
+/**
+ * parsing requested interval in seconds.
+ * wrong or out of range value is clamped, so that
+ * client can't flood itself with updates.
+**/
+func parseInterval(data string) time.Duration {
+	sec, err := strconv.Atoi(data)
+	interval := time.Duration(sec) * time.Second
+	if err != nil || interval < SUB_MIN_INTERVAL {
+		interval = SUB_MIN_INTERVAL
+	} else if interval > SUB_MAX_INTERVAL {
+		interval = SUB_MAX_INTERVAL
+	}
+	return interval
+}
+
+/**
+ * pushing "<request count> <running time> <connected clients>"
+ * to subscribed client periodically, until subscription stops.
+ * only one client is served at a time, so connected client is 1.
+**/
+func pushStatus(conn net.Conn, interval time.Duration, s *subscription) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			hh, mm, ss := getRuntime(time.Since(start_t))
+			msg := fmt.Sprintf("requests served = %d, run time = %02d:%02d:%02d, clients = %d\n",
+				atomic.LoadInt32(&req_serve), hh, mm, ss, 1)
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+/**
+ * stops current subscription, and waits for pushing goroutine
+ * so that no update is written after this function returns.
+**/
+func stopSubscription() {
+	if sub != nil {
+		close(sub.stop)
+		<-sub.done
+		sub = nil
+	}
+}
+
+/**
+ * answering LAN discovery query, so that clients can find this server.
+ * query: "DISCOVER"[" "<service type>], padded to DISCOVERY_QUERY_SIZE bytes
+ * reply: "SERVICE "<service type>" "<version>" "<port>" "<instance id>
+ * multicast listener shares the port with other servers on the same host,
+ * and receives broadcast query too. short query is ignored, not to be reflected.
+**/
+func serveDiscovery() {
+	pc, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(DISCOVERY_GROUP), Port: DISCOVERY_PORT})
+	if err != nil {
+		fmt.Println("Discovery is not available:", err)
+		return
+	}
+	defer pc.Close()
+
+	instanceID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	announce := []byte(DISCOVERY_REPLY + " " + SERVICE_TYPE + " " + SERVICE_VERSION + " " + serverPort + " " + instanceID)
+	buf := make([]byte, DISCOVERY_QUERY_SIZE)
+	for {
+		cnt, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := strings.Fields(string(buf[:cnt]))
+		if cnt < DISCOVERY_QUERY_SIZE || len(query) == 0 || query[0] != DISCOVERY_QUERY ||
+			(len(query) > 1 && query[1] != SERVICE_TYPE) {
+			continue
+		}
+		pc.WriteTo(announce, addr)
+	}
+}
+
 /**
  * interpreting time.Duration to Hour, Minute, and Second.
 **/
-func getRuntime() (hh, mm, ss time.Duration) {
+func getRuntime(dura time.Duration) (hh, mm, ss time.Duration) {
 	hh = dura / time.Hour
 	dura %= time.Hour
 	mm = dura / time.Minute
@@ -8,16 +8,28 @@
  * interpreting server's message done in client.
  * <command> : one ASCII character number ('0' ~ '9').
  * <data> : string
+ * request is wrapped as ["S"<timestamp><HMAC>]["C"<cookie>]<command><data>
+ * for source validation and authentication. (see EasyUDPServer)
 **/
 
 package main
 
 import (
 	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -27,9 +39,58 @@ const (
 	BUFFER_SIZE            int    = 1024
 	ERR_SEND               int    = 1
 	ERR_REC                int    = 2
+
+	// server drops subscription after a minute, so it is renewed before that.
+	// renewing also refreshes cookie before it expires.
+	SUB_RENEW_INTERVAL time.Duration = 20 * time.Second
+	UNSUB_TIMEOUT      time.Duration = 2 * time.Second
+	UNSUB_MSG          string        = "Unsubscribed"
+	SUB_FULL_MSG       string        = "Too many subscribers"
+
+	/**
+	 * server issues cookie valid for at least 30 seconds.
+	 * old cookie is fetched again before sending request, and
+	 * cookie older than COOKIE_REFRESH_AGE is refreshed in background.
+	**/
+	COOKIE_MAX_AGE      time.Duration = 25 * time.Second
+	COOKIE_REFRESH_AGE  time.Duration = 10 * time.Second
+	COOKIE_TIMEOUT      time.Duration = time.Second
+	COOKIE_REQUEST_SIZE int           = 32
+	COOKIE_REPLY        string        = "0cookie:"
+	SHARED_KEY_ENV      string        = "EASYUDP_KEY"
+
+	BATCH_COMMANDS string        = "12345" // command #6 subscription is interactive only
+	BATCH_TIMEOUT  time.Duration = 3 * time.Second
+	DRAIN_TIMEOUT  time.Duration = time.Millisecond // see drainReplies
+	INVALID_CMD    string        = "invalid command"
+
+	// LAN discovery (see discoverServer)
+	DISCOVERY_GROUP      string        = "239.255.20.45"
+	DISCOVERY_PORT       int           = 20455
+	DISCOVERY_QUERY      string        = "DISCOVER"
+	DISCOVERY_REPLY      string        = "SERVICE"
+	DISCOVERY_QUERY_SIZE int           = 64
+	DISCOVERY_TIMEOUT    time.Duration = time.Second
+	SERVICE_TYPE         string        = "command-udp"
+	NO_SERVER_DISCOVERED string        = "no server discovered"
+	INVALID_SELECTION    string        = "invalid selection"
 )
 
+/**
+ * result of one command in batch mode, printed as one JSON line.
+**/
+type batchResult struct {
+	Command string  `json:"command"`
+	Data    string  `json:"data,omitempty"`
+	Reply   string  `json:"reply,omitempty"`
+	RTT     float64 `json:"rtt_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
 var (
+	DISCOVERY_TARGETS []string = []string{DISCOVERY_GROUP, "255.255.255.255", "127.255.255.255"}
+	discoverMode      bool
+
 	buffer               []byte = make([]byte, BUFFER_SIZE)
 	pconn                net.PacketConn
 	server_addr          *net.UDPAddr
@@ -38,13 +99,42 @@ var (
 	usr_opt, str_to_send string
 	start_t, end_t       float64
 	err                  error
+
+	cookieMutex sync.Mutex // cookie is also used by subscription renewing goroutine
+	cookie      string
+	cookieTime  time.Time
+	sharedKey   []byte // nil when requests are not signed
 )
 
 func main() {
+	script, batch := readScript()
+
 	// initializing client's udp, and gets server's IP and port #.
 	pconn, err = net.ListenPacket("udp", ":")
-	server_addr, err = net.ResolveUDPAddr("udp", serverName+":"+serverPort)
+	serverAddr := serverName + ":" + serverPort
+	if discoverMode { // in batch mode, first discovered server is used
+		if serverAddr, err = discoverServer(!batch); err != nil && !batch {
+			fmt.Println(err)
+			return
+		}
+	}
+	if err == nil {
+		server_addr, err = net.ResolveUDPAddr("udp", serverAddr)
+	}
 	initCtrlCHandler() // ctrl-c handler
+	if key := os.Getenv(SHARED_KEY_ENV); key != "" {
+		sharedKey = []byte(key)
+	}
+
+	if batch {
+		if err != nil {
+			json.NewEncoder(os.Stdout).Encode(batchResult{Error: err.Error()})
+			os.Exit(1)
+		}
+		exitCode := runBatch(script)
+		pconn.Close()
+		os.Exit(exitCode)
+	}
 
 	fmt.Printf("Client is running on port %d\n", pconn.LocalAddr().(*net.UDPAddr).Port)
 	for {
@@ -58,10 +148,10 @@ func main() {
 			str_to_send = getLine()
 
 			start_t = float64(time.Now().UnixMicro())
-			if tmp_cnt, err = pconn.WriteTo([]byte("1"+str_to_send), server_addr); err != nil {
+			if tmp_cnt, err = sendRequest("1" + str_to_send); err != nil {
 				errorHandle(ERR_SEND)
 			}
-			if tmp_cnt, _, err = pconn.ReadFrom(buffer); err != nil {
+			if tmp_cnt, err = readReply(); err != nil {
 				errorHandle(ERR_REC)
 			}
 			end_t = float64(time.Now().UnixMicro())
@@ -70,10 +160,10 @@ func main() {
 			printRTT()
 		case "2": // command #2: requests client's IP address and port number.
 			start_t = float64(time.Now().UnixMicro())
-			if tmp_cnt, err = pconn.WriteTo([]byte("2"), server_addr); err != nil {
+			if tmp_cnt, err = sendRequest("2"); err != nil {
 				errorHandle(ERR_SEND)
 			}
-			if tmp_cnt, _, err = pconn.ReadFrom(buffer); err != nil {
+			if tmp_cnt, err = readReply(); err != nil {
 				errorHandle(ERR_REC)
 			}
 			end_t = float64(time.Now().UnixMicro())
@@ -83,10 +173,10 @@ func main() {
 			printRTT()
 		case "3": // command #3: requests the number of reqest served since server has started.
 			start_t = float64(time.Now().UnixMicro())
-			if tmp_cnt, err = pconn.WriteTo([]byte("3"), server_addr); err != nil {
+			if tmp_cnt, err = sendRequest("3"); err != nil {
 				errorHandle(ERR_SEND)
 			}
-			if tmp_cnt, _, err = pconn.ReadFrom(buffer); err != nil {
+			if tmp_cnt, err = readReply(); err != nil {
 				errorHandle(ERR_REC)
 			}
 			end_t = float64(time.Now().UnixMicro())
@@ -95,10 +185,10 @@ func main() {
 			printRTT()
 		case "4": // command #4: requests the running time of server program.
 			start_t = float64(time.Now().UnixMicro())
-			if tmp_cnt, err = pconn.WriteTo([]byte("4"), server_addr); err != nil {
+			if tmp_cnt, err = sendRequest("4"); err != nil {
 				errorHandle(ERR_SEND)
 			}
-			if tmp_cnt, _, err = pconn.ReadFrom(buffer); err != nil {
+			if tmp_cnt, err = readReply(); err != nil {
 				errorHandle(ERR_REC)
 			}
 			end_t = float64(time.Now().UnixMicro())
@@ -107,12 +197,178 @@ func main() {
 			printRTT()
 		case "5": // command #5: exit program.
 			cleanupAndExit()
+		case "6": // command #6: subscribes server status, and prints pushed updates until enter is pressed.
+			fmt.Print("Input update interval in seconds: ")
+			str_to_send = getLine()
+
+			if tmp_cnt, err = sendRequest("6" + str_to_send); err != nil {
+				errorHandle(ERR_SEND)
+			}
+			if tmp_cnt, err = readReply(); err != nil {
+				errorHandle(ERR_REC)
+			}
+			fmt.Println("\nReply from server: " + string(buffer[:tmp_cnt]))
+			if strings.HasPrefix(string(buffer[:tmp_cnt]), SUB_FULL_MSG) {
+				break
+			}
+
+			fmt.Println("Press enter to unsubscribe")
+			go renewSubscription(str_to_send)
+			for {
+				cleanBuffer()
+				if tmp_cnt, err = readReply(); err != nil {
+					if errors.Is(err, os.ErrDeadlineExceeded) { // reply of unsubscription is lost
+						break
+					}
+					errorHandle(ERR_REC)
+				}
+				msg := string(buffer[:tmp_cnt])
+				fmt.Print(msg)
+				if strings.HasPrefix(msg, UNSUB_MSG) {
+					break
+				}
+			}
+			pconn.SetReadDeadline(time.Time{})
+			fmt.Println()
 		default: // error handling: not defined command.
 			fmt.Println("\nInvalid instruction")
 		}
 	}
 }
 
+/**
+ * batch mode is used when script file(-f, "-" for stdin) or commands
+ * are given as arguments. each command is "<command> <data>",
+ * e.g. EasyUDPClient -f script.txt, EasyUDPClient "1 hello" 3 4
+ * with -d, server is discovered on LAN instead of serverName.
+**/
+func readScript() (lines []string, batch bool) {
+	scriptFile := flag.String("f", "", "script file of commands, one \"<command> <data>\" per line")
+	flag.BoolVar(&discoverMode, "d", false, "discover server on LAN, and select it")
+	flag.Parse()
+
+	if *scriptFile != "" {
+		var content []byte
+		var err error
+		if *scriptFile == "-" {
+			content, err = io.ReadAll(os.Stdin)
+		} else {
+			content, err = os.ReadFile(*scriptFile)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Can't read script:", err)
+			os.Exit(1)
+		}
+		lines = strings.Split(string(content), "\n")
+	}
+	lines = append(lines, flag.Args()...)
+	return lines, *scriptFile != "" || flag.NArg() > 0
+}
+
+/**
+ * finds servers of SERVICE_TYPE on LAN and this host, and lets user pick one.
+ * query is sent to multicast group and broadcast addresses,
+ * and replies are collected for DISCOVERY_TIMEOUT.
+ * when pick is false, first found server is used. returns "host:port".
+**/
+func discoverServer(pick bool) (string, error) {
+	pc, err := net.ListenPacket("udp4", ":")
+	if err != nil {
+		return "", err
+	}
+	defer pc.Close()
+
+	query := DISCOVERY_QUERY + " " + SERVICE_TYPE
+	query += strings.Repeat(" ", DISCOVERY_QUERY_SIZE-len(query)) // server ignores query shorter than its reply
+	for _, target := range DISCOVERY_TARGETS {
+		pc.WriteTo([]byte(query), &net.UDPAddr{IP: net.ParseIP(target), Port: DISCOVERY_PORT}) // unreachable one is ignored
+	}
+
+	servers, seen := []string{}, map[string]bool{}
+	buf := make([]byte, BUFFER_SIZE)
+	pc.SetReadDeadline(time.Now().Add(DISCOVERY_TIMEOUT))
+	for {
+		cnt, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		reply := strings.Fields(string(buf[:cnt])) // "SERVICE" <type> <version> <port> <instance id>
+		if len(reply) != 5 || reply[0] != DISCOVERY_REPLY || reply[1] != SERVICE_TYPE || seen[reply[4]] {
+			continue
+		}
+		seen[reply[4]] = true // same server answers through every interface query has reached
+		servers = append(servers, net.JoinHostPort(addr.(*net.UDPAddr).IP.String(), reply[3]))
+		if pick {
+			fmt.Printf("%d) %s (version %s)\n", len(servers), servers[len(servers)-1], reply[2])
+		}
+	}
+
+	if len(servers) == 0 {
+		return "", errors.New(NO_SERVER_DISCOVERED)
+	} else if !pick {
+		return servers[0], nil
+	}
+	fmt.Print("Select server: ")
+	idx, err := strconv.Atoi(getLine())
+	if err != nil || idx < 1 || idx > len(servers) {
+		return "", errors.New(INVALID_SELECTION)
+	}
+	return servers[idx-1], nil
+}
+
+/**
+ * runs commands non-interactively, and prints each result as JSON line.
+ * blank lines and lines starting with '#' are skipped, and command #5 stops.
+ * udp message can be lost, so reply is waited until BATCH_TIMEOUT
+ * and timed out command is reported as error. returns exit code of program.
+ * reply of timed out command can arrive later, so it is drained before next one.
+**/
+func runBatch(lines []string) int {
+	encoder := json.NewEncoder(os.Stdout)
+	exitCode, late := 0, false // late: reply of previous command may still come
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		cmd, data, _ := strings.Cut(line, " ")
+		result := batchResult{Command: cmd, Data: data}
+		if len(cmd) != 1 || !strings.Contains(BATCH_COMMANDS, cmd) {
+			result.Error = INVALID_CMD
+			encoder.Encode(result)
+			exitCode = 1
+			continue
+		} else if cmd == "5" {
+			encoder.Encode(result)
+			break
+		}
+
+		if late {
+			drainReplies(BATCH_TIMEOUT)
+		} else {
+			drainReplies(DRAIN_TIMEOUT)
+		}
+		cleanBuffer()
+		start := time.Now()
+		if tmp_cnt, err = sendRequest(cmd + data); err == nil {
+			pconn.SetReadDeadline(time.Now().Add(BATCH_TIMEOUT))
+			tmp_cnt, err = readReply()
+			pconn.SetReadDeadline(time.Time{})
+		}
+		result.RTT = float64(time.Since(start).Microseconds()) / 1000
+		late = errors.Is(err, os.ErrDeadlineExceeded)
+		if err != nil {
+			result.Error = err.Error()
+			exitCode = 1
+		} else {
+			result.Reply = string(buffer[:tmp_cnt])
+		}
+		encoder.Encode(result)
+	}
+	return exitCode
+}
+
 /**
  * prints available options
 **/
@@ -123,6 +379,7 @@ func printCommand() {
 	fmt.Println("3) get server request count")
 	fmt.Println("4) get server running time")
 	fmt.Println("5) exit")
+	fmt.Println("6) subscribe server status")
 	fmt.Print("Input option: ")
 }
 
@@ -165,6 +422,152 @@ func parseIPandPort() (ipaddr, portnum string) {
 	return
 }
 
+/**
+ * sends request to server. cookie is fetched first when it is too old.
+**/
+func sendRequest(msg string) (int, error) {
+	cookieMutex.Lock()
+	age := time.Since(cookieTime)
+	cookieMutex.Unlock()
+	if age > COOKIE_MAX_AGE {
+		fetchCookie()
+	}
+	return pconn.WriteTo(wrapRequest(msg), server_addr)
+}
+
+/**
+ * reads reply from server. cookie reply of background refresh
+ * can arrive any time, so it is consumed here and not returned.
+**/
+func readReply() (int, error) {
+	for {
+		cnt, _, err := pconn.ReadFrom(buffer)
+		if err != nil || !saveCookie(buffer[:cnt]) {
+			return cnt, err
+		}
+		cleanBuffer()
+	}
+}
+
+/**
+ * discards replies received until wait passes, so late reply of previous request
+ * is not taken as reply of next one. after late reply is discarded, only
+ * queued ones are read. cookie reply in them is still saved.
+ * reply later than that can't be told apart, since reply has no request id.
+**/
+func drainReplies(wait time.Duration) {
+	defer pconn.SetReadDeadline(time.Time{})
+	for {
+		pconn.SetReadDeadline(time.Now().Add(wait))
+		cnt, _, err := pconn.ReadFrom(buffer)
+		if err != nil {
+			return
+		} else if !saveCookie(buffer[:cnt]) {
+			wait = DRAIN_TIMEOUT
+		}
+	}
+}
+
+/**
+ * requests cookie and waits for it. udp message can be lost, so
+ * request is sent again after timeout. other replies are ignored.
+**/
+func fetchCookie() {
+	defer pconn.SetReadDeadline(time.Time{})
+	for try := 0; try < 3; try++ {
+		pconn.WriteTo(signRequest(cookieRequest()), server_addr)
+		pconn.SetReadDeadline(time.Now().Add(COOKIE_TIMEOUT))
+		for {
+			cnt, _, err := pconn.ReadFrom(buffer)
+			if err != nil {
+				break
+			} else if saveCookie(buffer[:cnt]) {
+				cleanBuffer()
+				return
+			}
+		}
+	}
+	cleanBuffer()
+	fmt.Fprintln(os.Stderr, "Cannot get cookie from server")
+}
+
+/**
+ * if message is cookie reply, saves cookie and returns true.
+**/
+func saveCookie(msg []byte) bool {
+	if !strings.HasPrefix(string(msg), COOKIE_REPLY) {
+		return false
+	}
+	cookieMutex.Lock()
+	cookie, cookieTime = string(msg[len(COOKIE_REPLY):]), time.Now()
+	cookieMutex.Unlock()
+	return true
+}
+
+/**
+ * cookie request is padded, 'cause server doesn't send reply larger than request.
+**/
+func cookieRequest() string {
+	return "0" + strings.Repeat(" ", COOKIE_REQUEST_SIZE-1)
+}
+
+/**
+ * wrapping request with cookie and signature.
+ * when cookie is getting old, new one is requested in background
+ * and its reply is consumed by readReply().
+ * message format: ["S"<timestamp><HMAC>]"C"<cookie><command><data>
+**/
+func wrapRequest(msg string) []byte {
+	cookieMutex.Lock()
+	curCookie, age := cookie, time.Since(cookieTime)
+	cookieMutex.Unlock()
+	if age > COOKIE_REFRESH_AGE {
+		pconn.WriteTo(signRequest(cookieRequest()), server_addr)
+	}
+	return signRequest("C" + curCookie + msg)
+}
+
+/**
+ * signing message with shared key, when it is set.
+ * timestamp is unix nano time in 16 hex digits, and server rejects
+ * message too old or already received.
+**/
+func signRequest(msg string) []byte {
+	if sharedKey == nil {
+		return []byte(msg)
+	}
+	ts := fmt.Sprintf("%016x", time.Now().UnixNano())
+	h := hmac.New(sha256.New, sharedKey)
+	h.Write([]byte(ts + msg))
+	return []byte("S" + ts + hex.EncodeToString(h.Sum(nil)) + msg)
+}
+
+/**
+ * renews subscription periodically until enter is pressed,
+ * then sends unsubscription message. udp message can be lost,
+ * so receiving reply is limited by deadline.
+**/
+func renewSubscription(interval string) {
+	enterChan := make(chan bool)
+	go func() {
+		getLine()
+		close(enterChan)
+	}()
+
+	ticker := time.NewTicker(SUB_RENEW_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-enterChan:
+			pconn.WriteTo(wrapRequest("7"), server_addr)
+			pconn.SetReadDeadline(time.Now().Add(UNSUB_TIMEOUT))
+			return
+		case <-ticker.C:
+			pconn.WriteTo(wrapRequest("6"+interval), server_addr)
+		}
+	}
+}
+
 /**
  * ctrl-c handler. if ctrl-c interrupt program,
  * it will call cleanup function.
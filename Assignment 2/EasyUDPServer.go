@@ -8,17 +8,28 @@
  * interpreting server's message done in client.
  * <command> : one ASCII character number ('0' ~ '9').
  * <data> : string
+ * request is wrapped as ["S"<timestamp><HMAC>]["C"<cookie>]<command><data>
+ * for source validation and authentication. (see EasyUDPServer)
 **/
 
 package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -26,58 +37,454 @@ import (
 const (
 	serverPort  string = "20454"
 	BUFFER_SIZE int    = 1024
+
+	/**
+	 * udp source address can be spoofed, so subscription is limited.
+	 * it expires after SUB_LIFETIME unless client renews it by sending
+	 * command #6 again, and at most SUB_MAX_COUNT addresses can subscribe.
+	**/
+	SUB_MIN_INTERVAL time.Duration = time.Second
+	SUB_MAX_INTERVAL time.Duration = time.Minute
+	SUB_LIFETIME     time.Duration = time.Minute
+	SUB_MAX_COUNT    int           = 16
+	UNSUB_MSG        string        = "Unsubscribed"
+	SUB_FULL_MSG     string        = "Too many subscribers"
+
+	/**
+	 * datagrams are read by several readers into pooled buffers,
+	 * and served by workers, so that slow command doesn't block others.
+	 * there are at least MIN_WORKERS workers, even on host with fewer CPUs.
+	 * clients more than CLIENT_STAT_MAX are counted as one, not to be
+	 * flooded by spoofed addresses. client without request for CLIENT_IDLE is forgotten.
+	**/
+	READER_COUNT    int           = 4
+	MIN_WORKERS     int           = 4
+	QUEUE_SIZE      int           = 1024
+	CLIENT_STAT_MAX int           = 4096
+	OTHER_CLIENTS   string        = "others"
+	CLIENT_IDLE     time.Duration = time.Minute
+
+	/**
+	 * source validation. reply larger than request is sent only when
+	 * request has cookie issued to its source address(HelloVerify-like),
+	 * otherwise COOKIE_NEEDED is sent, which is not larger than any request.
+	 * it is one byte that is not UTF-8, so reply of any command(UTF-8 text) can't be same with it.
+	 * cookie request should be padded to COOKIE_REQUEST_SIZE bytes.
+	 * when SHARED_KEY_ENV is set, every request should be signed with it.
+	**/
+	COOKIE_WINDOW       time.Duration = 30 * time.Second
+	COOKIE_SIZE         int           = 16
+	COOKIE_HEADER_SIZE  int           = 1 + COOKIE_SIZE
+	COOKIE_REQUEST_SIZE int           = 32
+	COOKIE_REPLY        string        = "0cookie:"
+	COOKIE_NEEDED       string        = "\xff"
+	SHARED_KEY_ENV      string        = "EASYUDP_KEY"
+	SIGN_HEADER_SIZE    int           = 1 + 16 + 64
+	REPLAY_WINDOW       time.Duration = 30 * time.Second
+	REPLAY_MAX_MACS     int           = 100000 // remembered MACs, see checkSignature
+
+	// LAN discovery (see serveDiscovery)
+	DISCOVERY_GROUP      string = "239.255.20.45"
+	DISCOVERY_PORT       int    = 20455
+	DISCOVERY_QUERY      string = "DISCOVER"
+	DISCOVERY_REPLY      string = "SERVICE"
+	DISCOVERY_QUERY_SIZE int    = 64
+	SERVICE_TYPE         string = "command-udp"
+	SERVICE_VERSION      string = "1.0.0"
 )
 
+/**
+ * status subscription of one udp address.
+ * renew is used to extend expiration time and change interval.
+**/
+type subscription struct {
+	stop  chan bool
+	renew chan time.Duration
+}
+
+/**
+ * received datagram, passed from reader to worker.
+ * buf is returned to bufferPool after it is served.
+**/
+type packet struct {
+	buf   *[]byte
+	count int
+	addr  net.Addr
+}
+
+/**
+ * per-client counters, key is client's address string.
+**/
+type clientStat struct {
+	requests, bytes int64
+	last            time.Time // time of last request
+}
+
 var (
-	buffer           []byte = make([]byte, BUFFER_SIZE)
-	pconn            net.PacketConn
-	sender_addr      net.Addr
-	count, req_serve int
-	start_t          time.Time
-	dura             time.Duration
-	err              error
+	pconn     net.PacketConn
+	req_serve int32 // shared by workers and subscription goroutines, thus atomic
+	start_t   time.Time
+	err       error
+
+	// receiving pipeline: READER_COUNT readers -> packetQueue -> workerCount workers
+	workerCount int         = max(MIN_WORKERS, runtime.NumCPU())
+	packetQueue chan packet = make(chan packet, QUEUE_SIZE)
+	bufferPool  sync.Pool   = sync.Pool{New: func() any { buf := make([]byte, BUFFER_SIZE); return &buf }}
+	droppedPkt  int64       // packets dropped 'cause queue was full
+	statMutex   sync.Mutex
+	clientStats map[string]*clientStat = make(map[string]*clientStat)
+
+	subMutex      sync.Mutex
+	subscriptions map[string]*subscription = make(map[string]*subscription) // key: address string
+
+	cookieSecret []byte = make([]byte, 32)
+	sharedKey    []byte // nil when requests are not signed
+	macMutex     sync.Mutex
+	seenMACs     map[string]time.Time = make(map[string]time.Time)
+	lastMACPurge time.Time
 )
 
 func main() {
-	start_t = time.Now()                                 // runtime calculation start
+	start_t = time.Now() // runtime calculation start
+	rand.Read(cookieSecret)
+	if key := os.Getenv(SHARED_KEY_ENV); key != "" {
+		sharedKey = []byte(key)
+		fmt.Println("Only signed requests are served")
+	}
 	pconn, err = net.ListenPacket("udp", ":"+serverPort) //initializing server's udp
 	initCtrlCHandler()                                   //ctrl-c handler init
+	go serveDiscovery()
 
 	fmt.Println("Server is ready to receive on port " + serverPort)
+	for i := 0; i < workerCount; i++ {
+		go worker()
+	}
+	for i := 1; i < READER_COUNT; i++ {
+		go reader()
+	}
+	go printClientStats()
+	reader()
+}
+
+/**
+ * receiving datagrams into pooled buffer, and passing them to workers.
+ * when workers can't keep up, datagram is dropped instead of blocking reader.
+**/
+func reader() {
 	for {
-		cleanBuffer() // waiting for udp packet to be sent
-		if count, sender_addr, err = pconn.ReadFrom(buffer); err == nil {
-			fmt.Println("UDP message from " + sender_addr.String())
+		buf := bufferPool.Get().(*[]byte)
+		count, addr, err := pconn.ReadFrom(*buf)
+		if err != nil {
+			bufferPool.Put(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		select {
+		case packetQueue <- packet{buf: buf, count: count, addr: addr}:
+		default:
+			atomic.AddInt64(&droppedPkt, 1)
+			bufferPool.Put(buf)
+		}
+	}
+}
+
+/**
+ * serving datagrams from readers.
+**/
+func worker() {
+	for pkt := range packetQueue {
+		countClient(pkt.addr, pkt.count)
+		serveRequest((*pkt.buf)[:pkt.count], pkt.addr)
+		bufferPool.Put(pkt.buf)
+	}
+}
+
+/**
+ * serving one request, and sending reply to sender.
+**/
+func serveRequest(buffer []byte, sender_addr net.Addr) {
+	count := len(buffer)
+	fmt.Println("UDP message from " + sender_addr.String())
+
+	msg, cookieOK, ok := validateRequest(buffer, sender_addr)
+	if !ok || len(msg) == 0 { // no reply to unauthenticated request, not to be reflected
+		fmt.Println("Dropped unauthenticated message")
+		return
+	}
+
+	// no "command #5" 'cause udp doesn't make strong connection.
+	var reply []byte
+	switch msg[0] {
+	case '0': // cookie request: padded request, so that reply is not larger than request.
+		fmt.Println("Cookie request")
+		if count < COOKIE_REQUEST_SIZE {
+			return
+		}
+		reply = []byte(COOKIE_REPLY + makeCookie(sender_addr, time.Now()))
+	case '1': // command #1: get lower case string, and returns upper case string.
+		fmt.Println("Command " + string(msg[0]))
+		reply = bytes.ToUpper(msg[1:])
+	case '2': // command #2: returns client's IP address and Port #.
+		fmt.Println("Command " + string(msg[0]))
+		reply = []byte(sender_addr.String())
+	case '3': // command #3: returns the number of requests served before this command.
+		fmt.Println("Command " + string(msg[0]))
+		reply = []byte(strconv.Itoa(int(atomic.LoadInt32(&req_serve))))
+	case '4': // command #4: returns server's running time.
+		fmt.Println("Command " + string(msg[0]))
+		hh, mm, ss := getRuntime(time.Since(start_t))
+		reply = []byte(fmt.Sprintf("%02d:%02d:%02d", hh, mm, ss))
+	case '6': // command #6: subscribes server status, pushed every <data> seconds until command #7 or expiration.
+		fmt.Println("Command " + string(msg[0]))
+		if !cookieOK { // updates should be sent only to validated address
+			reply = []byte(COOKIE_NEEDED)
+			break
+		}
+		interval := parseInterval(string(msg[1:]))
+		if subscribe(sender_addr, interval) {
+			reply = []byte(fmt.Sprintf("Subscribed every %d seconds\n", interval/time.Second))
+		} else {
+			reply = []byte(SUB_FULL_MSG)
+		}
+	case '7': // command #7: unsubscribes server status.
+		fmt.Println("Command " + string(msg[0]))
+		if !cookieOK {
+			reply = []byte(COOKIE_NEEDED)
+			break
+		}
+		unsubscribe(sender_addr)
+		reply = []byte(UNSUB_MSG + "\n")
+	default: // error handling: not defined messages
+		reply = []byte("Wrong command")
+	}
+
+	if !cookieOK && len(reply) > count { // reply larger than request needs validated source
+		reply = []byte(COOKIE_NEEDED)
+	}
+	pconn.WriteTo(reply, sender_addr)
+	atomic.AddInt32(&req_serve, 1)
+}
+
+/**
+ * checking signature(when shared key is set) and cookie of request.
+ * returns <command><data> part of the message, whether cookie is valid,
+ * and whether the message should be served.
+ *
+ * signed message: "S"<timestamp: 16 hex>< HMAC-SHA256(key, timestamp + rest): 64 hex><rest>
+ * cookie message: "C"<cookie: 16 hex><command><data>
+**/
+func validateRequest(msg []byte, addr net.Addr) (rest []byte, cookieOK, ok bool) {
+	if sharedKey != nil {
+		if len(msg) < SIGN_HEADER_SIZE || msg[0] != 'S' {
+			return nil, false, false
+		}
+		ts, mac := msg[1:17], msg[17:SIGN_HEADER_SIZE]
+		rest = msg[SIGN_HEADER_SIZE:]
+		if !checkSignature(ts, mac, rest) {
+			return nil, false, false
+		}
+		msg = rest
+	}
+
+	if len(msg) >= COOKIE_HEADER_SIZE && msg[0] == 'C' {
+		cookie, now := string(msg[1:COOKIE_HEADER_SIZE]), time.Now()
+		cookieOK = hmac.Equal([]byte(cookie), []byte(makeCookie(addr, now))) ||
+			hmac.Equal([]byte(cookie), []byte(makeCookie(addr, now.Add(-COOKIE_WINDOW)))) // issued in previous window
+		msg = msg[COOKIE_HEADER_SIZE:]
+	}
+	return msg, cookieOK, true
+}
+
+/**
+ * stateless cookie: hash of client address and time window with server secret.
+ * so server doesn't need to remember issued cookies.
+**/
+func makeCookie(addr net.Addr, t time.Time) string {
+	h := hmac.New(sha256.New, cookieSecret)
+	h.Write([]byte(addr.String()))
+	h.Write([]byte(strconv.FormatInt(t.Unix()/int64(COOKIE_WINDOW/time.Second), 10)))
+	return hex.EncodeToString(h.Sum(nil))[:COOKIE_SIZE]
+}
+
+/**
+ * verifying HMAC of signed message, and rejecting old or replayed one.
+ * replayed message is detected by remembering MACs within replay window.
+ * when REPLAY_MAX_MACS are remembered, new messages are rejected until old MACs are purged,
+ * since forgetting a MAC still in the window would let its message be replayed.
+**/
+func checkSignature(ts, mac, rest []byte) bool {
+	h := hmac.New(sha256.New, sharedKey)
+	h.Write(ts)
+	h.Write(rest)
+	if !hmac.Equal(mac, []byte(hex.EncodeToString(h.Sum(nil)))) {
+		return false
+	}
+
+	nsec, err := strconv.ParseInt(string(ts), 16, 64)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	if sent := time.Unix(0, nsec); sent.Before(now.Add(-REPLAY_WINDOW)) || sent.After(now.Add(REPLAY_WINDOW)) {
+		return false
+	}
+
+	macMutex.Lock()
+	defer macMutex.Unlock()
+	if now.Sub(lastMACPurge) > REPLAY_WINDOW { // forgetting MACs out of window, they are rejected by timestamp anyway
+		for seen, t := range seenMACs {
+			if now.Sub(t) > 2*REPLAY_WINDOW {
+				delete(seenMACs, seen)
+			}
 		}
+		lastMACPurge = now
+	}
+	if _, replayed := seenMACs[string(mac)]; replayed || len(seenMACs) >= REPLAY_MAX_MACS {
+		return false
+	}
+	seenMACs[string(mac)] = now
+	return true
+}
+
+/**
+ * parsing requested interval in seconds.
+ * wrong or out of range value is clamped, so that
+ * client can't flood itself (or spoofed address) with updates.
+**/
+func parseInterval(data string) time.Duration {
+	sec, err := strconv.Atoi(data)
+	interval := time.Duration(sec) * time.Second
+	if err != nil || interval < SUB_MIN_INTERVAL {
+		interval = SUB_MIN_INTERVAL
+	} else if interval > SUB_MAX_INTERVAL {
+		interval = SUB_MAX_INTERVAL
+	}
+	return interval
+}
+
+/**
+ * registers new subscription, or renews existing one.
+ * returns false when subscriber table is full.
+**/
+func subscribe(addr net.Addr, interval time.Duration) bool {
+	subMutex.Lock()
+	defer subMutex.Unlock()
+
+	if s, exist := subscriptions[addr.String()]; exist {
+		select {
+		case s.renew <- interval:
+		default: // renewal already pending
+		}
+		return true
+	}
+	if len(subscriptions) >= SUB_MAX_COUNT {
+		return false
+	}
+
+	s := &subscription{stop: make(chan bool), renew: make(chan time.Duration, 1)}
+	subscriptions[addr.String()] = s
+	go pushStatus(addr, interval, s)
+	return true
+}
+
+/**
+ * removes subscription of the address, if exists.
+**/
+func unsubscribe(addr net.Addr) {
+	subMutex.Lock()
+	defer subMutex.Unlock()
+
+	if s, exist := subscriptions[addr.String()]; exist {
+		delete(subscriptions, addr.String())
+		close(s.stop)
+	}
+}
+
+/**
+ * pushing "<request count> <running time> <subscribers>"
+ * to subscribed address periodically, until unsubscribed or expired.
+ * udp has no connection, so the number of subscribers is reported as clients.
+**/
+func pushStatus(addr net.Addr, interval time.Duration, s *subscription) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	expire := time.NewTimer(SUB_LIFETIME)
+	defer expire.Stop()
 
-		// no "command #5" 'cause udp doesn't make strong connection.
-		switch buffer[0] {
-		case '1': // command #1: get lower case string, and returns upper case string.
-			fmt.Println("Command " + string(buffer[0]))
-			pconn.WriteTo(bytes.ToUpper(buffer[1:count]), sender_addr)
-		case '2': // command #2: returns client's IP address and Port #.
-			fmt.Println("Command " + string(buffer[0]))
-			pconn.WriteTo([]byte(sender_addr.String()), sender_addr)
-		case '3': // command #3: returns the number of requests served before this command.
-			fmt.Println("Command " + string(buffer[0]))
-			pconn.WriteTo([]byte(strconv.Itoa(req_serve)), sender_addr)
-		case '4': // command #4: returns server's running time.
-			fmt.Println("Command " + string(buffer[0]))
-			dura = time.Since(start_t)
-			hh, mm, ss := getRuntime()
-			pconn.WriteTo([]byte(fmt.Sprintf("%02d:%02d:%02d", hh, mm, ss)), sender_addr)
-		default: // error handling: not defined messages
-			pconn.WriteTo([]byte("Wrong command"), sender_addr)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case interval = <-s.renew:
+			ticker.Reset(interval)
+			expire.Reset(SUB_LIFETIME)
+		case <-expire.C:
+			subMutex.Lock()
+			select {
+			case interval = <-s.renew: // renewed right before expiration
+				subMutex.Unlock()
+				ticker.Reset(interval)
+				expire.Reset(SUB_LIFETIME)
+				continue
+			default:
+			}
+			if subscriptions[addr.String()] == s { // not removed by unsubscribe yet
+				delete(subscriptions, addr.String())
+			}
+			subMutex.Unlock()
+			return
+		case <-ticker.C:
+			subMutex.Lock()
+			clients := len(subscriptions)
+			subMutex.Unlock()
+
+			hh, mm, ss := getRuntime(time.Since(start_t))
+			msg := fmt.Sprintf("requests served = %d, run time = %02d:%02d:%02d, clients = %d\n",
+				atomic.LoadInt32(&req_serve), hh, mm, ss, clients)
+			pconn.WriteTo([]byte(msg), addr)
 		}
+	}
+}
 
-		req_serve++
+/**
+ * answering LAN discovery query, so that clients can find this server.
+ * query: "DISCOVER"[" "<service type>], padded to DISCOVERY_QUERY_SIZE bytes
+ * reply: "SERVICE "<service type>" "<version>" "<port>" "<instance id>
+ * multicast listener shares the port with other servers on the same host,
+ * and receives broadcast query too. short query is ignored, not to be reflected.
+**/
+func serveDiscovery() {
+	pc, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(DISCOVERY_GROUP), Port: DISCOVERY_PORT})
+	if err != nil {
+		fmt.Println("Discovery is not available:", err)
+		return
+	}
+	defer pc.Close()
+
+	instanceID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	announce := []byte(DISCOVERY_REPLY + " " + SERVICE_TYPE + " " + SERVICE_VERSION + " " + serverPort + " " + instanceID)
+	buf := make([]byte, DISCOVERY_QUERY_SIZE)
+	for {
+		cnt, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := strings.Fields(string(buf[:cnt]))
+		if cnt < DISCOVERY_QUERY_SIZE || len(query) == 0 || query[0] != DISCOVERY_QUERY ||
+			(len(query) > 1 && query[1] != SERVICE_TYPE) {
+			continue
+		}
+		pc.WriteTo(announce, addr)
 	}
 }
 
 /**
  * interpreting time.Duration to Hour, Minute, and Second.
 **/
-func getRuntime() (hh, mm, ss time.Duration) {
+func getRuntime(dura time.Duration) (hh, mm, ss time.Duration) {
 	hh = dura / time.Hour
 	dura %= time.Hour
 	mm = dura / time.Minute
@@ -87,12 +494,57 @@ func getRuntime() (hh, mm, ss time.Duration) {
 }
 
 /**
- * for not allocating buffer every time,
- * program should clean buffer every time
+ * counting requests and bytes per client.
 **/
-func cleanBuffer() {
-	for i := 0; i < BUFFER_SIZE; i++ {
-		buffer[i] = 0
+func countClient(addr net.Addr, count int) {
+	statMutex.Lock()
+	defer statMutex.Unlock()
+
+	key := addr.String()
+	stat, exist := clientStats[key]
+	if !exist {
+		if len(clientStats) >= CLIENT_STAT_MAX {
+			key = OTHER_CLIENTS
+			stat = clientStats[key]
+		}
+		if stat == nil {
+			stat = &clientStat{}
+			clientStats[key] = stat
+		}
+	}
+	stat.requests++
+	stat.bytes += int64(count)
+	stat.last = time.Now()
+}
+
+/**
+ * removing clients idle for CLIENT_IDLE, and returns the number of remaining ones.
+**/
+func pruneClients() int {
+	statMutex.Lock()
+	defer statMutex.Unlock()
+
+	for key, stat := range clientStats {
+		if time.Since(stat.last) > CLIENT_IDLE {
+			delete(clientStats, key)
+		}
+	}
+	return len(clientStats)
+}
+
+/**
+ * print received packets per second, and the number of clients active in last CLIENT_IDLE
+ * periodically, 1 minute.
+**/
+func printClientStats() {
+	var lastReq int32
+	for {
+		time.Sleep(time.Minute)
+		req := atomic.LoadInt32(&req_serve)
+		clients := pruneClients()
+		fmt.Printf("1 minute passed. %.1f requests/sec from %d active clients, %d packets dropped\n",
+			float64(req-lastReq)/60, clients, atomic.LoadInt64(&droppedPkt))
+		lastReq = req
 	}
 }
 
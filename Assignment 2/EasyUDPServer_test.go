@@ -0,0 +1,110 @@
+/**
+ * Author: 20170454 YiChangmin
+ *
+ * benchmark of receiving pipeline, compared with single ReadFrom loop.
+ * go test -run NONE -bench . EasyUDPServer.go EasyUDPServer_test.go
+**/
+
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	BENCH_PARALLELISM int           = 8 // clients per GOMAXPROCS
+	BENCH_TIMEOUT     time.Duration = 200 * time.Millisecond
+)
+
+var benchWorkers sync.Once // workers read packetQueue until the test binary ends
+
+/**
+ * replies per second of command 1 with concurrent clients, served by reader/worker pipeline.
+**/
+func BenchmarkPipeline(b *testing.B) {
+	benchServer(b, func() {
+		benchWorkers.Do(func() {
+			for i := 0; i < workerCount; i++ {
+				go worker()
+			}
+		})
+		for i := 1; i < READER_COUNT; i++ {
+			go reader()
+		}
+		reader()
+	})
+}
+
+/**
+ * same with BenchmarkPipeline, served by one ReadFrom loop like before the pipeline.
+**/
+func BenchmarkSingleLoop(b *testing.B) {
+	benchServer(b, func() {
+		buffer := make([]byte, BUFFER_SIZE)
+		for {
+			count, addr, err := pconn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			countClient(addr, count)
+			serveRequest(buffer[:count], addr)
+		}
+	})
+}
+
+/**
+ * running serve on new loopback socket while clients send command 1 and wait for its reply.
+ * lost datagram is sent again after BENCH_TIMEOUT. log of server is discarded.
+**/
+func benchServer(b *testing.B, serve func()) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	b.Cleanup(func() {
+		os.Stdout = stdout
+		devNull.Close()
+	})
+
+	if pconn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+		b.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		serve()
+		close(done)
+	}()
+	defer func() {
+		pconn.Close()
+		<-done
+	}()
+
+	server := pconn.LocalAddr()
+	b.SetParallelism(BENCH_PARALLELISM)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("udp", server.String())
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+		request, buffer := []byte("1hello"), make([]byte, BUFFER_SIZE)
+		for pb.Next() {
+			for {
+				conn.Write(request)
+				conn.SetReadDeadline(time.Now().Add(BENCH_TIMEOUT))
+				if _, err := conn.Read(buffer); err == nil {
+					break
+				}
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "replies/s")
+}
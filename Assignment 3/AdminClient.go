@@ -0,0 +1,122 @@
+/**
+ * 20170454 YiChangmin
+ * admin client of MultiClientTCPServer and ChatTCPServer.
+ * both servers use same admin messages: "9"<admin command>, reply: "9"<result>
+ * replies of both servers are framed as chat protocol: 4-byte big-endian length + message.
+ *
+ * usage: AdminClient [-chat] <host:port> <admin command> ...
+ * e.g. AdminClient localhost:20454 STATS "KICK 3" "LOGLEVEL info"
+ * with -chat, requests are framed too.
+ * shared secret is read from the environment variable of the server, COMMAND_ADMIN_SECRET,
+ * or CHAT_ADMIN_SECRET with -chat. ADMIN_SECRET is used when it is not set.
+ * challenge-response is done before the commands.
+**/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	FRAME_HEADER       int           = 4
+	MAX_FRAME_SIZE     uint32        = 1 << 20
+	ADMIN_HEADER       string        = "9"
+	ADMIN_SECRET_ENV   string        = "ADMIN_SECRET" // used when variable of the server is not set
+	COMMAND_SECRET_ENV string        = "COMMAND_ADMIN_SECRET"
+	CHAT_SECRET_ENV    string        = "CHAT_ADMIN_SECRET"
+	REPLY_TIMEOUT      time.Duration = 5 * time.Second
+)
+
+var (
+	conn     net.Conn
+	chatMode bool
+)
+
+func main() {
+	flag.BoolVar(&chatMode, "chat", false, "server is ChatTCPServer, which uses framed messages")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		fmt.Println("usage: AdminClient [-chat] <host:port> <admin command> ...")
+		fmt.Println("secret is read from " + COMMAND_SECRET_ENV + ", or " + CHAT_SECRET_ENV + " with -chat, or " + ADMIN_SECRET_ENV)
+		os.Exit(1)
+	}
+	secretEnv := COMMAND_SECRET_ENV
+	if chatMode {
+		secretEnv = CHAT_SECRET_ENV
+	}
+	secret := os.Getenv(secretEnv)
+	if secret == "" {
+		secret = os.Getenv(ADMIN_SECRET_ENV)
+	}
+	if secret == "" {
+		fmt.Println(secretEnv + " or " + ADMIN_SECRET_ENV + " is not set")
+		os.Exit(1)
+	}
+
+	var err error
+	if conn, err = net.Dial("tcp", flag.Arg(0)); err != nil {
+		fmt.Println("Can't find server")
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	// challenge-response: secret itself is never sent
+	challenge := request("AUTH")
+	if !strings.HasPrefix(challenge, "CHALLENGE ") {
+		fmt.Println(challenge)
+		os.Exit(1)
+	}
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(strings.TrimPrefix(challenge, "CHALLENGE ")))
+	if reply := request("AUTH " + hex.EncodeToString(h.Sum(nil))); reply != "OK" {
+		fmt.Println(reply)
+		os.Exit(1)
+	}
+
+	for _, cmd := range flag.Args()[1:] {
+		fmt.Println(cmd + ": " + request(cmd))
+	}
+	if !chatMode { // chat server ends admin connection when it is closed
+		conn.Write([]byte("5"))
+	}
+}
+
+/**
+ * sends admin command, and returns its result.
+ * when server doesn't answer, program stops.
+**/
+func request(cmd string) string {
+	conn.SetDeadline(time.Now().Add(REPLY_TIMEOUT))
+	msg := []byte(ADMIN_HEADER + cmd)
+	if chatMode {
+		msg = binary.BigEndian.AppendUint32(nil, uint32(len(msg)))
+		msg = append(msg, ADMIN_HEADER+cmd...)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		fmt.Println("Error occured while sending request")
+		os.Exit(1)
+	}
+
+	header := make([]byte, FRAME_HEADER)
+	if _, err := io.ReadFull(conn, header); err != nil || binary.BigEndian.Uint32(header) > MAX_FRAME_SIZE {
+		fmt.Println("Error occured while receiving reply")
+		os.Exit(1)
+	}
+	reply := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		fmt.Println("Error occured while receiving reply")
+		os.Exit(1)
+	}
+	return strings.TrimPrefix(string(reply), ADMIN_HEADER)
+}
@@ -0,0 +1,344 @@
+/**
+ * 20170454 YiChangmin
+ * tcp load balancer in front of several MultiClientTCPServer.
+ * protocol messages are same with Assignment 2, and relayed as they are,
+ * except command #3, which is answered with the sum of backends' request counts.
+ * when some backend can't be counted, the reply says so after the sum.
+ *
+ * usage: CommandLoadBalancer [-port 20456] [-policy rr|lc] <backend host:port> ...
+ * rr: round-robin, lc: least-connections
+ * backends are probed with status command "S" periodically, and unhealthy one is ejected
+ * until it answers again. "S" is not counted as request by backend, so probes and
+ * request counting don't change the count.
+**/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	BUFFER_SIZE int = 1024
+
+	POLICY_ROUND_ROBIN string = "rr"
+	POLICY_LEAST_CONN  string = "lc"
+
+	HEALTH_INTERVAL     time.Duration = 5 * time.Second
+	PROBE_TIMEOUT       time.Duration = 2 * time.Second
+	UNHEALTHY_THRESHOLD int           = 2 // consecutive failed probes to eject backend
+	HEALTHY_THRESHOLD   int           = 1 // consecutive successful probes to reinstate backend
+
+	STATUS_CMD        string = "S" // "<requests served> <running time>" from backend
+	NO_BACKEND_MSG    string = "No server available"
+	PARTIAL_COUNT_FMT string = "%d (%d of %d servers not counted)"
+)
+
+/**
+ * backend server state. healthy, fails and passes are guarded by backendMutex.
+ * conns is the number of relayed client connections.
+**/
+type backend struct {
+	addr          string
+	healthy       bool
+	fails, passes int
+	conns         int32
+}
+
+var (
+	listener net.Listener
+	port     string
+	policy   string
+
+	backendMutex sync.Mutex
+	backends     []*backend
+	rrIndex      int
+	curClient    int32 = 0
+)
+
+func main() {
+	flag.StringVar(&port, "port", "20456", "port to listen for clients")
+	flag.StringVar(&policy, "policy", POLICY_ROUND_ROBIN, "balancing policy, rr(round-robin) or lc(least-connections)")
+	flag.Parse()
+	if flag.NArg() == 0 || (policy != POLICY_ROUND_ROBIN && policy != POLICY_LEAST_CONN) {
+		flag.Usage()
+		return
+	}
+	for _, addr := range flag.Args() {
+		backends = append(backends, &backend{addr: addr, healthy: true}) // healthy until first probe says not
+	}
+
+	var err error
+	if listener, err = net.Listen("tcp", ":"+port); err != nil {
+		fmt.Println("Cannot listen on port", port)
+		return
+	}
+	ctrlCHandler()
+	go healthCheck()
+
+	fmt.Println("Load balancer is ready to receive on port", port, "with", len(backends), "backends")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			continue
+		}
+		go relay(conn)
+	}
+}
+
+/**
+ * relaying one client to backend. when backend can't be connected,
+ * another one is tried, and client is closed when none is left.
+**/
+func relay(client net.Conn) {
+	defer client.Close()
+
+	var server net.Conn
+	var b *backend
+	tried := make(map[*backend]bool)
+	for server == nil {
+		if b = pickBackend(tried); b == nil {
+			client.Write([]byte(NO_BACKEND_MSG))
+			return
+		}
+		tried[b] = true
+
+		var err error
+		if server, err = net.DialTimeout("tcp", b.addr, PROBE_TIMEOUT); err != nil {
+			fmt.Println("Cannot connect backend", b.addr)
+			markBackend(b, false)
+		}
+	}
+	defer server.Close()
+
+	atomic.AddInt32(&b.conns, 1)
+	defer atomic.AddInt32(&b.conns, -1)
+	fmt.Printf("Client %s relayed to %s. Number of connected clients = %d\n",
+		client.RemoteAddr().String(), b.addr, atomic.AddInt32(&curClient, 1))
+	defer func() {
+		fmt.Println("Client", client.RemoteAddr().String(), "disconnected. Number of connected clients =",
+			atomic.AddInt32(&curClient, -1))
+	}()
+
+	// client waits for reply before next command, so command starts at the first
+	// read after reply. reads before reply are the rest of command split by tcp,
+	// and relayed without looking at their first byte.
+	// pushed update also ends command, since it can't be told apart from reply.
+	var pending int32 // 1 while command is relayed and not replied
+	done := make(chan bool, 2)
+	go func() { // backend to client: replies and pushed updates are copied as they are
+		buffer := make([]byte, BUFFER_SIZE)
+		for {
+			count, err := server.Read(buffer)
+			if err != nil {
+				break
+			}
+			atomic.StoreInt32(&pending, 0)
+			if _, err = client.Write(buffer[:count]); err != nil {
+				break
+			}
+		}
+		done <- true
+	}()
+	go func() { // client to backend: command #3 is answered here
+		buffer := make([]byte, BUFFER_SIZE)
+		for {
+			count, err := client.Read(buffer)
+			if err != nil {
+				server.Write([]byte("5")) // backend should know client has gone
+				break
+			}
+			cmd := byte(0) // 0 for the rest of command
+			if atomic.SwapInt32(&pending, 1) == 0 {
+				cmd = buffer[0]
+			}
+			if cmd == '3' {
+				_, err = client.Write([]byte(requestCountReply()))
+				atomic.StoreInt32(&pending, 0)
+			} else {
+				_, err = server.Write(buffer[:count])
+			}
+			if err != nil || cmd == '5' {
+				break
+			}
+		}
+		done <- true
+	}()
+	<-done // either side is closed, then deferred Close() stops the other
+}
+
+/**
+ * choosing healthy backend not in exclude, by policy.
+ * returns nil when there is no such backend.
+**/
+func pickBackend(exclude map[*backend]bool) *backend {
+	backendMutex.Lock()
+	defer backendMutex.Unlock()
+
+	var picked *backend
+	for i := 0; i < len(backends); i++ {
+		b := backends[(rrIndex+i)%len(backends)]
+		if !b.healthy || exclude[b] {
+			continue
+		}
+		if policy == POLICY_ROUND_ROBIN {
+			rrIndex = (rrIndex + i + 1) % len(backends)
+			return b
+		}
+		if picked == nil || atomic.LoadInt32(&b.conns) < atomic.LoadInt32(&picked.conns) {
+			picked = b
+		}
+	}
+	return picked
+}
+
+/**
+ * recording result of probe or connection.
+ * backend is ejected after UNHEALTHY_THRESHOLD consecutive failures,
+ * and reinstated after HEALTHY_THRESHOLD consecutive successes.
+**/
+func markBackend(b *backend, ok bool) {
+	backendMutex.Lock()
+	defer backendMutex.Unlock()
+
+	if ok {
+		b.fails, b.passes = 0, b.passes+1
+		if !b.healthy && b.passes >= HEALTHY_THRESHOLD {
+			b.healthy = true
+			fmt.Println("Backend", b.addr, "is healthy again")
+		}
+	} else {
+		b.fails, b.passes = b.fails+1, 0
+		if b.healthy && b.fails >= UNHEALTHY_THRESHOLD {
+			b.healthy = false
+			fmt.Println("Backend", b.addr, "is ejected")
+		}
+	}
+}
+
+/**
+ * probing every backend with status command, periodically.
+**/
+func healthCheck() {
+	for {
+		var wg sync.WaitGroup
+		for _, b := range backends {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				_, err := queryStatus(b.addr)
+				markBackend(b, err == nil)
+			}(b)
+		}
+		wg.Wait()
+		time.Sleep(HEALTH_INTERVAL)
+	}
+}
+
+/**
+ * reply of command #3, sum of request counts of backends.
+ * unhealthy backend and backend not answering in time are not counted,
+ * and the number of them is added to reply, e.g. "120 (1 of 3 servers not counted)".
+**/
+func requestCountReply() string {
+	var total int64
+	var missing int32 // backends not answering
+	var wg sync.WaitGroup
+
+	backendMutex.Lock()
+	unhealthy := 0
+	for _, b := range backends {
+		if !b.healthy {
+			unhealthy++
+			continue
+		}
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if cnt, err := queryStatus(addr); err == nil {
+				atomic.AddInt64(&total, int64(cnt))
+			} else {
+				atomic.AddInt32(&missing, 1)
+			}
+		}(b.addr)
+	}
+	backendMutex.Unlock()
+
+	wg.Wait()
+	missing += int32(unhealthy)
+	if missing > 0 {
+		fmt.Println("Request count is missing from", missing, "backends")
+		return fmt.Sprintf(PARTIAL_COUNT_FMT, total, missing, len(backends))
+	}
+	return strconv.FormatInt(total, 10)
+}
+
+/**
+ * asking backend its status, and returns its request count.
+**/
+func queryStatus(addr string) (int, error) {
+	reply, err := query(addr, STATUS_CMD)
+	if err != nil {
+		return 0, err
+	}
+	var cnt, hh, mm, ss int
+	if _, err = fmt.Sscanf(reply, "%d %d:%d:%d", &cnt, &hh, &mm, &ss); err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+/**
+ * sending one command to backend with new connection, and returns its reply.
+**/
+func query(addr, cmd string) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, PROBE_TIMEOUT)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(PROBE_TIMEOUT))
+	buffer := make([]byte, BUFFER_SIZE)
+	if _, err = conn.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+	count, err := conn.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	conn.Write([]byte("5"))
+	return string(buffer[:count]), nil
+}
+
+/**
+ * receiving ctrl-c interrupt from os
+**/
+func ctrlCHandler() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		cleanupAndExit()
+	}()
+}
+
+/**
+ * terminating function
+**/
+func cleanupAndExit() {
+	if listener != nil {
+		listener.Close()
+	}
+	fmt.Println("\nBye bye~")
+	os.Exit(0)
+}
@@ -7,12 +7,21 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -21,36 +30,151 @@ import (
 const (
 	serverPort  string = "20454"
 	BUFFER_SIZE int    = 1024
+
+	SUB_MIN_INTERVAL time.Duration = time.Second
+	SUB_MAX_INTERVAL time.Duration = time.Minute
+	UNSUB_MSG        string        = "Unsubscribed"
+
+	/**
+	 * key-value store, command #8: "8"<KV command>" "<arguments>
+	 * SET <key> <value>, GET <key>, DEL <key>, INCR <key>, EXPIRE <key> <seconds>
+	 * every change is appended to KV_LOG_FILE, and replayed when server starts.
+	 * log is rewritten with current keys only when server starts, and when it has grown
+	 * over KV_COMPACT_SIZE and twice as large as the keys(see compactKVLog).
+	**/
+	KV_LOG_FILE    string = "kvstore.log"
+	KV_OK          string = "OK"
+	KV_NIL         string = "(nil)"
+	KV_ERR_SYNTAX  string = "ERR wrong command format"
+	KV_ERR_NOT_INT string = "ERR value is not an integer"
+	KV_ERR_LOG     string = "ERR cannot write log"
+
+	KV_COMPACT_SIZE int64 = 1 << 20 // see compactKVLog
+
+	// admin command, command #9 (see handleAdmin)
+	ADMIN_SECRET_ENV   string = "COMMAND_ADMIN_SECRET"
+	ADMIN_HEADER       string = "9"
+	ADMIN_OK           string = "OK"
+	ADMIN_ERR_AUTH     string = "ERR authentication required"
+	ADMIN_ERR_FORMAT   string = "ERR wrong admin command"
+	ADMIN_ERR_DISABLED string = "ERR admin is disabled"
+	DRAINING_MSG       string = "Server is draining"
+
+	// per-client accounting, command #0 (see countRequest)
+	STATS_TOP_N int = 5
+
+	LOG_QUIET int32 = 0
+	LOG_INFO  int32 = 1
+	LOG_DEBUG int32 = 2
+
+	// LAN discovery (see serveDiscovery)
+	DISCOVERY_GROUP      string = "239.255.20.45"
+	DISCOVERY_PORT       int    = 20455
+	DISCOVERY_QUERY      string = "DISCOVER"
+	DISCOVERY_REPLY      string = "SERVICE"
+	DISCOVERY_QUERY_SIZE int    = 64
+	SERVICE_TYPE         string = "command-tcp"
+	SERVICE_VERSION      string = "1.0.0"
 )
 
+/**
+ * status subscription of one client.
+ * stop is closed to end pushing, and done is closed
+ * by pushing goroutine after its last write.
+**/
+type subscription struct {
+	stop, done chan bool
+}
+
+/**
+ * admin authentication state of one connection.
+ * challenge is issued by "AUTH", and consumed by "AUTH <response>".
+**/
+type adminSession struct {
+	challenge string
+	authed    bool
+}
+
+/**
+ * request accounting of one client number or one source ip.
+ * bytes are application messages, not including pushed status.
+ * commands counts requests by command character.
+**/
+type clientStat struct {
+	requests          int
+	bytesIn, bytesOut int
+	commands          map[byte]int
+}
+
+/**
+ * value of key-value store. zero expire time means no ttl.
+**/
+type kvEntry struct {
+	value  string
+	expire time.Time
+}
+
 var (
 	listener    net.Listener
 	start_t     time.Time
 	req_serve   int32 = 0
 	totalClient int32 = 0
 	curClient   int32 = 0
+
+	kvMutex    sync.Mutex          // guards kvStore and kvLog, so that log order is same with applying order
+	kvStore    map[string]*kvEntry = make(map[string]*kvEntry)
+	kvLog      *os.File
+	kvLogSize  int64 = 0 // bytes of kvLog
+	kvSnapSize int64 = 0 // bytes of kvLog right after last compaction
+
+	statMutex   sync.Mutex                                            // guards clientStats and ipStats
+	clientStats map[int32]*clientStat  = make(map[int32]*clientStat)  // connected clients only
+	ipStats     map[string]*clientStat = make(map[string]*clientStat) // kept after clients leave
+
+	connMutex   sync.Mutex
+	clientConns map[int32]net.Conn = make(map[int32]net.Conn) // client number to connection, for admin KICK
+	adminSecret []byte                                        // nil when admin is disabled
+	draining    int32              = 0
+	logLevel    int32              = LOG_DEBUG
+	LOG_LEVELS  []string           = []string{"quiet", "info", "debug"}
 )
 
 func main() {
-	start_t = time.Now()                            // server running time init
+	start_t = time.Now() // server running time init
+	if secret := os.Getenv(ADMIN_SECRET_ENV); secret != "" {
+		adminSecret = []byte(secret)
+	}
+	if err := loadKVStore(); err != nil {
+		fmt.Println("Cannot open key-value log:", err)
+		return
+	}
 	listener, _ = net.Listen("tcp", ":"+serverPort) // tcp init
 
 	ctrlCHandler()
 	go printTotalClientCount()
+	go serveDiscovery()
 
 	fmt.Println("Server is ready to receive on port", serverPort)
 	for {
 		conn, _ := listener.Accept() // when connection is made, call serverThread() with conn as parameter
 		if conn != nil {
-			fmt.Println("Connection request from", conn.RemoteAddr().String())
+			logInfo("Connection request from", conn.RemoteAddr().String())
+			if atomic.LoadInt32(&draining) == 1 { // no new client while draining
+				conn.Write([]byte(DRAINING_MSG))
+				conn.Close()
+				continue
+			}
 
 			/**
 			 * do multi-thread stuff
 			 * all the accesss to global variable use atomic function(concurrency control)
 			**/
 			thrNum := atomic.AddInt32(&totalClient, 1)
-			fmt.Println("Client", thrNum, "connected. Number of connected clients =", atomic.AddInt32(&curClient, 1))
-			go serverThread(conn, totalClient)
+			connMutex.Lock()
+			clientConns[thrNum] = conn
+			connMutex.Unlock()
+			logInfo("Client", thrNum, "connected. Number of connected clients =", atomic.AddInt32(&curClient, 1))
+			go serverThread(conn, thrNum)
 		}
 	}
 }
@@ -62,50 +186,597 @@ func main() {
 **/
 func serverThread(conn net.Conn, thrNum int32) {
 	buffer := make([]byte, BUFFER_SIZE)
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	var sub *subscription
+	var admin adminSession
 TASK:
 	for {
-		count, _ := conn.Read(buffer)
+		count, err := conn.Read(buffer)
+		if err != nil { // connection lost(or kicked) without command #5, same as disconnection
+			stopSubscription(sub)
+			break
+		}
 
+		var reply []byte
 		switch buffer[0] {
+		case '0': // command #0: returns statistics of this client and its ip address.
+			logDebug("Command " + string(buffer[0]))
+			reply = []byte(myStats(thrNum, ip))
 		case '1': // command #1: get lower case string, and returns upper case string.
-			fmt.Println("Command " + string(buffer[0]))
-			conn.Write(bytes.ToUpper(buffer[1:count]))
+			logDebug("Command " + string(buffer[0]))
+			reply = bytes.ToUpper(buffer[1:count])
 		case '2': // command #2: returns client's IP address and Port #.
-			fmt.Println("Command " + string(buffer[0]))
-			conn.Write([]byte(conn.RemoteAddr().String()))
+			logDebug("Command " + string(buffer[0]))
+			reply = []byte(conn.RemoteAddr().String())
 		case '3': // command #3: returns the number of requests served before this command.
-			fmt.Println("Command " + string(buffer[0]))
-			conn.Write([]byte(strconv.Itoa(int(atomic.LoadInt32(&req_serve)))))
+			logDebug("Command " + string(buffer[0]))
+			reply = []byte(strconv.Itoa(int(atomic.LoadInt32(&req_serve))))
 		case '4': // command #4: returns server's running time.
-			fmt.Println("Command " + string(buffer[0]))
-			dura := time.Since(start_t)
-			hh := dura / time.Hour
-			dura %= time.Hour
-			mm := dura / time.Minute
-			dura %= time.Minute
-			ss := dura / time.Second
-			conn.Write([]byte(fmt.Sprintf("%02d:%02d:%02d", hh, mm, ss)))
+			logDebug("Command " + string(buffer[0]))
+			hh, mm, ss := getRuntime(time.Since(start_t))
+			reply = []byte(fmt.Sprintf("%02d:%02d:%02d", hh, mm, ss))
 		case '5': // command #5: receives client's disconnection message, and reduce total client count
-			fmt.Println("Client", thrNum, "disconnected. Number of connected clients =", atomic.AddInt32(&curClient, -1))
+			stopSubscription(sub)
 			break TASK
+		case '6': // command #6: subscribes server status, pushed every <data> seconds until command #7.
+			logDebug("Command " + string(buffer[0]))
+			stopSubscription(sub)
+			interval := parseInterval(string(buffer[1:count]))
+			reply = []byte(fmt.Sprintf("Subscribed every %d seconds\n", interval/time.Second))
+			sub = &subscription{stop: make(chan bool), done: make(chan bool)}
+			go pushStatus(conn, interval, sub) // first update is pushed after interval, so reply comes first
+		case '7': // command #7: unsubscribes server status.
+			logDebug("Command " + string(buffer[0]))
+			stopSubscription(sub)
+			sub = nil
+			reply = []byte(UNSUB_MSG + "\n")
+		case '8': // command #8: key-value store command, returns its result.
+			logDebug("Command " + string(buffer[0]))
+			reply = []byte(handleKV(string(buffer[1:count])))
+		case '9': // command #9: admin command, allowed after challenge-response authentication.
+			logDebug("Command " + string(buffer[0]))
+			reply = adminFrame(handleAdmin(string(buffer[1:count]), &admin))
+		case 'S': // status probe of load balancer: "<requests served> <running time>", not counted as request.
+			hh, mm, ss := getRuntime(time.Since(start_t))
+			conn.Write([]byte(fmt.Sprintf("%d %02d:%02d:%02d", atomic.LoadInt32(&req_serve), hh, mm, ss)))
+			continue
 		default: // error handling: not defined messages
-			conn.Write([]byte("Wrong command"))
+			reply = []byte("Wrong command")
 		}
 
+		conn.Write(reply)
+		countRequest(thrNum, ip, buffer[0], count, len(reply))
 		atomic.AddInt32(&req_serve, 1)
 	}
 
 	conn.Close()
+	clientLeft(thrNum)
+}
+
+/**
+ * adding one request to statistics of client number and source ip.
+ * not defined command is counted as '?'.
+**/
+func countRequest(thrNum int32, ip string, cmd byte, in, out int) {
+	if cmd < '0' || cmd > '9' {
+		cmd = '?'
+	}
+	statMutex.Lock()
+	defer statMutex.Unlock()
+
+	if clientStats[thrNum] == nil {
+		clientStats[thrNum] = &clientStat{commands: make(map[byte]int)}
+	}
+	if ipStats[ip] == nil {
+		ipStats[ip] = &clientStat{commands: make(map[byte]int)}
+	}
+	for _, stat := range []*clientStat{clientStats[thrNum], ipStats[ip]} {
+		stat.requests++
+		stat.bytesIn += in
+		stat.bytesOut += out
+		stat.commands[cmd]++
+	}
+}
+
+/**
+ * formatting statistics, e.g. "requests = 3, bytes in = 12, bytes out = 30, commands = 1:2 4:1"
+**/
+func (stat *clientStat) String() string {
+	if stat == nil {
+		stat = &clientStat{}
+	}
+	cmds := []string{}
+	for cmd, cnt := range stat.commands {
+		cmds = append(cmds, fmt.Sprintf("%c:%d", cmd, cnt))
+	}
+	sort.Strings(cmds)
+	return fmt.Sprintf("requests = %d, bytes in = %d, bytes out = %d, commands = %s",
+		stat.requests, stat.bytesIn, stat.bytesOut, strings.Join(cmds, " "))
+}
+
+/**
+ * command #0 reply. this request itself is counted after reply is made.
+**/
+func myStats(thrNum int32, ip string) string {
+	statMutex.Lock()
+	defer statMutex.Unlock()
+	return fmt.Sprintf("client %d: %s\nip %s: %s", thrNum, clientStats[thrNum], ip, ipStats[ip])
+}
+
+/**
+ * ranking of clients and source ips by request count, at most STATS_TOP_N lines each.
+**/
+func topClients() string {
+	statMutex.Lock()
+	defer statMutex.Unlock()
+
+	nums := []int32{}
+	for num := range clientStats {
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool {
+		if clientStats[nums[i]].requests != clientStats[nums[j]].requests {
+			return clientStats[nums[i]].requests > clientStats[nums[j]].requests
+		}
+		return nums[i] < nums[j]
+	})
+	ips := []string{}
+	for ip := range ipStats {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		if ipStats[ips[i]].requests != ipStats[ips[j]].requests {
+			return ipStats[ips[i]].requests > ipStats[ips[j]].requests
+		}
+		return ips[i] < ips[j]
+	})
+
+	var sb strings.Builder
+	sb.WriteString("top clients:")
+	for i := 0; i < len(nums) && i < STATS_TOP_N; i++ {
+		sb.WriteString(fmt.Sprintf("\n%d) client %d: %s", i+1, nums[i], clientStats[nums[i]]))
+	}
+	sb.WriteString("\ntop ips:")
+	for i := 0; i < len(ips) && i < STATS_TOP_N; i++ {
+		sb.WriteString(fmt.Sprintf("\n%d) ip %s: %s", i+1, ips[i], ipStats[ips[i]]))
+	}
+	return sb.String()
+}
+
+/**
+ * unregistering disconnected client. when server is draining,
+ * it stops after the last client has left.
+**/
+func clientLeft(thrNum int32) {
+	connMutex.Lock()
+	delete(clientConns, thrNum)
+	connMutex.Unlock()
+	statMutex.Lock()
+	delete(clientStats, thrNum)
+	statMutex.Unlock()
+
+	left := atomic.AddInt32(&curClient, -1)
+	logInfo("Client", thrNum, "disconnected. Number of connected clients =", left)
+	if left == 0 && atomic.LoadInt32(&draining) == 1 {
+		cleanupAndExit()
+	}
+}
+
+/**
+ * admin reply framed as chat protocol: 4-byte big-endian length + "9"<result>,
+ * so that result longer than one read(e.g. STATS) is not mixed with next reply.
+**/
+func adminFrame(result string) []byte {
+	msg := ADMIN_HEADER + result
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(msg))), msg...)
+}
+
+/**
+ * admin command, command #9: "9"<admin command>, reply: <length>"9"<result>(see adminFrame)
+ * AUTH                 returns "CHALLENGE "<nonce>
+ * AUTH <response>      response = hex(HMAC-SHA256(secret, nonce)), returns OK or ERR
+ * STATS                returns server statistics, and top clients by request count
+ * KICK <client number> disconnects the client
+ * DRAIN                stops accepting clients, and stops server after the last one leaves
+ * SHUTDOWN             stops server now
+ * LOGLEVEL <level>     quiet, info or debug
+ * admin is disabled when ADMIN_SECRET_ENV is not set.
+**/
+func handleAdmin(data string, admin *adminSession) string {
+	if adminSecret == nil {
+		return ADMIN_ERR_DISABLED
+	}
+	args := strings.Fields(data)
+	if len(args) == 0 {
+		return ADMIN_ERR_FORMAT
+	}
+
+	if strings.ToUpper(args[0]) == "AUTH" {
+		if len(args) == 1 { // new challenge, previous one can't be used anymore
+			nonce := make([]byte, 16)
+			rand.Read(nonce)
+			admin.challenge, admin.authed = hex.EncodeToString(nonce), false
+			return "CHALLENGE " + admin.challenge
+		}
+		h := hmac.New(sha256.New, adminSecret)
+		h.Write([]byte(admin.challenge))
+		admin.authed = admin.challenge != "" && hmac.Equal([]byte(args[1]), []byte(hex.EncodeToString(h.Sum(nil))))
+		admin.challenge = "" // one response for one challenge
+		if !admin.authed {
+			logInfo("Admin authentication failed")
+			return ADMIN_ERR_AUTH
+		}
+		logInfo("Admin authenticated")
+		return ADMIN_OK
+	} else if !admin.authed {
+		return ADMIN_ERR_AUTH
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "STATS":
+		hh, mm, ss := getRuntime(time.Since(start_t))
+		kvMutex.Lock()
+		keys := len(kvStore)
+		kvMutex.Unlock()
+		return fmt.Sprintf("run time = %02d:%02d:%02d, requests served = %d, total clients = %d, "+
+			"connected clients = %d, keys = %d, draining = %t, log level = %s\n%s",
+			hh, mm, ss, atomic.LoadInt32(&req_serve), atomic.LoadInt32(&totalClient),
+			atomic.LoadInt32(&curClient), keys, atomic.LoadInt32(&draining) == 1, LOG_LEVELS[atomic.LoadInt32(&logLevel)], topClients())
+	case "KICK":
+		if len(args) != 2 {
+			return ADMIN_ERR_FORMAT
+		}
+		num, err := strconv.Atoi(args[1])
+		if err != nil {
+			return ADMIN_ERR_FORMAT
+		}
+		connMutex.Lock()
+		conn, exist := clientConns[int32(num)]
+		connMutex.Unlock()
+		if !exist {
+			return "ERR no such client"
+		}
+		conn.Close() // its serverThread stops on read error
+		logInfo("Client", num, "kicked by admin")
+		return ADMIN_OK
+	case "DRAIN":
+		atomic.StoreInt32(&draining, 1) // admin's connection is also waited
+		logInfo("Server is draining")
+		return ADMIN_OK
+	case "SHUTDOWN":
+		logInfo("Shutdown by admin")
+		go func() {
+			time.Sleep(time.Second) // let reply be sent
+			cleanupAndExit()
+		}()
+		return ADMIN_OK
+	case "LOGLEVEL":
+		for level, name := range LOG_LEVELS {
+			if len(args) == 2 && strings.ToLower(args[1]) == name {
+				atomic.StoreInt32(&logLevel, int32(level))
+				return ADMIN_OK
+			}
+		}
+		return ADMIN_ERR_FORMAT
+	}
+	return ADMIN_ERR_FORMAT
+}
+
+/**
+ * logging by level. connection messages are info, and commands are debug.
+**/
+func logInfo(a ...any) {
+	if atomic.LoadInt32(&logLevel) >= LOG_INFO {
+		fmt.Println(a...)
+	}
+}
+
+func logDebug(a ...any) {
+	if atomic.LoadInt32(&logLevel) >= LOG_DEBUG {
+		fmt.Println(a...)
+	}
+}
+
+/**
+ * interpreting time.Duration to Hour, Minute, and Second.
+**/
+func getRuntime(dura time.Duration) (hh, mm, ss time.Duration) {
+	hh = dura / time.Hour
+	dura %= time.Hour
+	mm = dura / time.Minute
+	dura %= time.Minute
+	ss = dura / time.Second
+	return
+}
+
+/**
+ * parsing requested interval in seconds.
+ * wrong or out of range value is clamped, so that
+ * client can't flood itself with updates.
+**/
+func parseInterval(data string) time.Duration {
+	sec, err := strconv.Atoi(data)
+	interval := time.Duration(sec) * time.Second
+	if err != nil || interval < SUB_MIN_INTERVAL {
+		interval = SUB_MIN_INTERVAL
+	} else if interval > SUB_MAX_INTERVAL {
+		interval = SUB_MAX_INTERVAL
+	}
+	return interval
+}
+
+/**
+ * pushing "<request count> <running time> <connected clients>"
+ * to subscribed client periodically, until subscription stops.
+**/
+func pushStatus(conn net.Conn, interval time.Duration, s *subscription) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			hh, mm, ss := getRuntime(time.Since(start_t))
+			msg := fmt.Sprintf("requests served = %d, run time = %02d:%02d:%02d, clients = %d\n",
+				atomic.LoadInt32(&req_serve), hh, mm, ss, atomic.LoadInt32(&curClient))
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+/**
+ * stops the subscription if exists, and waits for pushing goroutine
+ * so that no update is written after this function returns.
+**/
+func stopSubscription(sub *subscription) {
+	if sub != nil {
+		close(sub.stop)
+		<-sub.done
+	}
+}
+
+/**
+ * interpreting key-value command, and returns reply message.
+ * key can't contain space, but value can.
+**/
+func handleKV(data string) string {
+	args := strings.SplitN(data, " ", 3)
+	if len(args) < 2 || len(args[1]) == 0 || strings.ContainsAny(data, "\r\n") {
+		return KV_ERR_SYNTAX
+	}
+	cmd, key := strings.ToUpper(args[0]), args[1]
+
+	kvMutex.Lock()
+	defer kvMutex.Unlock()
+	defer compactKVLogIfLarge() // after the change is applied to kvStore
+
+	entry, exist := kvStore[key]
+	if exist && !entry.expire.IsZero() && time.Now().After(entry.expire) { // lazy expiration
+		delete(kvStore, key)
+		entry, exist = nil, false
+	}
+
+	switch {
+	case cmd == "SET" && len(args) == 3:
+		if appendKVLog("SET", key, args[2]) != nil {
+			return KV_ERR_LOG
+		}
+		kvStore[key] = &kvEntry{value: args[2]}
+		return KV_OK
+	case cmd == "GET" && len(args) == 2:
+		if !exist {
+			return KV_NIL
+		}
+		return entry.value
+	case cmd == "DEL" && len(args) == 2:
+		if !exist {
+			return "0"
+		}
+		if appendKVLog("DEL", key) != nil {
+			return KV_ERR_LOG
+		}
+		delete(kvStore, key)
+		return "1"
+	case cmd == "INCR" && len(args) == 2:
+		num := 0
+		if exist {
+			var err error
+			if num, err = strconv.Atoi(entry.value); err != nil {
+				return KV_ERR_NOT_INT
+			}
+		} else {
+			entry = &kvEntry{}
+		}
+		num++
+		if appendKVLog("SET", key, strconv.Itoa(num)) != nil {
+			return KV_ERR_LOG
+		}
+		if !entry.expire.IsZero() { // incrementing keeps ttl, so it is logged again
+			if appendKVLog("EXPIREAT", key, strconv.FormatInt(entry.expire.UnixMilli(), 10)) != nil {
+				return KV_ERR_LOG
+			}
+		}
+		entry.value = strconv.Itoa(num)
+		kvStore[key] = entry
+		return entry.value
+	case cmd == "EXPIRE" && len(args) == 3:
+		sec, err := strconv.Atoi(args[2])
+		if err != nil {
+			return KV_ERR_NOT_INT
+		}
+		if !exist {
+			return "0"
+		}
+		expire := time.Now().Add(time.Duration(sec) * time.Second)
+		if appendKVLog("EXPIREAT", key, strconv.FormatInt(expire.UnixMilli(), 10)) != nil {
+			return KV_ERR_LOG
+		}
+		entry.expire = expire
+		return "1"
+	}
+	return KV_ERR_SYNTAX
+}
+
+/**
+ * appending one change to log file. expiration is logged
+ * as absolute time(EXPIREAT), so replaying it later gives same ttl.
+ * caller should hold kvMutex.
+**/
+func appendKVLog(args ...string) error {
+	if kvLog == nil {
+		return os.ErrClosed
+	}
+	cnt, err := kvLog.WriteString(strings.Join(args, " ") + "\n")
+	kvLogSize += int64(cnt)
+	return err
+}
+
+/**
+ * compacting log when it is mostly overwritten or deleted changes.
+ * caller should hold kvMutex.
+**/
+func compactKVLogIfLarge() {
+	if kvLogSize > KV_COMPACT_SIZE && kvLogSize > 2*kvSnapSize {
+		if err := compactKVLog(); err != nil {
+			fmt.Println("cannot compact " + KV_LOG_FILE + ": " + err.Error())
+		}
+	}
+}
+
+/**
+ * rewriting log with SET and EXPIREAT of current keys, to temporary file renamed over the log.
+ * expired keys are dropped. on error, the old log is kept and used,
+ * except when the renamed log can't be opened. then the old one is unlinked,
+ * so log is closed and following writes fail, not to be lost silently.
+ * caller should hold kvMutex, or be the only user of kvStore.
+**/
+func compactKVLog() error {
+	tmp, err := os.CreateTemp(".", KV_LOG_FILE+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails after rename
+	tmp.Chmod(0644)             // same with log made by loadKVStore
+
+	w := bufio.NewWriter(tmp)
+	now := time.Now()
+	for key, entry := range kvStore {
+		if !entry.expire.IsZero() && now.After(entry.expire) {
+			delete(kvStore, key)
+			continue
+		}
+		fmt.Fprintf(w, "SET %s %s\n", key, entry.value)
+		if !entry.expire.IsZero() {
+			fmt.Fprintf(w, "EXPIREAT %s %d\n", key, entry.expire.UnixMilli())
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	} else if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	info, err := tmp.Stat()
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if err := os.Rename(tmp.Name(), KV_LOG_FILE); err != nil {
+		return err
+	}
+
+	newLog, err := os.OpenFile(KV_LOG_FILE, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		kvLog.Close()
+		kvLog = nil
+		return fmt.Errorf("log is closed, writes are refused: %w", err)
+	}
+	kvLog.Close()
+	kvLog, kvLogSize, kvSnapSize = newLog, size, size
+	return nil
+}
+
+/**
+ * replaying log file into kvStore, and opening it for appending.
+**/
+func loadKVStore() error {
+	var err error
+	kvLog, err = os.OpenFile(KV_LOG_FILE, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(kvLog)
+	scanner.Buffer(make([]byte, BUFFER_SIZE), BUFFER_SIZE*4) // value is smaller than receive buffer
+	for scanner.Scan() {
+		args := strings.SplitN(scanner.Text(), " ", 3)
+		switch {
+		case args[0] == "SET" && len(args) == 3:
+			kvStore[args[1]] = &kvEntry{value: args[2]}
+		case args[0] == "DEL" && len(args) == 2:
+			delete(kvStore, args[1])
+		case args[0] == "EXPIREAT" && len(args) == 3:
+			if entry, exist := kvStore[args[1]]; exist {
+				msec, _ := strconv.ParseInt(args[2], 10, 64)
+				entry.expire = time.UnixMilli(msec)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return compactKVLog() // keys expired while server was down are dropped too
+}
+
+/**
+ * answering LAN discovery query, so that clients can find this server.
+ * query: "DISCOVER"[" "<service type>], padded to DISCOVERY_QUERY_SIZE bytes
+ * reply: "SERVICE "<service type>" "<version>" "<port>" "<instance id>
+ * multicast listener shares the port with other servers on the same host,
+ * and receives broadcast query too. short query is ignored, not to be reflected.
+**/
+func serveDiscovery() {
+	pc, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(DISCOVERY_GROUP), Port: DISCOVERY_PORT})
+	if err != nil {
+		fmt.Println("Discovery is not available:", err)
+		return
+	}
+	defer pc.Close()
+
+	instanceID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	announce := []byte(DISCOVERY_REPLY + " " + SERVICE_TYPE + " " + SERVICE_VERSION + " " + serverPort + " " + instanceID)
+	buf := make([]byte, DISCOVERY_QUERY_SIZE)
+	for {
+		cnt, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := strings.Fields(string(buf[:cnt]))
+		if cnt < DISCOVERY_QUERY_SIZE || len(query) == 0 || query[0] != DISCOVERY_QUERY ||
+			(len(query) > 1 && query[1] != SERVICE_TYPE) {
+			continue
+		}
+		pc.WriteTo(announce, addr)
+	}
 }
 
 /**
  * print the number of connected clients
- * periodically, 1 minute.
+ * and top clients periodically, 1 minute.
 **/
 func printTotalClientCount() {
 	for {
 		time.Sleep(time.Minute /*time.Second * 60*/)
-		fmt.Println("1 minute passed. Number of connected clients =", atomic.LoadInt32(&curClient))
+		logInfo("1 minute passed. Number of connected clients =", atomic.LoadInt32(&curClient))
+		logInfo(topClients())
 	}
 }
 
@@ -128,6 +799,8 @@ func cleanupAndExit() {
 	if listener != nil {
 		listener.Close()
 	}
+	kvMutex.Lock() // waiting for log writing in progress
+	kvLog.Close()
 	fmt.Println("\nBye bye~")
 	os.Exit(0)
 }
@@ -0,0 +1,384 @@
+package main
+
+/**
+ * 20170454 Yi Changmin
+ *
+ * chat rooms of ChatTCPServer, with their members and history.
+ * built together with server: go build ChatTCPServer.go ChatRoom.go
+ * tests: go test -race ChatTCPServer.go ChatRoom.go ChatRoom_test.go
+ */
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	roomsMutex sync.Mutex       // guards rooms, taken before room's own mutex
+	rooms      map[string]*room // DEFAULT_ROOM is made in main, and never removed
+)
+
+/**
+ * one broadcast kept in room history.
+ */
+type historyEntry struct {
+	time     time.Time
+	nickname string
+	msg      string
+}
+
+/**
+ * chat room owning nickname registry. members are keyed by nickKey, so
+ * nicknames differing only in case or width are the same.
+ * every access is guarded by mutex,
+ * so joins, leaves and broadcasts from many goroutines are safe.
+ * messages are sent outside of the lock, to members snapshot.
+ * history is ring buffer of at most historySize broadcasts, oldest one at historyNext when full.
+ * history file has historyLines lines, and is rewritten with ring buffer when
+ * it reaches HISTORY_TRIM_RATIO times historySize lines(see trimHistory).
+ */
+type room struct {
+	name         string
+	mutex        sync.RWMutex
+	capacity     int
+	topic        string
+	members      map[string]*member
+	history      []historyEntry
+	historyNext  int
+	historyLog   *os.File // nil when history is not persisted
+	historyPath  string
+	historyLines int
+}
+
+func newRoom(name string, capacity int) *room {
+	return &room{name: name, capacity: capacity, members: make(map[string]*member)}
+}
+
+/**
+ * registers member, and returns the number of members including it.
+ * when room is full or nickname is in use, member is not registered
+ * and reject reason is returned.
+ */
+func (r *room) join(m *member) (int, string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.members) >= r.capacity {
+		return len(r.members), REJECT_MSG_ROMM_FULL
+	} else if _, exist := r.members[nickKey(m.nickname)]; exist {
+		return len(r.members), REJECT_MSG_NICKNAME_DUP
+	}
+	r.members[nickKey(m.nickname)] = m
+	return len(r.members), ""
+}
+
+/**
+ * unregisters member, and returns the number of members left.
+ */
+func (r *room) leave(nickname string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.members, nickKey(nickname))
+	return len(r.members)
+}
+
+func (r *room) setTopic(topic string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.topic = topic
+}
+
+func (r *room) getTopic() string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.topic
+}
+
+/**
+ * adding broadcast to history, and to history file if exists.
+ */
+func (r *room) record(nickname, msg string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	e := historyEntry{time.Now(), nickname, msg}
+	r.addHistory(e)
+	if r.historyLog != nil {
+		r.historyLog.WriteString(formatHistoryLine(e))
+		if r.historyLines++; r.historyLines >= HISTORY_TRIM_RATIO*historySize {
+			r.trimHistory()
+		}
+	}
+}
+
+/**
+ * caller should hold mutex.
+ */
+func (r *room) addHistory(e historyEntry) {
+	if historySize <= 0 {
+		return
+	} else if len(r.history) < historySize {
+		r.history = append(r.history, e)
+	} else {
+		r.history[r.historyNext] = e
+		r.historyNext = (r.historyNext + 1) % historySize
+	}
+}
+
+/**
+ * last n broadcasts, oldest first.
+ */
+func (r *room) recent(n int) []historyEntry {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.lastEntries(n)
+}
+
+/**
+ * caller should hold mutex.
+ */
+func (r *room) lastEntries(n int) []historyEntry {
+	n = min(n, len(r.history))
+	entries := make([]historyEntry, 0, n)
+	for i := len(r.history) - n; i < len(r.history); i++ {
+		entries = append(entries, r.history[(r.historyNext+i)%len(r.history)])
+	}
+	return entries
+}
+
+/**
+ * reading history file of room into ring buffer, and opening it for appending.
+ * file is [historyDir]/room-[escaped room name].log, one "[unix milli] [nickname] [quoted msg]" per line.
+ * when file has more lines than ring buffer, it is rewritten with kept ones.
+ */
+func (r *room) openHistory() {
+	if historyDir == "" || historySize <= 0 {
+		return
+	}
+	path := filepath.Join(historyDir, "room-"+url.PathEscape(r.name)+".log") // escaped name has no '/'
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	lines := 0
+	if content, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.SplitN(line, " ", 3)
+			if len(fields) != 3 {
+				continue
+			}
+			msec, err1 := strconv.ParseInt(fields[0], 10, 64)
+			msg, err2 := strconv.Unquote(fields[2])
+			if err1 == nil && err2 == nil {
+				r.addHistory(historyEntry{time.UnixMilli(msec), fields[1], msg})
+				lines++
+			}
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Println("cannot open history:", err)
+		return
+	}
+	r.historyLog, r.historyPath, r.historyLines = file, path, lines
+	if lines > historySize {
+		r.trimHistory()
+	}
+}
+
+/**
+ * rewriting history file with broadcasts in ring buffer only.
+ * new file is written next to it and renamed over it, so
+ * history is not lost on failure. caller should hold mutex.
+ */
+func (r *room) trimHistory() {
+	tmp, err := os.CreateTemp(historyDir, filepath.Base(r.historyPath)+".*.tmp")
+	if err != nil {
+		fmt.Println("cannot trim history:", err)
+		return
+	}
+	defer os.Remove(tmp.Name()) // fails after rename
+	entries := r.lastEntries(historySize)
+	var sb strings.Builder
+	for _, e := range entries {
+		sb.WriteString(formatHistoryLine(e))
+	}
+	_, err = tmp.WriteString(sb.String())
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.historyPath)
+	}
+	if err != nil {
+		fmt.Println("cannot trim history:", err)
+		return
+	}
+
+	file, err := os.OpenFile(r.historyPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Println("cannot open history:", err)
+		r.historyLog.Close()
+		r.historyLog = nil
+		return
+	}
+	r.historyLog.Close()
+	r.historyLog, r.historyLines = file, len(entries)
+}
+
+func (r *room) closeHistory() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.historyLog != nil {
+		r.historyLog.Close()
+		r.historyLog = nil
+	}
+}
+
+func formatHistoryLine(e historyEntry) string {
+	return strconv.FormatInt(e.time.UnixMilli(), 10) + " " + e.nickname + " " + strconv.Quote(e.msg) + "\n"
+}
+
+/**
+ * "[hh:mm:ss] [nickname]> [msg]\n" of entries
+ */
+func formatHistory(entries []historyEntry) string {
+	var sb strings.Builder
+	for _, e := range entries {
+		sb.WriteString("[" + e.time.Format("15:04:05") + "] " + e.nickname + "> " + e.msg + "\n")
+	}
+	return sb.String()
+}
+
+func (r *room) count() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.members)
+}
+
+func (r *room) lookup(nickname string) (*member, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	m, exist := r.members[nickKey(nickname)]
+	return m, exist
+}
+
+/**
+ * members sorted by nickname, taken under the lock.
+ */
+func (r *room) snapshot() []*member {
+	r.mutex.RLock()
+	list := make([]*member, 0, len(r.members))
+	for _, m := range r.members {
+		list = append(list, m)
+	}
+	r.mutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].nickname < list[j].nickname })
+	return list
+}
+
+/**
+ * sends msg to every member except the one named except("" for nobody).
+ */
+func (r *room) broadcast(msg string, except string) {
+	for _, m := range r.snapshot() {
+		if m.nickname != except {
+			m.deliver(msg)
+		}
+	}
+}
+
+/**
+ * "[nickname]: [address]\n" of every member, for \list and admin STATS
+ */
+func (r *room) list() string {
+	var sb strings.Builder
+	for _, m := range r.snapshot() {
+		if atomic.LoadInt32(&m.parked) == 1 {
+			sb.WriteString(m.nickname + ": " + m.getConn().RemoteAddr().String() + " (away)\n")
+		} else {
+			sb.WriteString(m.nickname + ": " + m.getConn().RemoteAddr().String() + "\n")
+		}
+	}
+	return sb.String()
+}
+
+/**
+ * puts member into named room, creating the room when it doesn't exist.
+ * returns the room and the number of its members, or reject reason.
+ */
+func joinRoom(name string, m *member) (*room, int, string) {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	r, exist := rooms[name]
+	if !exist {
+		r = newRoom(name, roomCapacity)
+	}
+	cnt, reject := r.join(m)
+	if reject == "" && !exist {
+		rooms[name] = r
+		r.openHistory()
+	}
+	return r, cnt, reject
+}
+
+/**
+ * takes member out of room, and returns the number of members left.
+ * empty room is removed, except DEFAULT_ROOM.
+ */
+func partRoom(r *room, nickname string) int {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	cnt := r.leave(nickname)
+	if cnt == 0 && r.name != DEFAULT_ROOM {
+		delete(rooms, r.name)
+		r.closeHistory()
+	}
+	return cnt
+}
+
+func findRoom(name string) (*room, bool) {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+	r, exist := rooms[name]
+	return r, exist
+}
+
+/**
+ * "[roomName] ([count] users)[: topic]\n" of every room, sorted by name
+ */
+func roomList() string {
+	roomsMutex.Lock()
+	names := make([]string, 0, len(rooms))
+	for name := range rooms {
+		names = append(names, name)
+	}
+	roomsMutex.Unlock()
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		if r, exist := findRoom(name); exist {
+			sb.WriteString(fmt.Sprintf("%s (%d users)", name, r.count()))
+			if topic := r.getTopic(); topic != "" {
+				sb.WriteString(": " + topic)
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
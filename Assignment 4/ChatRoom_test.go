@@ -0,0 +1,323 @@
+package main
+
+/**
+ * 20170454 Yi Changmin
+ *
+ * tests of room with many goroutines, to be run with race detector.
+ * go test -race ChatTCPServer.go ChatRoom.go ChatRoom_test.go
+ */
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	TEST_GOROUTINES int = 32
+	TEST_ROUNDS     int = 100
+)
+
+/**
+ * member not connected to anyone. messages delivered to it stay in its queue.
+ */
+func newTestMember(t *testing.T, nickname string) *member {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return &member{nickname: nickname, conn: conn, queue: newSendQueue(), done: make(chan bool),
+		kicked: make(chan bool), seenIDs: make(map[string]bool)}
+}
+
+/**
+ * messages in member's queue, oldest first.
+ */
+func queued(m *member) []string {
+	m.queue.mutex.Lock()
+	defer m.queue.mutex.Unlock()
+	msgs := make([]string, 0, len(m.queue.items))
+	for _, out := range m.queue.items {
+		msgs = append(msgs, out.msg)
+	}
+	return msgs
+}
+
+/**
+ * sets globals used by room as main does, and restores them after test.
+ */
+func setupRooms(t *testing.T, history int) {
+	prevQueue, prevHistory, prevDir, prevRooms, prevCapacity := sendQueueSize, historySize, historyDir, rooms, roomCapacity
+	sendQueueSize, historySize, historyDir, roomCapacity = 1<<20, history, "", TEST_GOROUTINES
+	rooms = map[string]*room{DEFAULT_ROOM: newRoom(DEFAULT_ROOM, 1<<20)}
+	t.Cleanup(func() {
+		sendQueueSize, historySize, historyDir, rooms, roomCapacity = prevQueue, prevHistory, prevDir, prevRooms, prevCapacity
+	})
+}
+
+func TestRoomJoinLeave(t *testing.T) {
+	setupRooms(t, 0)
+	r := newRoom("test", TEST_GOROUTINES)
+
+	var wg sync.WaitGroup
+	for i := 0; i < TEST_GOROUTINES; i++ {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			for j := 0; j < TEST_ROUNDS; j++ {
+				if _, reject := r.join(m); reject != "" {
+					t.Errorf("%s: join rejected: %s", m.nickname, reject)
+					return
+				}
+				if found, exist := r.lookup(m.nickname); !exist || found != m {
+					t.Errorf("%s: lookup after join = %v, %t", m.nickname, found, exist)
+				}
+				r.count()
+				r.list()
+				r.leave(m.nickname)
+				if _, exist := r.lookup(m.nickname); exist {
+					t.Errorf("%s: found after leave", m.nickname)
+				}
+			}
+		}(newTestMember(t, fmt.Sprint("user", i)))
+	}
+	wg.Wait()
+
+	if cnt := r.count(); cnt != 0 {
+		t.Errorf("count = %d, want 0", cnt)
+	}
+}
+
+/**
+ * nicknames with same nickKey joining at once, only one of them gets in.
+ */
+func TestRoomJoinSameNickname(t *testing.T) {
+	setupRooms(t, 0)
+	r := newRoom("test", TEST_GOROUTINES)
+	nicknames := []string{"alice", "Alice", "ALICE", "Ａｌｉｃｅ", "ａｌｉｃｅ"}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	joined, rejected := 0, 0
+	for i := 0; i < TEST_GOROUTINES; i++ {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			_, reject := r.join(m)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if reject == "" {
+				joined++
+			} else if reject == REJECT_MSG_NICKNAME_DUP {
+				rejected++
+			} else {
+				t.Errorf("%s: unexpected reject %s", m.nickname, reject)
+			}
+		}(newTestMember(t, nicknames[i%len(nicknames)]))
+	}
+	wg.Wait()
+
+	if joined != 1 || rejected != TEST_GOROUTINES-1 {
+		t.Errorf("joined = %d, rejected = %d, want 1 and %d", joined, rejected, TEST_GOROUTINES-1)
+	}
+	for _, nickname := range nicknames {
+		if _, exist := r.lookup(nickname); !exist {
+			t.Errorf("lookup(%s) failed", nickname)
+		}
+	}
+}
+
+func TestRoomCapacity(t *testing.T) {
+	setupRooms(t, 0)
+	capacity := 5
+	r := newRoom("test", capacity)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	joined := 0
+	for i := 0; i < TEST_GOROUTINES; i++ {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			cnt, reject := r.join(m)
+			if cnt > capacity {
+				t.Errorf("%s: count %d is over capacity", m.nickname, cnt)
+			}
+			if reject == "" {
+				mutex.Lock()
+				joined++
+				mutex.Unlock()
+			} else if reject != REJECT_MSG_ROMM_FULL {
+				t.Errorf("%s: unexpected reject %s", m.nickname, reject)
+			}
+		}(newTestMember(t, fmt.Sprint("user", i)))
+	}
+	wg.Wait()
+
+	if joined != capacity || r.count() != capacity {
+		t.Errorf("joined = %d, count = %d, want %d", joined, r.count(), capacity)
+	}
+}
+
+/**
+ * every member gets every broadcast except its own, in the order each sender sent them,
+ * while other members are joining and leaving.
+ */
+func TestRoomBroadcast(t *testing.T) {
+	setupRooms(t, 0)
+	r := newRoom("test", 2*TEST_GOROUTINES)
+	senders := make([]*member, TEST_GOROUTINES)
+	for i := range senders {
+		senders[i] = newTestMember(t, fmt.Sprint("sender", i))
+		r.join(senders[i])
+	}
+
+	var wg sync.WaitGroup
+	for i, m := range senders {
+		wg.Add(2)
+		go func(m *member) {
+			defer wg.Done()
+			for j := 0; j < TEST_ROUNDS; j++ {
+				r.broadcast(fmt.Sprintf("%s %d", m.nickname, j), m.nickname)
+			}
+		}(m)
+		go func(m *member) { // visitor is in the room only for a while
+			defer wg.Done()
+			for j := 0; j < TEST_ROUNDS; j++ {
+				r.join(m)
+				r.leave(m.nickname)
+			}
+		}(newTestMember(t, fmt.Sprint("visitor", i)))
+	}
+	wg.Wait()
+
+	for _, m := range senders {
+		next := make(map[string]int)
+		msgs := queued(m)
+		if len(msgs) != (TEST_GOROUTINES-1)*TEST_ROUNDS {
+			t.Errorf("%s got %d messages, want %d", m.nickname, len(msgs), (TEST_GOROUTINES-1)*TEST_ROUNDS)
+		}
+		for _, msg := range msgs {
+			var sender string
+			var seq int
+			fmt.Sscanf(msg, "%s %d", &sender, &seq)
+			if sender == m.nickname {
+				t.Errorf("%s got its own message", m.nickname)
+			} else if seq != next[sender] {
+				t.Errorf("%s got %q, want sequence %d", m.nickname, msg, next[sender])
+			}
+			next[sender] = seq + 1
+		}
+	}
+}
+
+func TestRoomHistory(t *testing.T) {
+	setupRooms(t, 10)
+	r := newRoom("test", 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < TEST_GOROUTINES; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < TEST_ROUNDS; j++ {
+				r.record(fmt.Sprint("user", i), fmt.Sprint(j))
+				if n := len(r.recent(historySize + 1)); n > historySize {
+					t.Errorf("recent returned %d entries, over %d", n, historySize)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 15; i++ {
+		r.record("last", fmt.Sprint(i))
+	}
+	entries := r.recent(3)
+	if len(entries) != 3 {
+		t.Fatalf("recent(3) returned %d entries", len(entries))
+	}
+	for i, e := range entries {
+		if e.nickname != "last" || e.msg != fmt.Sprint(12+i) {
+			t.Errorf("entry %d = %s %s, want last %d", i, e.nickname, e.msg, 12+i)
+		}
+	}
+}
+
+/**
+ * history file is trimmed to ring buffer while broadcasts are recorded,
+ * and the room made again reads the same history from it.
+ */
+func TestRoomHistoryFile(t *testing.T) {
+	setupRooms(t, 5)
+	historyDir = t.TempDir()
+	r := newRoom("test room", 1)
+	r.openHistory()
+
+	for i := 0; i < 10*historySize; i++ {
+		r.record("user", fmt.Sprint(i))
+		content, err := os.ReadFile(r.historyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(content), "\n"); lines > HISTORY_TRIM_RATIO*historySize || lines < min(i+1, historySize) {
+			t.Fatalf("history file has %d lines after %d broadcasts", lines, i+1)
+		}
+	}
+	r.closeHistory()
+
+	reopened := newRoom("test room", 1)
+	reopened.openHistory()
+	defer reopened.closeHistory()
+	entries := reopened.recent(historySize)
+	if len(entries) != historySize {
+		t.Fatalf("reopened history has %d entries, want %d", len(entries), historySize)
+	}
+	for i, e := range entries {
+		if want := fmt.Sprint(9*historySize + i); e.msg != want {
+			t.Errorf("entry %d = %s, want %s", i, e.msg, want)
+		}
+	}
+	if files, _ := os.ReadDir(historyDir); len(files) != 1 {
+		t.Errorf("history dir has %d files, want 1", len(files))
+	}
+}
+
+/**
+ * room is made by first member and removed after last member, while others join it.
+ */
+func TestJoinPartRoom(t *testing.T) {
+	setupRooms(t, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < TEST_GOROUTINES; i++ {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			for j := 0; j < TEST_ROUNDS; j++ {
+				r, _, reject := joinRoom("shared", m)
+				if reject != "" {
+					t.Errorf("%s: join rejected: %s", m.nickname, reject)
+					return
+				}
+				if found, exist := findRoom("shared"); !exist || found != r {
+					t.Errorf("%s: joined room is not registered", m.nickname)
+				}
+				roomList()
+				partRoom(r, m.nickname)
+			}
+		}(newTestMember(t, fmt.Sprint("user", i)))
+	}
+	wg.Wait()
+
+	if _, exist := findRoom("shared"); exist {
+		t.Error("empty room is not removed")
+	}
+	if _, exist := findRoom(DEFAULT_ROOM); !exist {
+		t.Error(DEFAULT_ROOM + " is removed")
+	}
+}
@@ -2,12 +2,23 @@ package main
 
 /**
  * 20170454 Yi Changmin
+ *
+ * usage: ChatTCPClient [-d] [-login | -register] [-heartbeat 15s] [-timeout 45s] [-reconnect 60s]
+ *                      [-downloads dir] [-direct=false] nickname
+ * with -login or -register, password of nickname is asked before connecting,
+ * and it is not echoed when stdin is terminal.
+ * server is pinged by heartbeat interval, and connection is lost when server sends nothing for timeout.
+ * on lost connection, client tries to resume session for reconnect time(see reconnect).
+ * files from \send are saved in downloads dir, and they are sent directly between users
+ * when it is possible, unless direct is false(see offerFile).
  */
 
 /**
 MESSAGE FORMAT
+every message is framed as [length][message],
+[length] is 4-byte big-endian byte count of [message] (see readFrame)
 "0": connection request, connection accept
-	client: "0"[nickname]
+	client: "0"[nickname] as guest, or "0"[nickname]" "[password] for registered nickname
 	server: "0"[welcomeMsg]
 "1": connection request reject
 	server: "1"[rejectReason]
@@ -15,11 +26,12 @@ MESSAGE FORMAT
 	client: "2"
 	server: "2"[killReason]
 "3": broadcast message by client
-	client: "3"[senderNickname]" "[msg]
+	client: "3"[msgID]" "[msg]
+	server: "3"[senderNickname]" "[msg]
 "4": broadcast message by server
 	server: "4"[msg]
 "5": direct message
-	sender: "5"[receiverNickname]" "[msg]
+	sender: "5"[msgID]" "[receiverNickname]" "[msg]
 	server changes [receiverNickname] to [senderNickname]
 	receiver: "5"[senderNickname]" "[msg]
 "6": version of server
@@ -31,26 +43,94 @@ MESSAGE FORMAT
 "8": rtt
 	client: "8"
 	server: "8"
+"A": join room
+	client: "A"[roomName]
+"B": part room, and go back to lobby
+	client: "B"
+"C": list of rooms
+	client: "C"
+	server: "C"[roomListMsg]
+"D": members of room, current room when [roomName] is empty
+	client: "D"[roomName]
+	server: "D"[listMsg]
+"E": topic of current room
+	client: "E"[topic]
+"F": recent broadcasts of current room, also sent after joining room
+	client: "F"[count]
+	server: "F"[historyMsg]
+"G": acknowledgement of "3" and "5", [code] is "OK", "QUEUED" or reject reason
+	server: "G"[msgID]" "[code]
+"H": delivery receipt of "5"
+	server: "H"[msgID]" "[receiverNickname]
+"I": registering nickname with password
+	client: "I"[nickname]" "[password] instead of connection request
+	client: "I"[password] after connection, for my nickname
+	server: "4"[result]
+"J": operator command, [command] is kick, ban, unban, mute or unmute with arguments
+	client: "J"[command]
+	server: "4"[result]
+"K": heartbeat ping, sent by both sides when heartbeat interval passes
+	server, client: "K"
+"L": heartbeat pong, answer of "K"
+	server, client: "L"
+"M": resume token of session, sent after welcome
+	server: "M"[token]
+"N": resuming session, sent instead of connection request
+	client: "N"[token]" "[received], [received] is the number of messages after "M"
+	server: "0"[welcomeBackMsg] and messages after [received] again, or "1"[rejectReason]
+"O": file offer
+	sender: "O"[fileID]" "[receiverNickname]" "[size]" "[sha256]" "[directPort]" "[fileName]
+	receiver: "O"[senderNickname]" "[fileID]" "[size]" "[sha256]" "[directAddr]" "[fileName]
+	[directPort] is [port]"/"[secret] where sender waits for receiver, or "-"
+	[directAddr] is [host:port]"/"[secret] with host of sender seen by server, or "-"
+"P": file reply, from receiver of offer to its sender
+	receiver: "P"[senderNickname]" "[fileID]" "[reply]
+	sender: "P"[receiverNickname]" "[fileID]" "[reply]
+	[reply] is "accept" to relay, "direct" when receiver is connected to [directAddr], "reject",
+	"ack "[bytes] of relayed bytes written, "ok" when checksum is verified, or "fail "[reason]
+"Q": file chunk relayed by server after "accept"
+	sender: "Q"[fileID]" "[offset]" "[base64Data]
+	receiver: "Q"[senderNickname]" "[fileID]" "[offset]" "[base64Data]
+"R": end of file by sender, [result] is "done" after last chunk or "cancel "[reason]
+	sender: "R"[fileID]" "[result]
+	receiver: "R"[senderNickname]" "[fileID]" "[result]
+on direct connection, receiver writes "[secret]" framed, and sender writes raw bytes of file
 */
 
 import (
 	"bufio"
 	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+
+	"golang.org/x/term"
 )
 
 const (
-	CONN_TYPE   string = "tcp"
-	SERVER_NAME string = "nsl2.cau.ac.kr"
-	SERVER_PORT string = "20454"
-	BUFFER_SIZE int    = 1024
+	CONN_TYPE      string = "tcp"
+	SERVER_NAME    string = "nsl2.cau.ac.kr"
+	SERVER_PORT    string = "20454"
+	BUFFER_SIZE    int    = 1024
+	MAX_FRAME_SIZE int    = 1 << 16
+	FRAME_HEADER   int    = 4
 
 	CONN_REQUSET     string = "0"
 	CONN_REJECT      string = "1"
@@ -61,77 +141,389 @@ const (
 	GET_VERSION      string = "6"
 	USER_LIST        string = "7"
 	GET_RTT          string = "8"
+	JOIN_ROOM        string = "A"
+	PART_ROOM        string = "B"
+	ROOM_LIST        string = "C"
+	ROOM_WHO         string = "D"
+	ROOM_TOPIC       string = "E"
+	HISTORY          string = "F"
+	ACK              string = "G"
+	RECEIPT          string = "H"
+	REGISTER         string = "I"
+	OPERATOR         string = "J"
+	PING             string = "K"
+	PONG             string = "L"
+	SESSION          string = "M"
+	RESUME           string = "N"
+	FILE_OFFER       string = "O"
+	FILE_REPLY       string = "P"
+	FILE_CHUNK       string = "Q"
+	FILE_END         string = "R"
+
+	ACK_OK       string        = "OK"
+	ACK_QUEUED   string        = "QUEUED"
+	PENDING_TIME time.Duration = 2 * time.Second  // message without ack is marked pending
+	FAIL_TIME    time.Duration = 10 * time.Second // and then failed
+
+	HEARTBEAT_INTERVAL time.Duration = 15 * time.Second // default of -heartbeat
+	SERVER_TIMEOUT     time.Duration = 45 * time.Second // default of -timeout
+
+	// reconnecting lost connection (see reconnect)
+	RECONNECT_TIME time.Duration = time.Minute // default of -reconnect
+	BACKOFF_MIN    time.Duration = 500 * time.Millisecond
+	BACKOFF_MAX    time.Duration = 8 * time.Second
+	DIAL_TIMEOUT   time.Duration = 5 * time.Second
+
+	// file transfer (see offerFile), chunk and window are same as server
+	FILE_CHUNK_SIZE int           = 16 << 10
+	FILE_WINDOW     int64         = 8 * int64(FILE_CHUNK_SIZE)
+	DIRECT_TIMEOUT  time.Duration = 3 * time.Second
+	FILE_OFFERED    string        = "offered" // states of transfer
+	FILE_ACTIVE     string        = "active"
+
+	FILE_FRAME_GAP time.Duration = time.Second / 200 // chunks and acks, under -file-limit of server
 
 	NO_SERVER_FOUND  string = "cannot find server"
 	INVALID_ARG      string = "invalid argument"
 	INVALID_COMMAND  string = "invalid command"
 	INVALID_MSG_RECV string = "invalid message from server"
 	SERVER_LOST      string = "server is not good"
+	SERVER_TIMED_OUT string = "server is not answering"
+	RECONNECTING     string = "[connection is lost. reconnecting...]"
+	FRAME_TOO_LARGE  string = "message is too large"
 	EXIT_MSG         string = "gg~"
+
+	// LAN discovery (see discoverServer)
+	DISCOVERY_GROUP      string        = "239.255.20.45"
+	DISCOVERY_PORT       int           = 20455
+	DISCOVERY_QUERY      string        = "DISCOVER"
+	DISCOVERY_REPLY      string        = "SERVICE"
+	DISCOVERY_QUERY_SIZE int           = 64
+	DISCOVERY_TIMEOUT    time.Duration = time.Second
+	SERVICE_TYPE         string        = "chat"
+	NO_SERVER_DISCOVERED string        = "no server discovered"
+	INVALID_SELECTION    string        = "invalid selection"
 )
 
 var (
+	DISCOVERY_TARGETS []string = []string{DISCOVERY_GROUP, "255.255.255.255", "127.255.255.255"}
+	discoverMode      bool
+	loginMode         bool
+	registerMode      bool
+	heartbeatInterval time.Duration
+	serverTimeout     time.Duration
+	reconnectTime     time.Duration
+	downloadDir       string
+	directMode        bool
+
 	scanner bufio.Scanner = *bufio.NewScanner(os.Stdin)
 
 	myNickname    string
+	serverAddr    string
+	connRequest   string     // sent again when session can't be resumed
+	connMutex     sync.Mutex // guards conn, which is changed by reconnect
 	conn          net.Conn
-	startTimeList list.List = list.List{}
+	reader        *bufio.Reader // used by receiveHandler only, after connected
+	writeMutex    sync.Mutex    // frames written by sendHandler and reconnect are not mixed
+	startTimeList list.List     = list.List{}
+
+	sessionToken string // "" when server gave no token
+	recvCount    int64  // messages received after token, atomic
+	reconnecting int32  // 1 while reconnecting, atomic
 
 	sendChan, receiveChan chan string
+	chatting              int32                      // 1 after sendChan is read by sendHandler, atomic
+	passwordTerm          atomic.Pointer[term.State] // terminal state to restore while password is read
 
 	terminateChan chan bool
 	terminateFlag int32 = 0
+	lastRecv      int64 // unix nano of last message from server, atomic
+
+	// messages waiting for ack, by message id. id is [session]"."[sequence],
+	// so that receipt of dm sent in previous session is not mixed up.
+	pendingMutex sync.Mutex
+	pending      map[string]*pendingMsg = make(map[string]*pendingMsg)
+	sessionID    string                 = strconv.FormatInt(time.Now().UnixNano(), 36)
+	msgSeq       int                    = 0
+
+	// file transfers by number shown to user
+	filesMutex sync.Mutex
+	files      map[int]*fileTransfer = make(map[int]*fileTransfer)
+	fileSeq    int                   = 0
+	errStopped error                 = errors.New("transfer is over")
+
+	errChecksum error      = errors.New("checksum mismatch")
+	frameMutex  sync.Mutex // guards nextFrame
+	nextFrame   time.Time  // time when next chunk or ack can be sent
+
+	OPERATOR_COMMANDS []string = []string{"kick", "ban", "unban", "mute", "unmute"}
+
+	// reject reasons of server
+	REJECT_REASONS map[string]string = map[string]string{
+		"BLOCKED":      "blocked by filter",
+		"MUTED":        "you are muted",
+		"NO_USER":      "no such user",
+		"QUEUE_FULL":   "too many dms are waiting for receiver",
+		"RATE_LIMITED": "sending too fast",
+		"SENDER_FULL":  "too many of your dms are waiting for offline users",
+	}
 
 	err error
 )
 
+/**
+ * message sent to server, not acknowledged yet.
+ * receiver is "" for broadcast.
+ */
+type pendingMsg struct {
+	text     string
+	receiver string
+	frame    string // sent again after resume
+	seq      int
+	sent     time.Time
+	marked   bool // pending marker is printed
+}
+
+/**
+ * file sent to or received from peer. it is in files until it ends, and stop is closed then.
+ */
+type fileTransfer struct {
+	num      int // for \accept, \reject and \cancel
+	id       string
+	peer     string
+	name     string
+	path     string // file to send, or where received file is saved
+	size     int64
+	sum      string // sha256 in hex
+	outgoing bool
+	direct   string // directAddr of incoming offer, directPort of outgoing one
+	state    string // FILE_OFFERED or FILE_ACTIVE, guarded by filesMutex
+	done     int64  // bytes sent or written, atomic
+	acked    int64  // bytes receiver has written, atomic
+	ackReady chan bool
+	chunks   chan string // relayed chunks "[offset] [data]" to receiving goroutine, "" after last one
+	listener net.Listener
+	stop     chan bool
+	stopOnce sync.Once
+	shown    int64 // quarters of progress printed
+}
+
 func main() {
 	initCtrlCHandler()
 
-	if len(os.Args) != 2 { // argument format checking
+	flag.BoolVar(&discoverMode, "d", false, "discover server on LAN, and select it")
+	flag.BoolVar(&loginMode, "login", false, "connect with password of registered nickname")
+	flag.BoolVar(&registerMode, "register", false, "register nickname with password, and connect")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", HEARTBEAT_INTERVAL, "interval of pinging server")
+	flag.DurationVar(&serverTimeout, "timeout", SERVER_TIMEOUT, "connection is lost when server sends nothing for this time")
+	flag.DurationVar(&reconnectTime, "reconnect", RECONNECT_TIME, "how long lost connection is tried again, 0 for never")
+	flag.StringVar(&downloadDir, "downloads", ".", "directory where received files are saved")
+	flag.BoolVar(&directMode, "direct", true, "send and receive files directly between users when possible")
+	flag.Parse()
+	if flag.NArg() != 1 || (loginMode && registerMode) || heartbeatInterval <= 0 || serverTimeout <= heartbeatInterval ||
+		reconnectTime < 0 { // argument format checking
 		fmt.Println(INVALID_ARG)
 		return
 	} else {
-		myNickname = os.Args[1]
+		myNickname = flag.Arg(0)
 	}
 
-	conn, err = net.Dial(CONN_TYPE, SERVER_NAME+":"+SERVER_PORT) // connection start
-	if err != nil {
-		fmt.Println(NO_SERVER_FOUND)
-		return
+	serverAddr = SERVER_NAME + ":" + SERVER_PORT
+	if discoverMode {
+		if serverAddr, err = discoverServer(true); err != nil {
+			fmt.Println(err)
+			return
+		}
 	}
-	defer conn.Close()
 
-	// trying to get into chatting room
-	buffer := make([]byte, 128)
-	conn.Write([]byte(CONN_REQUSET + myNickname))
-	bufferLen, err := conn.Read(buffer)
-	if err != nil {
-		fmt.Println(SERVER_LOST)
-		return
+	connRequest = CONN_REQUSET + myNickname
+	if loginMode || registerMode {
+		fmt.Print("Password: ")
+		connRequest += " " + readPassword()
+		if registerMode {
+			connRequest = REGISTER + connRequest[1:]
+		}
 	}
 
-	msg := string(buffer[0:bufferLen])
-	fmt.Println(msg[1:])
-	if strings.HasPrefix(msg, CONN_REJECT) {
+	if !connect() { // trying to get into chatting room
 		return
 	}
+	defer func() { getConn().Close() }()
 
+	// channels are not closed, goroutines may still use them until program ends
 	terminateChan = make(chan bool) // for ctrl_c, and \exit
 	sendChan = make(chan string)    // send message to server by this channel
 	receiveChan = make(chan string) // receive message from server by this channel
-	defer close(sendChan)
-	defer close(receiveChan)
-	defer close(terminateChan)
 
-	go receiveThread(conn, receiveChan) // sending goroutine
-	go sendThread(conn, sendChan)       // receiving goroutine
+	go receiveThread(receiveChan) // sending goroutine
+	go sendThread(sendChan)       // receiving goroutine
+	atomic.StoreInt32(&chatting, 1)
+	go watchPending()
+	atomic.StoreInt64(&lastRecv, time.Now().UnixNano())
+	go heartbeat()
 
 	<-terminateChan
 }
 
-func sendThread(myConn net.Conn, ch chan string) {
-	go sendHandler(myConn, ch)
+/**
+ * connecting to server with connRequest, and reading welcome and resume token.
+ * returns false when server is not found or rejects, after printing reason.
+ */
+func connect() bool {
+	c, err := net.DialTimeout(CONN_TYPE, serverAddr, DIAL_TIMEOUT) // connection start
+	if err != nil {
+		fmt.Println(NO_SERVER_FOUND)
+		return false
+	}
+
+	r := bufio.NewReader(c)
+	writeFrame(c, connRequest)
+	msg, err := readFrame(r)
+	if err != nil || len(msg) == 0 {
+		fmt.Println(SERVER_LOST)
+		c.Close()
+		return false
+	}
+	fmt.Println(msg[1:])
+	if strings.HasPrefix(msg, CONN_REJECT) {
+		c.Close()
+		return false
+	}
+
+	if msg, err = readFrame(r); err != nil {
+		fmt.Println(SERVER_LOST)
+		c.Close()
+		return false
+	} else if strings.HasPrefix(msg, SESSION) {
+		sessionToken = msg[1:]
+	}
+	if strings.HasPrefix(connRequest, REGISTER) { // nickname is registered now, so it is login next time
+		connRequest = CONN_REQUSET + connRequest[1:]
+	}
+	atomic.StoreInt64(&recvCount, 0)
+	atomic.StoreInt64(&lastRecv, time.Now().UnixNano())
+	reader = r
+	setConn(c)
+	return true
+}
+
+/**
+ * resuming session on new connection, trying again with backoff doubled from BACKOFF_MIN
+ * to BACKOFF_MAX until reconnectTime passes. messages not acknowledged yet are sent again,
+ * before sendHandler writes to new connection. when server has ended session, client connects
+ * again as new user. returns false when it fails.
+ */
+func reconnect() bool {
+	atomic.StoreInt32(&reconnecting, 1)
+	defer atomic.StoreInt32(&reconnecting, 0)
+	getConn().Close()
+	fmt.Println(RECONNECTING)
+
+	backoff := BACKOFF_MIN
+	for deadline := time.Now().Add(reconnectTime); time.Now().Before(deadline); backoff = min(2*backoff, BACKOFF_MAX) {
+		time.Sleep(backoff)
+		if atomic.LoadInt32(&terminateFlag) != 0 {
+			return false
+		}
+		c, err := net.DialTimeout(CONN_TYPE, serverAddr, DIAL_TIMEOUT)
+		if err != nil {
+			continue
+		}
+
+		r := bufio.NewReader(c)
+		c.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+		writeFrame(c, RESUME+sessionToken+" "+strconv.FormatInt(atomic.LoadInt64(&recvCount), 10))
+		msg, err := readFrame(r)
+		c.SetDeadline(time.Time{})
+		if err != nil || len(msg) == 0 {
+			c.Close()
+			continue
+		}
+		fmt.Println(msg[1:])
+		if strings.HasPrefix(msg, CONN_REJECT) { // session is over
+			c.Close()
+			failPending("session is over")
+			failFiles("session is over")
+			return connect()
+		}
+
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		reader = r
+		setConn(c)
+		atomic.StoreInt64(&lastRecv, time.Now().UnixNano())
+		resendPending(c)
+		return true
+	}
+	return false
+}
+
+func getConn() net.Conn {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	return conn
+}
+
+func setConn(c net.Conn) {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	conn = c
+}
+
+/**
+ * finds servers of SERVICE_TYPE on LAN and this host, and lets user pick one.
+ * query is sent to multicast group and broadcast addresses,
+ * and replies are collected for DISCOVERY_TIMEOUT.
+ * when pick is false, first found server is used. returns "host:port".
+**/
+func discoverServer(pick bool) (string, error) {
+	pc, err := net.ListenPacket("udp4", ":")
+	if err != nil {
+		return "", err
+	}
+	defer pc.Close()
+
+	query := DISCOVERY_QUERY + " " + SERVICE_TYPE
+	query += strings.Repeat(" ", DISCOVERY_QUERY_SIZE-len(query)) // server ignores query shorter than its reply
+	for _, target := range DISCOVERY_TARGETS {
+		pc.WriteTo([]byte(query), &net.UDPAddr{IP: net.ParseIP(target), Port: DISCOVERY_PORT}) // unreachable one is ignored
+	}
+
+	servers, seen := []string{}, map[string]bool{}
+	buf := make([]byte, BUFFER_SIZE)
+	pc.SetReadDeadline(time.Now().Add(DISCOVERY_TIMEOUT))
+	for {
+		cnt, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		reply := strings.Fields(string(buf[:cnt])) // "SERVICE" <type> <version> <port> <instance id>
+		if len(reply) != 5 || reply[0] != DISCOVERY_REPLY || reply[1] != SERVICE_TYPE || seen[reply[4]] {
+			continue
+		}
+		seen[reply[4]] = true // same server answers through every interface query has reached
+		servers = append(servers, net.JoinHostPort(addr.(*net.UDPAddr).IP.String(), reply[3]))
+		if pick {
+			fmt.Printf("%d) %s (version %s)\n", len(servers), servers[len(servers)-1], reply[2])
+		}
+	}
+
+	if len(servers) == 0 {
+		return "", errors.New(NO_SERVER_DISCOVERED)
+	} else if !pick {
+		return servers[0], nil
+	}
+	fmt.Print("Select server: ")
+	scanner.Scan()
+	idx, err := strconv.Atoi(scanner.Text())
+	if err != nil || idx < 1 || idx > len(servers) {
+		return "", errors.New(INVALID_SELECTION)
+	}
+	return servers[idx-1], nil
+}
+
+func sendThread(ch chan string) {
+	go sendHandler(ch)
 
 	for {
 		scanner.Scan()
@@ -151,10 +543,38 @@ func sendThread(myConn net.Conn, ch chan string) {
 			} else if input == "\\rtt" {
 				ch <- GET_RTT
 				startTimeList.PushBack(float64(time.Now().UnixMicro()))
+			} else if strings.HasPrefix(input, "\\join ") {
+				ch <- JOIN_ROOM + strings.TrimSpace(input[6:])
+			} else if input == "\\part" {
+				ch <- PART_ROOM
+			} else if input == "\\rooms" {
+				ch <- ROOM_LIST
+			} else if input == "\\who" || strings.HasPrefix(input, "\\who ") {
+				ch <- ROOM_WHO + strings.TrimSpace(input[4:])
+			} else if input == "\\history" || strings.HasPrefix(input, "\\history ") {
+				ch <- HISTORY + strings.TrimSpace(input[8:])
+			} else if strings.HasPrefix(input, "\\register ") {
+				ch <- REGISTER + input[10:]
+			} else if isOperatorCommand(input) {
+				ch <- OPERATOR + input[1:]
+			} else if strings.HasPrefix(input, "\\topic ") {
+				ch <- ROOM_TOPIC + input[7:]
+			} else if strings.HasPrefix(input, "\\send ") {
+				if receiver, path, ok := strings.Cut(input[6:], " "); ok {
+					go offerFile(receiver, path) // reading file for checksum may take long
+				} else {
+					fmt.Println(INVALID_COMMAND)
+				}
+			} else if strings.HasPrefix(input, "\\accept ") || strings.HasPrefix(input, "\\reject ") ||
+				strings.HasPrefix(input, "\\cancel ") {
+				command, num, _ := strings.Cut(input[1:], " ")
+				answerFile(command, num)
+			} else if input == "\\files" {
+				fmt.Print(fileList())
 			} else if strings.HasPrefix(input, "\\dm ") {
 				msg := input[4:]
-				if strings.Contains(msg, " ") && !strings.Contains(msg, "\\") {
-					ch <- DIRECT_MESSAGE + msg
+				if receiver, text, ok := strings.Cut(msg, " "); ok && !strings.Contains(msg, "\\") {
+					ch <- newPending(DIRECT_MESSAGE, receiver, text, msg)
 				} else {
 					fmt.Println(INVALID_COMMAND)
 				}
@@ -162,14 +582,26 @@ func sendThread(myConn net.Conn, ch chan string) {
 				fmt.Println(INVALID_COMMAND)
 			}
 		} else { // broadcasting message
-			ch <- CLIENT_BROADCAST + input
+			ch <- newPending(CLIENT_BROADCAST, "", input, input)
+		}
+	}
+}
+
+/**
+ * \kick, \ban, \unban, \mute and \unmute, checked by server.
+ */
+func isOperatorCommand(input string) bool {
+	for _, command := range OPERATOR_COMMANDS {
+		if strings.HasPrefix(input, "\\"+command+" ") {
+			return true
 		}
 	}
+	return false
 }
 
-func receiveThread(myConn net.Conn, ch chan string) {
+func receiveThread(ch chan string) {
+	go receiveHandler(ch)
 	for {
-		go receiveHandler(myConn, ch)
 		msg := <-ch
 
 		if strings.HasPrefix(msg, CONN_KILL) { // client kill acception, force kill by server
@@ -198,11 +630,43 @@ func receiveThread(myConn net.Conn, ch chan string) {
 			}
 
 			fmt.Println("from: " + msg[1:idx] + "> " + msg[idx+1:])
+		} else if strings.HasPrefix(msg, PING) { // heartbeat of server
+			writeNow(PONG)
+		} else if strings.HasPrefix(msg, PONG) { // answer of my heartbeat, lastRecv is enough
 		} else if strings.HasPrefix(msg, GET_VERSION) { // receiving ver
 			fmt.Println("Server version: " + msg[1:])
 		} else if strings.HasPrefix(msg, USER_LIST) { // receiving list
 			fmt.Println("User List:")
 			fmt.Print(msg[1:])
+		} else if strings.HasPrefix(msg, ROOM_LIST) { // receiving rooms
+			fmt.Println("Room List:")
+			fmt.Print(msg[1:])
+		} else if strings.HasPrefix(msg, ROOM_WHO) { // receiving who
+			fmt.Println("Room Members:")
+			fmt.Print(msg[1:])
+		} else if strings.HasPrefix(msg, ACK) { // receiving ack of my message
+			id, code, _ := strings.Cut(msg[1:], " ")
+			if p := takePending(id); p != nil {
+				if code == ACK_QUEUED {
+					fmt.Println("[dm to " + p.receiver + " is queued until the user joins]")
+				} else if code != ACK_OK {
+					fmt.Println("[failed: " + REJECT_REASONS[code] + "] " + p.text)
+				}
+			}
+		} else if strings.HasPrefix(msg, RECEIPT) { // receiving receipt of my dm
+			_, receiver, _ := strings.Cut(msg[1:], " ")
+			fmt.Println("[dm delivered to " + receiver + "]")
+		} else if strings.HasPrefix(msg, FILE_OFFER) { // receiving file offer
+			gotOffer(msg[1:])
+		} else if strings.HasPrefix(msg, FILE_REPLY) { // receiving answer and progress of my file
+			gotReply(msg[1:])
+		} else if strings.HasPrefix(msg, FILE_CHUNK) { // receiving relayed file
+			gotChunk(msg[1:])
+		} else if strings.HasPrefix(msg, FILE_END) { // receiving end of relayed file
+			gotEnd(msg[1:])
+		} else if strings.HasPrefix(msg, HISTORY) { // receiving history
+			fmt.Println("Recent Messages:")
+			fmt.Print(msg[1:])
 		} else if strings.HasPrefix(msg, GET_RTT) { // calculating rtt
 			endTime := float64(time.Now().UnixMicro())
 			startTime := startTimeList.Front().Value.(float64)
@@ -218,33 +682,751 @@ func receiveThread(myConn net.Conn, ch chan string) {
 	cleanupAndExit()
 }
 
-func sendHandler(myConn net.Conn, ch <-chan string) {
+/**
+ * writing messages from send thread. when connection is lost, message is written again
+ * after reconnect, except CONN_KILL and messages waiting ack, which reconnect has
+ * already sent again or given up.
+ */
+func sendHandler(ch <-chan string) {
 	for sendChan != nil {
 		msg := <-ch // receive message to send from send thread
-		_, err := myConn.Write([]byte(msg))
-		time.Sleep(time.Millisecond * 10) // slow down, 'cause message are mixed up
-		if err != nil {
-			fmt.Println(SERVER_LOST)
-			cleanupAndExit()
-		} else if strings.HasPrefix(msg, CONN_KILL) { // client will be terminated
+		for {
+			c := getConn()
+			writeMutex.Lock()
+			err := writeFrame(c, msg)
+			writeMutex.Unlock()
+			if err == nil || strings.HasPrefix(msg, CONN_KILL) {
+				break
+			}
+			c.Close() // receiveHandler finds it, and reconnects
+			for getConn() == c {
+				if atomic.LoadInt32(&terminateFlag) != 0 {
+					return
+				}
+				time.Sleep(time.Second / 10)
+			}
+			if isPendingFrame(msg) {
+				break
+			}
+		}
+		if strings.HasPrefix(msg, CONN_KILL) { // client will be terminated
 			cleanupAndExit()
 		}
 	}
 }
 
-func receiveHandler(myConn net.Conn, ch chan<- string) {
-	buffer := make([]byte, BUFFER_SIZE)
-	bufferLen := 0
-	for bufferLen == 0 {
-		bufferLen, err = myConn.Read(buffer)
+func receiveHandler(ch chan<- string) {
+	for {
+		msg, err := readFrame(reader)
 		if err != nil {
+			if atomic.LoadInt32(&terminateFlag) != 0 { // closed by exiting
+				return
+			} else if sessionToken != "" && reconnectTime > 0 && reconnect() {
+				continue
+			}
+			ch <- CONN_KILL + SERVER_LOST // server is gone without CONN_KILL
+			return
+		}
+		atomic.StoreInt64(&lastRecv, time.Now().UnixNano())
+		atomic.AddInt64(&recvCount, 1)
+		ch <- msg
+		if strings.HasPrefix(msg, CONN_KILL) { // connection is closed by server after it
 			return
 		}
 	}
+}
+
+/**
+ * pinging server by heartbeatInterval, and closing connection
+ * when server has sent nothing(even pong) for serverTimeout, so that receiveHandler reconnects.
+ */
+func heartbeat() {
+	for range time.Tick(heartbeatInterval) {
+		if atomic.LoadInt32(&reconnecting) == 1 {
+			continue
+		} else if time.Since(time.Unix(0, atomic.LoadInt64(&lastRecv))) > serverTimeout {
+			fmt.Println(SERVER_TIMED_OUT)
+			getConn().Close()
+			continue
+		}
+		sendChan <- PING
+	}
+}
+
+/**
+ * writing message from receive path, without sendChan. sendHandler stops reading sendChan
+ * after write error until receiveHandler reconnects, so receive path waiting for it would
+ * never reconnect. message is dropped when connection is broken.
+ */
+func writeNow(msg string) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	writeFrame(getConn(), msg)
+}
+
+/**
+ * reads one message framed as [length][message].
+ */
+func readFrame(reader *bufio.Reader) (string, error) {
+	header := make([]byte, FRAME_HEADER)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > uint32(MAX_FRAME_SIZE) {
+		return "", errors.New(FRAME_TOO_LARGE)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(reader, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+/**
+ * writes one message framed as [length][message], with single Write call.
+ */
+func writeFrame(conn net.Conn, msg string) error {
+	frame := make([]byte, FRAME_HEADER+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[FRAME_HEADER:], msg)
+	_, err := conn.Write(frame)
+	return err
+}
+
+/**
+ * registering message to wait for ack, and returns its frame [header][id]" "[body].
+ */
+func newPending(header, receiver, text, body string) string {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	msgSeq++
+	id := sessionID + "." + strconv.Itoa(msgSeq)
+	frame := header + id + " " + body
+	pending[id] = &pendingMsg{text: text, receiver: receiver, frame: frame, seq: msgSeq, sent: time.Now()}
+	return frame
+}
+
+/**
+ * writing messages without ack to resumed connection, in order they were sent.
+ * server ignores ones it has already handled.
+ */
+func resendPending(c net.Conn) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	msgs := make([]*pendingMsg, 0, len(pending))
+	for _, p := range pending {
+		msgs = append(msgs, p)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].seq < msgs[j].seq })
+	for _, p := range msgs {
+		writeFrame(c, p.frame)
+		p.sent, p.marked = time.Now(), false
+	}
+}
+
+/**
+ * checking whether msg is frame of message waiting for ack(see newPending).
+ */
+func isPendingFrame(msg string) bool {
+	if !strings.HasPrefix(msg, CLIENT_BROADCAST) && !strings.HasPrefix(msg, DIRECT_MESSAGE) {
+		return false
+	}
+	id, _, _ := strings.Cut(msg[1:], " ")
+	return strings.HasPrefix(id, sessionID+".")
+}
+
+/**
+ * giving up every message without ack.
+ */
+func failPending(reason string) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	for id, p := range pending {
+		fmt.Println("[failed: " + reason + "] " + p.text)
+		delete(pending, id)
+	}
+}
+
+func takePending(id string) *pendingMsg {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	p := pending[id]
+	delete(pending, id)
+	return p
+}
+
+/**
+ * marking messages without ack, pending after PENDING_TIME and failed after FAIL_TIME.
+ */
+func watchPending() {
+	for range time.Tick(time.Second / 2) {
+		if atomic.LoadInt32(&reconnecting) == 1 { // they are sent again after reconnect
+			continue
+		}
+		pendingMutex.Lock()
+		for id, p := range pending {
+			if time.Since(p.sent) > FAIL_TIME {
+				fmt.Println("[failed: no answer from server] " + p.text)
+				delete(pending, id)
+			} else if time.Since(p.sent) > PENDING_TIME && !p.marked {
+				fmt.Println("[pending] " + p.text)
+				p.marked = true
+			}
+		}
+		pendingMutex.Unlock()
+	}
+}
+
+/**
+ * offering file to receiver after computing its checksum. when directMode is on, sender
+ * waits for receiver on new listener(see serveDirect), and the file is relayed by server
+ * when receiver can't connect to it(see relayFile).
+ */
+func offerFile(receiver, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println("[cannot send file: " + err.Error() + "]")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		fmt.Println("[cannot send file: " + path + " is not a regular file]")
+		return
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		fmt.Println("[cannot send file: " + err.Error() + "]")
+		return
+	}
 
-	msg := string(buffer[0:bufferLen])
-	ch <- msg
-	time.Sleep(time.Millisecond * 10) // slow down, 'cause message are mixed up
+	t := &fileTransfer{peer: receiver, name: filepath.Base(path), path: path, size: info.Size(),
+		sum: hex.EncodeToString(h.Sum(nil)), outgoing: true, direct: "-", ackReady: make(chan bool, 1)}
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	if directMode {
+		if l, err := net.Listen(CONN_TYPE, ":0"); err == nil {
+			_, port, _ := net.SplitHostPort(l.Addr().String()) // server adds my address it sees
+			t.listener, t.direct = l, port+"/"+hex.EncodeToString(secret)
+		}
+	}
+	addFile(t, "")
+	if t.listener != nil {
+		go serveDirect(t, hex.EncodeToString(secret))
+	}
+	fmt.Printf("[offering %s (%s) to %s as file %d]\n", t.name, formatSize(t.size), receiver, t.num)
+	sendChan <- FILE_OFFER + t.id + " " + receiver + " " + strconv.FormatInt(t.size, 10) + " " + t.sum + " " + t.direct + " " + t.name
+}
+
+/**
+ * waiting for receiver connecting directly, and writing the file to the first one with secret.
+ */
+func serveDirect(t *fileTransfer, secret string) {
+	for {
+		c, err := t.listener.Accept()
+		if err != nil { // closed when relayed or ended
+			return
+		}
+		c.SetDeadline(time.Now().Add(DIRECT_TIMEOUT))
+		if msg, err := readFrame(bufio.NewReader(c)); err != nil || msg != secret {
+			c.Close()
+			continue
+		} else if !setFileState(t, FILE_OFFERED, FILE_ACTIVE) {
+			c.Close()
+			return
+		}
+		t.listener.Close()
+		c.SetDeadline(time.Time{})
+		go func() {
+			<-t.stop
+			c.Close()
+		}()
+
+		if err := writeFile(t, c); err != nil && !isStopped(t) {
+			finishFile(t, "[sending file "+strconv.Itoa(t.num)+" "+t.name+" to "+t.peer+" failed: "+err.Error()+"]")
+		}
+		c.Close() // receiver answers by server after verifying
+		return
+	}
+}
+
+func writeFile(t *fileTransfer, c net.Conn) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, FILE_CHUNK_SIZE)
+	for atomic.LoadInt64(&t.done) < t.size {
+		n, err := f.Read(buf[:min(int64(len(buf)), t.size-atomic.LoadInt64(&t.done))])
+		if err != nil {
+			return err
+		} else if _, err := c.Write(buf[:n]); err != nil {
+			return err
+		}
+		atomic.AddInt64(&t.done, int64(n))
+		printProgress(t)
+	}
+	return nil
+}
+
+/**
+ * sending the file in chunks through server, keeping at most FILE_WINDOW bytes ahead of
+ * receiver's ack. chunks go to sendChan with chat messages, so they don't block chatting.
+ */
+func relayFile(t *fileTransfer) {
+	f, err := os.Open(t.path)
+	if err != nil {
+		sendChan <- FILE_END + t.id + " cancel cannot read file"
+		finishFile(t, "[sending file "+strconv.Itoa(t.num)+" "+t.name+" failed: "+err.Error()+"]")
+		return
+	}
+	defer f.Close()
+
+	buf := make([]byte, FILE_CHUNK_SIZE)
+	for offset := int64(0); offset < t.size; {
+		n := min(int64(len(buf)), t.size-offset)
+		for offset+n-atomic.LoadInt64(&t.acked) > FILE_WINDOW {
+			select {
+			case <-t.ackReady:
+			case <-t.stop:
+				return
+			}
+		}
+		if _, err := io.ReadFull(f, buf[:n]); err != nil {
+			sendChan <- FILE_END + t.id + " cancel cannot read file"
+			finishFile(t, "[sending file "+strconv.Itoa(t.num)+" "+t.name+" failed: "+err.Error()+"]")
+			return
+		}
+		waitFrameTurn()
+		select {
+		case sendChan <- FILE_CHUNK + t.id + " " + strconv.FormatInt(offset, 10) + " " + base64.StdEncoding.EncodeToString(buf[:n]):
+		case <-t.stop:
+			return
+		}
+		offset += n
+		atomic.StoreInt64(&t.done, offset)
+		printProgress(t)
+	}
+	sendChan <- FILE_END + t.id + " done"
+}
+
+/**
+ * waiting until next file frame can be sent. chunks and acks of every transfer
+ * are sent FILE_FRAME_GAP apart, so that server doesn't take them as flooding.
+ */
+func waitFrameTurn() {
+	frameMutex.Lock()
+	turn := time.Now()
+	if nextFrame.After(turn) {
+		turn = nextFrame
+	}
+	nextFrame = turn.Add(FILE_FRAME_GAP)
+	frameMutex.Unlock()
+	time.Sleep(time.Until(turn))
+}
+
+/**
+ * "O" from server, offer waits for \accept or \reject.
+ */
+func gotOffer(data string) {
+	args := strings.SplitN(data, " ", 6) // sender, id, size, sha256, direct address, name
+	if len(args) != 6 {
+		fmt.Println(INVALID_MSG_RECV + ": " + FILE_OFFER + data)
+		return
+	}
+	size, err := strconv.ParseInt(args[2], 10, 64)
+	name := filepath.Base(args[5]) // not to be saved out of downloadDir
+	if err != nil || size < 0 || name == "." || name == ".." || name == string(filepath.Separator) {
+		writeNow(FILE_REPLY + args[0] + " " + args[1] + " fail invalid offer")
+		return
+	}
+
+	t := &fileTransfer{peer: args[0], name: name, size: size, sum: args[3], direct: args[4],
+		chunks: make(chan string, int(FILE_WINDOW)/FILE_CHUNK_SIZE+2)}
+	addFile(t, args[1])
+	fmt.Printf("[%s offers file %s (%s). \\accept %d or \\reject %d]\n", t.peer, t.name, formatSize(t.size), t.num, t.num)
+}
+
+/**
+ * \accept, \reject or \cancel of file by its number.
+ */
+func answerFile(command, num string) {
+	n, _ := strconv.Atoi(strings.TrimSpace(num))
+	filesMutex.Lock()
+	t, exist := files[n]
+	filesMutex.Unlock()
+	if !exist || (command != "cancel" && t.outgoing) {
+		fmt.Println("[no such file offered]")
+		return
+	}
+
+	prefix := "[file " + strconv.Itoa(t.num) + " " + t.name
+	switch command {
+	case "accept":
+		if setFileState(t, FILE_OFFERED, FILE_ACTIVE) {
+			go receiveFile(t)
+		} else {
+			fmt.Println(prefix + " is already accepted]")
+		}
+	case "reject":
+		if finishFile(t, prefix+" is rejected]") {
+			sendChan <- FILE_REPLY + t.peer + " " + t.id + " reject"
+		}
+	case "cancel":
+		if !finishFile(t, prefix+" is canceled]") {
+			return
+		} else if t.outgoing {
+			sendChan <- FILE_END + t.id + " cancel canceled by sender"
+		} else {
+			sendChan <- FILE_REPLY + t.peer + " " + t.id + " fail canceled by receiver"
+		}
+	}
+}
+
+/**
+ * receiving accepted file into temporary file of downloadDir, directly from sender when
+ * it can be connected, or relayed by server. it is saved after checksum is verified.
+ */
+func receiveFile(t *fileTransfer) {
+	prefix := "file " + strconv.Itoa(t.num) + " " + t.name + " from " + t.peer
+	tmp, err := os.CreateTemp(downloadDir, "."+t.name+".*.part")
+	if err != nil {
+		sendChan <- FILE_REPLY + t.peer + " " + t.id + " fail receiver cannot save file"
+		finishFile(t, "[receiving "+prefix+" failed: "+err.Error()+"]")
+		return
+	}
+	h := sha256.New()
+	w := io.MultiWriter(tmp, h)
+	if c := dialDirect(t); c != nil {
+		sendChan <- FILE_REPLY + t.peer + " " + t.id + " direct"
+		err = readDirect(t, c, w)
+	} else {
+		sendChan <- FILE_REPLY + t.peer + " " + t.id + " accept"
+		err = readRelayed(t, w)
+	}
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != t.sum {
+		err = errChecksum
+	}
+	tmp.Close()
+
+	path := ""
+	if err == nil {
+		path = savePath(t.name)
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		if !isStopped(t) { // canceled one is already told, and server forwards only known reasons
+			reason := "transfer error"
+			if err == errChecksum {
+				reason = err.Error()
+			}
+			sendChan <- FILE_REPLY + t.peer + " " + t.id + " fail " + reason
+			finishFile(t, "[receiving "+prefix+" failed: "+err.Error()+"]")
+		}
+		return
+	}
+	sendChan <- FILE_REPLY + t.peer + " " + t.id + " ok"
+	finishFile(t, "["+prefix+" is saved as "+path+", checksum verified]")
+}
+
+/**
+ * connecting to directAddr of offer, returns nil when it is not possible.
+ */
+func dialDirect(t *fileTransfer) net.Conn {
+	addr, secret, ok := strings.Cut(t.direct, "/")
+	if !directMode || !ok {
+		return nil
+	}
+	c, err := net.DialTimeout(CONN_TYPE, addr, DIRECT_TIMEOUT)
+	if err != nil {
+		return nil
+	} else if err := writeFrame(c, secret); err != nil {
+		c.Close()
+		return nil
+	}
+	return c
+}
+
+func readDirect(t *fileTransfer, c net.Conn, w io.Writer) error {
+	defer c.Close()
+	go func() {
+		<-t.stop
+		c.Close()
+	}()
+	buf := make([]byte, FILE_CHUNK_SIZE)
+	for atomic.LoadInt64(&t.done) < t.size {
+		c.SetReadDeadline(time.Now().Add(serverTimeout))
+		n, err := c.Read(buf[:min(int64(len(buf)), t.size-atomic.LoadInt64(&t.done))])
+		if isStopped(t) {
+			return errStopped
+		} else if err != nil {
+			return errors.New("direct connection is lost")
+		} else if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		atomic.AddInt64(&t.done, int64(n))
+		printProgress(t)
+	}
+	return nil
+}
+
+func readRelayed(t *fileTransfer, w io.Writer) error {
+	for {
+		var chunk string
+		select {
+		case chunk = <-t.chunks:
+		case <-t.stop:
+			return errStopped
+		}
+		if chunk == "" { // end of file
+			if atomic.LoadInt64(&t.done) != t.size {
+				return errors.New("file is not complete")
+			}
+			return nil
+		}
+
+		offsetStr, encoded, _ := strings.Cut(chunk, " ")
+		offset, err := strconv.ParseInt(offsetStr, 10, 64)
+		data, decodeErr := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || decodeErr != nil || offset != atomic.LoadInt64(&t.done) || offset+int64(len(data)) > t.size {
+			return errors.New("missing chunk")
+		} else if _, err := w.Write(data); err != nil {
+			return err
+		}
+		done := atomic.AddInt64(&t.done, int64(len(data)))
+		waitFrameTurn()
+		sendChan <- FILE_REPLY + t.peer + " " + t.id + " ack " + strconv.FormatInt(done, 10)
+		printProgress(t)
+	}
+}
+
+/**
+ * "P" from server, answer of receiver to my offer.
+ */
+func gotReply(data string) {
+	args := strings.SplitN(data, " ", 3) // receiver, id, reply
+	if len(args) != 3 {
+		fmt.Println(INVALID_MSG_RECV + ": " + FILE_REPLY + data)
+		return
+	}
+	t := findFile(args[0], args[1], true)
+	if t == nil {
+		return
+	}
+	reply, arg, _ := strings.Cut(args[2], " ")
+	prefix := "file " + strconv.Itoa(t.num) + " " + t.name
+	switch reply {
+	case "accept":
+		if setFileState(t, FILE_OFFERED, FILE_ACTIVE) {
+			if t.listener != nil {
+				t.listener.Close()
+			}
+			go relayFile(t)
+		}
+	case "ack":
+		if acked, err := strconv.ParseInt(arg, 10, 64); err == nil {
+			atomic.StoreInt64(&t.acked, acked)
+			select {
+			case t.ackReady <- true:
+			default:
+			}
+		}
+	case "reject":
+		finishFile(t, "["+t.peer+" rejected "+prefix+"]")
+	case "ok":
+		finishFile(t, "["+prefix+" is sent to "+t.peer+", checksum verified]")
+	case "fail":
+		finishFile(t, "[sending "+prefix+" to "+t.peer+" failed: "+arg+"]")
+	}
+}
+
+/**
+ * "Q" from server, given to receiving goroutine of the file.
+ */
+func gotChunk(data string) {
+	sender, rest, _ := strings.Cut(data, " ")
+	id, chunk, _ := strings.Cut(rest, " ")
+	if t := findFile(sender, id, false); t != nil {
+		select {
+		case t.chunks <- chunk:
+		default: // sender is not keeping window
+			writeNow(FILE_REPLY + t.peer + " " + t.id + " fail too many chunks")
+			finishFile(t, "[receiving file "+strconv.Itoa(t.num)+" "+t.name+" failed: too many chunks]")
+		}
+	}
+}
+
+/**
+ * "R" from server, end or cancel of offered file.
+ */
+func gotEnd(data string) {
+	args := strings.SplitN(data, " ", 3) // sender, id, result
+	if len(args) != 3 {
+		fmt.Println(INVALID_MSG_RECV + ": " + FILE_END + data)
+		return
+	}
+	t := findFile(args[0], args[1], false)
+	if t == nil {
+		return
+	}
+	if result, reason, _ := strings.Cut(args[2], " "); result == "done" {
+		gotChunk(args[0] + " " + args[1] + " ") // "" after last chunk
+	} else {
+		finishFile(t, "[file "+strconv.Itoa(t.num)+" "+t.name+" from "+t.peer+" is canceled: "+reason+"]")
+	}
+}
+
+/**
+ * numbering transfer, and giving id to my file.
+ */
+func addFile(t *fileTransfer, id string) {
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	fileSeq++
+	t.num, t.id, t.state, t.stop = fileSeq, id, FILE_OFFERED, make(chan bool)
+	if t.outgoing {
+		t.id = sessionID + ".f" + strconv.Itoa(fileSeq)
+	}
+	files[t.num] = t
+}
+
+/**
+ * transfer of id, sent by me or by sender.
+ */
+func findFile(peer, id string, outgoing bool) *fileTransfer {
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	for _, t := range files {
+		if t.id == id && t.outgoing == outgoing && (outgoing || t.peer == peer) {
+			return t
+		}
+	}
+	return nil
+}
+
+func setFileState(t *fileTransfer, from, to string) bool {
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	if _, exist := files[t.num]; !exist || t.state != from {
+		return false
+	}
+	t.state = to
+	return true
+}
+
+/**
+ * ending transfer with msg. returns false when it has already ended.
+ */
+func finishFile(t *fileTransfer, msg string) bool {
+	filesMutex.Lock()
+	if _, exist := files[t.num]; !exist {
+		filesMutex.Unlock()
+		return false
+	}
+	delete(files, t.num)
+	filesMutex.Unlock()
+
+	t.stopOnce.Do(func() { close(t.stop) })
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	fmt.Println(msg)
+	return true
+}
+
+func isStopped(t *fileTransfer) bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+ * giving up every transfer, server has already forgotten them.
+ */
+func failFiles(reason string) {
+	filesMutex.Lock()
+	list := make([]*fileTransfer, 0, len(files))
+	for _, t := range files {
+		list = append(list, t)
+	}
+	filesMutex.Unlock()
+	for _, t := range list {
+		finishFile(t, "[file "+strconv.Itoa(t.num)+" "+t.name+" failed: "+reason+"]")
+	}
+}
+
+/**
+ * printing progress at every quarter of the file, except the end.
+ */
+func printProgress(t *fileTransfer) {
+	if t.size == 0 {
+		return
+	}
+	if quarter := 4 * atomic.LoadInt64(&t.done) / t.size; quarter > t.shown && quarter < 4 {
+		t.shown = quarter
+		fmt.Printf("[file %d %s: %d%% of %s]\n", t.num, t.name, quarter*25, formatSize(t.size))
+	}
+}
+
+/**
+ * "[number]) [name] to|from [peer]: [state] [percent]% of [size]\n" of every transfer, for \files.
+ */
+func fileList() string {
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	if len(files) == 0 {
+		return "[no file transfers]\n"
+	}
+	nums := make([]int, 0, len(files))
+	for num := range files {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	var sb strings.Builder
+	for _, num := range nums {
+		t := files[num]
+		direction, percent := "from", int64(100)
+		if t.outgoing {
+			direction = "to"
+		}
+		if t.size > 0 {
+			percent = 100 * atomic.LoadInt64(&t.done) / t.size
+		}
+		fmt.Fprintf(&sb, "%d) %s %s %s: %s %d%% of %s\n", num, t.name, direction, t.peer, t.state, percent, formatSize(t.size))
+	}
+	return sb.String()
+}
+
+/**
+ * path in downloadDir not used yet, "name(1).ext" and so on when name is used.
+ */
+func savePath(name string) string {
+	ext := filepath.Ext(name)
+	path := filepath.Join(downloadDir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = filepath.Join(downloadDir, strings.TrimSuffix(name, ext)+"("+strconv.Itoa(i)+")"+ext)
+	}
+}
+
+func formatSize(size int64) string {
+	if size < 1<<10 {
+		return strconv.FormatInt(size, 10) + " B"
+	} else if size < 1<<20 {
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	} else if size < 1<<30 {
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	}
+	return fmt.Sprintf("%.1f GB", float64(size)/(1<<30))
 }
 
 func initCtrlCHandler() {
@@ -252,10 +1434,35 @@ func initCtrlCHandler() {
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-ch
+		if atomic.LoadInt32(&chatting) == 0 { // no one reads sendChan yet, e.g. while password is asked
+			if state := passwordTerm.Load(); state != nil {
+				term.Restore(int(os.Stdin.Fd()), state)
+			}
+			fmt.Println()
+			os.Exit(1)
+		}
 		sendChan <- CONN_KILL
 	}()
 }
 
+/**
+ * reading password without echo when stdin is terminal, otherwise one line of stdin.
+ */
+func readPassword() string {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		scanner.Scan()
+		return scanner.Text()
+	}
+	if state, err := term.GetState(fd); err == nil {
+		passwordTerm.Store(state)
+		defer passwordTerm.Store(nil)
+	}
+	password, _ := term.ReadPassword(fd)
+	fmt.Println()
+	return string(password)
+}
+
 func cleanupAndExit() {
 	if atomic.AddInt32(&terminateFlag, 1) == 1 { // concurrency control: do just one time
 		fmt.Println(EXIT_MSG)
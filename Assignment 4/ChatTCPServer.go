@@ -2,12 +2,42 @@ package main
 
 /**
  * 20170454 Yi Changmin
+ *
+ * build: go build ChatTCPServer.go ChatRoom.go
+ * usage: ChatTCPServer [-capacity 64] [-room-capacity 8] [-filter chatfilter.txt]
+ *                      [-history 100] [-history-dir dir]
+ *                      [-accounts chataccounts.txt] [-guests=false]
+ *                      [-ops nickname,nickname] [-bans chatbans.txt]
+ *                      [-msg-limit 2:10] [-dm-limit 1:5] [-cmd-limit 2:10] [-file-limit 256:512]
+ *                      [-flood-warnings 3] [-flood-mutes 2] [-flood-mute 30s]
+ *                      [-send-queue 256] [-slow-policy drop|kick] [-write-timeout 10s]
+ *                      [-heartbeat 15s] [-peer-timeout 45s] [-resume-grace 60s]
+ * capacity is the number of users on server, and room capacity is
+ * the number of users in each room except DEFAULT_ROOM.
+ * filter is moderation rule file(see loadFilter), reloaded by SIGHUP or admin RELOAD.
+ * history is the number of broadcasts kept in each room, and they are
+ * also written in history dir when it is given(see openHistory).
+ * accounts is file of registered nicknames(see accountBook), registration is disabled when it is empty.
+ * unregistered(guest) nicknames are not allowed with -guests=false.
+ * ops are operators(see handleOperator), also granted by admin OP.
+ * bans is file of bans by operators(see banList), not persisted when it is empty.
+ * limits are [rate per second]:[burst] of broadcasts, dms, other commands and file frames of each user,
+ * and flood options are how users over limits are warned, muted and kicked(see floodGuard).
+ * send queue is bounded for each user, so that slow one doesn't block others.
+ * when it is full, oldest message is dropped or user is disconnected by slow policy.
+ * every user is pinged by heartbeat interval, and user sending nothing for peer timeout
+ * is disconnected(see heartbeat).
+ * session of user whose connection is lost is kept for resume grace, and client can resume it
+ * with its token. resume grace 0 is leaving at once(see parkSession).
+ * files offered by users are relayed in chunks, with flow control(see relayChunk).
  */
 
 /**
 MESSAGE FORMAT
+every message is framed as [length][message],
+[length] is 4-byte big-endian byte count of [message] (see readFrame)
 "0": connection request, connection accept
-	client: "0"[nickname]
+	client: "0"[nickname] as guest, or "0"[nickname]" "[password] for registered nickname
 	server: "0"[welcomeMsg]
 "1": connection request reject
 	server: "1"[rejectReason]
@@ -15,13 +45,18 @@ MESSAGE FORMAT
 	client: "2"
 	server: "2"[killReason]
 "3": broadcast message by client
-	client: "3"[senderNickname]" "[msg]
+	client: "3"[msgID]" "[msg]
+	server: "3"[senderNickname]" "[msg]
 "4": broadcast message by server
 	server: "4"[msg]
 "5": direct message
-	sender: "5"[receiverNickname]" "[msg]
+	sender: "5"[msgID]" "[receiverNickname]" "[msg]
 	server changes [receiverNickname] to [senderNickname]
 	receiver: "5"[senderNickname]" "[msg]
+	message queued for offline receiver is delivered when it joins next time,
+	with "[offline hh:mm:ss] " before [msg] (see sendDM)
+	offline receiver should be registered, or connected within OFFLINE_SEEN_AGE
+	and not among least recently seen ones over OFFLINE_MAX_SEEN
 "6": version of server
 	client: "6"
 	server: "6"[serverVersion]
@@ -31,24 +66,184 @@ MESSAGE FORMAT
 "8": rtt
 	client: "8"
 	server: "8"
+"9": admin command, sent instead of connection request (see handleAdmin)
+	admin: "9"[adminCommand]
+	server: "9"[result]
+"A": join room, user is in DEFAULT_ROOM after connection
+	client: "A"[roomName]
+	server: "4"[result]
+"B": part room, and go back to DEFAULT_ROOM
+	client: "B"
+	server: "4"[result]
+"C": list of rooms
+	client: "C"
+	server: "C"[roomListMsg]
+"D": members of room, current room when [roomName] is empty
+	client: "D"[roomName]
+	server: "D"[listMsg]
+"E": topic of current room
+	client: "E"[topic]
+	server: "4"[topicMsg] to room members
+"F": recent broadcasts of current room, sent after joining room too
+	client: "F"[count]
+	server: "F"[historyMsg]
+"G": acknowledgement of "3" and "5", [code] is ACK_OK, ACK_QUEUED or reject reason
+	server: "G"[msgID]" "[code]
+"H": delivery receipt of "5", sent after dm is written to receiver's connection
+	server: "H"[msgID]" "[receiverNickname]
+"I": registering nickname with password
+	client: "I"[nickname]" "[password] instead of connection request, then same as "0"
+	client: "I"[password] after connection, for its own nickname
+	server: "4"[result]
+"J": operator command (see handleOperator)
+	client: "J"[command]
+	server: "4"[result] to operator, or "4"[notice] to all users
+"K": heartbeat ping, sent by both sides when heartbeat interval passes
+	server, client: "K"
+"L": heartbeat pong, answer of "K"
+	server, client: "L"
+"M": resume token of session, sent after welcome
+	server: "M"[token]
+"N": resuming session, sent instead of connection request
+	client: "N"[token]" "[received], [received] is the number of messages after "M"
+	server: "0"[welcomeBackMsg] and messages after [received] again, or "1"[rejectReason]
+	client sends messages not acknowledged yet again, and server ignores ones already handled
+"O": file offer (see offerFile)
+	sender: "O"[fileID]" "[receiverNickname]" "[size]" "[sha256]" "[directPort]" "[fileName]
+	server changes [receiverNickname] to [senderNickname], and [directPort] to [directAddr]
+	receiver: "O"[senderNickname]" "[fileID]" "[size]" "[sha256]" "[directAddr]" "[fileName]
+	[directPort] is [port]"/"[secret] where sender waits for receiver, or "-"
+	[directAddr] is [host:port]"/"[secret] with host of sender seen by server, or "-"
+"P": file reply, from receiver of offer to its sender (see replyFile)
+	receiver: "P"[senderNickname]" "[fileID]" "[reply]
+	server changes [senderNickname] to [receiverNickname]
+	sender: "P"[receiverNickname]" "[fileID]" "[reply]
+	[reply] is "accept" to relay, "direct" when receiver is connected to [directAddr], "reject",
+	"ack "[bytes] of relayed bytes written, "ok" when checksum is verified, or "fail "[reason]
+"Q": file chunk relayed after "accept" (see relayChunk)
+	sender: "Q"[fileID]" "[offset]" "[base64Data]
+	receiver: "Q"[senderNickname]" "[fileID]" "[offset]" "[base64Data]
+"R": end of file by sender, [result] is "done" after last chunk or "cancel "[reason] (see endFile)
+	sender: "R"[fileID]" "[result]
+	receiver: "R"[senderNickname]" "[fileID]" "[result]
+	server also sends "P" with "fail" or "R" with "cancel" when transfer can't go on
+[msgID] and [fileID] are chosen by client, without space and at most MAX_MSG_ID bytes
 */
 
 import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
 const (
-	CONN_TYPE      string = "tcp"
-	SERVER_PORT    string = "20454"
-	SERVER_VERSION string = "1.0.0"
-	BUFFER_SIZE    int    = 1024
+	CONN_TYPE       string = "tcp"
+	SERVER_PORT     string = "20454"
+	SERVER_VERSION  string = "1.0.0"
+	MAX_FRAME_SIZE  int    = 1 << 16
+	FRAME_HEADER    int    = 4
+	ROOM_CAPACITY   int    = 8  // default of -room-capacity
+	SERVER_CAPACITY int    = 64 // default of -capacity
+	DEFAULT_ROOM    string = "lobby"
+	MAX_ROOM_NAME   int    = 32
+	HISTORY_SIZE    int    = 100 // default of -history
+	HISTORY_ON_JOIN int    = 10  // broadcasts sent to user joining room
+
+	HISTORY_TRIM_RATIO int = 2 // see trimHistory
+
+	LINGER_TIME time.Duration = 2 * time.Second // see lingerClose
+
+	// send queue of each user (see deliverWithReceipt)
+	SEND_QUEUE_SIZE int           = 256 // default of -send-queue
+	WRITE_TIMEOUT   time.Duration = 10 * time.Second
+	SLOW_DROP       string        = "drop" // policies of -slow-policy
+	SLOW_KICK       string        = "kick"
+
+	// dead peer detection (see heartbeat)
+	HEARTBEAT_INTERVAL time.Duration = 15 * time.Second // default of -heartbeat
+	PEER_TIMEOUT       time.Duration = 45 * time.Second // default of -peer-timeout
+
+	// session resume (see parkSession)
+	RESUME_GRACE time.Duration = time.Minute     // default of -resume-grace
+	RESUME_LOG   int           = 256             // messages kept to be sent again, and ids of client messages
+	RESUME_WAIT  time.Duration = 5 * time.Second // for serverTask to find connection is lost
+
+	// file transfer (see offerFile)
+	FILE_CHUNK_SIZE int           = 16 << 10 // bytes of chunk before base64
+	FILE_WINDOW     int64         = 8 * int64(FILE_CHUNK_SIZE)
+	FILE_MAX_SIZE   int64         = 1 << 30
+	FILE_MAX_NAME   int           = 255
+	FILE_MAX_OFFERS int           = 4 // transfers of each sender
+	FILE_OFFER_TIME time.Duration = 5 * time.Minute
+	FILE_FAIL_OTHER string        = "receiver failed" // sent instead of reason not in FILE_FAIL_REASONS
+
+	// offline direct message queue (see sendDM)
+	OFFLINE_MAX_PER_USER   int           = 20
+	OFFLINE_MAX_PER_SENDER int           = 50
+	OFFLINE_MAX_TOTAL      int           = 1000
+	OFFLINE_MAX_AGE        time.Duration = 24 * time.Hour
+	OFFLINE_SEEN_AGE       time.Duration = 7 * 24 * time.Hour // guest nickname can get dms for this after it has left
+	OFFLINE_MAX_SEEN       int           = 10000              // seen nicknames kept, least recently seen one is forgotten over it
+
+	// registered nicknames (see accountBook)
+	ACCOUNT_FILE     string = "chataccounts.txt" // default of -accounts
+	HASH_NAME        string = "pbkdf2-sha256"
+	HASH_ITERATIONS  int    = 600000
+	HASH_SALT_SIZE   int    = 16
+	HASH_SIZE        int    = 32
+	PASSWORD_MIN_LEN int    = 8
+	PASSWORD_MAX_LEN int    = 128
+	BAN_FILE         string = "chatbans.txt" // default of -bans
+
+	// login throttling (see loginGuard and hashPassword)
+	LOGIN_FREE_FAILS    int           = 3           // failed logins of nickname or address before backoff
+	LOGIN_BACKOFF       time.Duration = time.Second // doubled on every failure after free ones
+	LOGIN_BACKOFF_MAX   time.Duration = 5 * time.Minute
+	LOGIN_FAIL_RESET    time.Duration = 15 * time.Minute // failures are forgotten after this without new one
+	HASH_MAX_CONCURRENT int           = 4                // password hashes computed at once
+	HASH_WAIT           time.Duration = 5 * time.Second
+
+	// flood protection (see floodGuard), kinds of rate limit
+	LIMIT_MSG      int           = 0
+	LIMIT_DM       int           = 1
+	LIMIT_CMD      int           = 2
+	LIMIT_FILE     int           = 3 // file chunks and replies
+	FLOOD_WARNINGS int           = 3 // default of -flood-warnings
+	FLOOD_MUTES    int           = 2 // default of -flood-mutes
+	FLOOD_MUTE     time.Duration = 30 * time.Second
+	FLOOD_FORGIVE  time.Duration = time.Minute
+
+	// nickname policy (see checkNickname), length is in characters
+	NICK_MIN_LEN     int    = 2
+	NICK_MAX_LEN     int    = 16
+	NICK_EXTRA_CHARS string = "_-." // allowed besides letters and digits
+	NICK_MAX_MARKS   int    = 4     // combining marks on one letter or digit
 
 	CONN_REQUSET     string = "0"
 	CONN_REJECT      string = "1"
@@ -59,18 +254,110 @@ const (
 	GET_VERSION      string = "6"
 	USER_LIST        string = "7"
 	GET_RTT          string = "8"
+	ADMIN_COMMAND    string = "9"
+	JOIN_ROOM        string = "A"
+	PART_ROOM        string = "B"
+	ROOM_LIST        string = "C"
+	ROOM_WHO         string = "D"
+	ROOM_TOPIC       string = "E"
+	HISTORY          string = "F"
+	ACK              string = "G"
+	RECEIPT          string = "H"
+	REGISTER         string = "I"
+	OPERATOR         string = "J"
+	PING             string = "K"
+	PONG             string = "L"
+	SESSION          string = "M"
+	RESUME           string = "N"
+	FILE_OFFER       string = "O"
+	FILE_REPLY       string = "P"
+	FILE_CHUNK       string = "Q"
+	FILE_END         string = "R"
+	CONN_LOST        string = "\x00" // made by recvHandler when connection is lost, never sent
 
-	BADWORD_STR string = "i hate professor"
+	MAX_MSG_ID      int    = 32
+	ACK_OK          string = "OK"
+	ACK_QUEUED      string = "QUEUED"       // dm is queued for offline receiver
+	REJ_BLOCKED     string = "BLOCKED"      // blocked by filter
+	REJ_MUTED       string = "MUTED"        // sender is muted
+	REJ_NO_USER     string = "NO_USER"      // receiver nickname is not valid, or not known for offline dm
+	REJ_QUEUE_FULL  string = "QUEUE_FULL"   // offline queue of receiver is full
+	REJ_SENDER_FULL string = "SENDER_FULL"  // sender has too many dms in offline queue
+	REJ_RATE        string = "RATE_LIMITED" // sender is over rate limit
+
+	BADWORD_STR string = "i hate professor" // kicked by default, when there is no filter file
+
+	// moderation filter (see loadFilter)
+	FILTER_FILE     string        = "chatfilter.txt"
+	FILTER_STRIKES  int           = 3 // user is kicked on this strike
+	FILTER_MUTE     time.Duration = time.Minute
+	FILTER_COOLDOWN time.Duration = 5 * time.Minute
+
+	ACTION_NONE int = 0 // actions are in order of severity
+	ACTION_MASK int = 1
+	ACTION_WARN int = 2
+	ACTION_MUTE int = 3
+	ACTION_KICK int = 4
 
 	LISTENER_OPEN_ERR       string = "cannot open server"
 	CONN_OPEN_ERR           string = "connection error"
 	REJECT_MSG_ROMM_FULL    string = "chatting room full. cannot connect"
 	REJECT_MSG_NICKNAME_DUP string = "that nickname is already used by another user. cannot connect"
+	REJECT_MSG_NICK_SHORT   string = "that nickname is too short. cannot connect"
+	REJECT_MSG_NICK_LONG    string = "that nickname is too long. cannot connect"
+	REJECT_MSG_NICK_UTF8    string = "that nickname is not valid UTF-8. cannot connect"
+	REJECT_MSG_NICK_CHAR    string = "nickname can have letters, digits and " + NICK_EXTRA_CHARS + " only. cannot connect"
+	REJECT_MSG_NICK_MARK    string = "nickname can't start with combining mark, or have too many of them on one letter. cannot connect"
+	REJECT_MSG_NICK_RESERVE string = "that nickname is reserved. cannot connect"
 	SERVER_DOWN             string = "[server has been terminated]"
 	BADWORD_KILL            string = "[you used bad word]"
-	EXIT_MSG                string = "gg~"
-	INVALID_RECEIVER        string = "invalid direct message receiver: "
-	INTERPRET_FAIL          string = "invalid message format"
+	FLOOD_KILL              string = "[you are kicked for flooding]"
+	SLOW_KILL               string = "[you are disconnected, because messages are not received in time]"
+	REJECT_MSG_COOLDOWN     string = "you were kicked for bad words. cannot connect for "
+	REJECT_MSG_NICK_OWNED   string = "that nickname is registered. connect with its password"
+	REJECT_MSG_NOT_OWNED    string = "that nickname is not registered. connect without password"
+	REJECT_MSG_LOGIN_FAIL   string = "wrong password. cannot connect"
+	REJECT_MSG_LOGIN_WAIT   string = "too many failed logins. cannot connect for "
+	REJECT_MSG_BUSY         string = "server is busy. try again later"
+	REJECT_MSG_GUESTS_OFF   string = "guests are not allowed. register nickname to connect"
+	REJECT_MSG_REGISTER     string = "cannot register: "
+	REGISTERED_MSG          string = "[your nickname is registered]"
+	REJECT_MSG_BANNED       string = "you are banned"
+	REJECT_MSG_NO_SESSION   string = "session is over. cannot resume"
+	NOT_OPERATOR            string = "[you are not an operator]"
+	NO_SUCH_USER            string = "[no such user]"
+	BAN_NOT_SAVED           string = "[bans are not persisted, change is lost when server restarts]"
+	OPERATOR_USAGE          string = "[usage: kick nickname [reason] | ban nickname|ip duration|perm [reason] | " +
+		"unban nickname|ip | mute nickname duration | unmute nickname], duration is like 90s, 10m or 2h"
+	EXIT_MSG            string = "gg~"
+	INVALID_RECEIVER    string = "invalid direct message receiver: "
+	UNKNOWN_RECEIVER    string = "unknown offline direct message receiver: "
+	INTERPRET_FAIL      string = "invalid message format"
+	FRAME_TOO_LARGE     string = "message is too large"
+	REJECT_MSG_DRAINING string = "server is going down. cannot connect"
+	KICK_MSG            string = "[you are kicked by admin]"
+	INVALID_ROOM_NAME   string = "[invalid room name]"
+	NO_SUCH_ROOM        string = "[no such room]"
+	ALREADY_IN_ROOM     string = "[you are already in that room]"
+	NO_HISTORY          string = "[no messages in history]"
+
+	ADMIN_SECRET_ENV   string = "CHAT_ADMIN_SECRET"
+	ADMIN_OK           string = "OK"
+	ADMIN_ERR_AUTH     string = "ERR authentication required"
+	ADMIN_ERR_FORMAT   string = "ERR wrong admin command"
+	ADMIN_ERR_DISABLED string = "ERR admin is disabled"
+
+	LOG_QUIET int32 = 0
+	LOG_INFO  int32 = 1
+	LOG_DEBUG int32 = 2
+
+	// LAN discovery (see serveDiscovery)
+	DISCOVERY_GROUP      string = "239.255.20.45"
+	DISCOVERY_PORT       int    = 20455
+	DISCOVERY_QUERY      string = "DISCOVER"
+	DISCOVERY_REPLY      string = "SERVICE"
+	DISCOVERY_QUERY_SIZE int    = 64
+	SERVICE_TYPE         string = "chat"
 )
 
 var (
@@ -92,214 +379,2707 @@ var (
 		" left. There are ",
 		" users now]",
 	}
+	ROOM_JOIN_MSG []string = []string{
+		"[",
+		" joined room ",
+		". There are ",
+		" users in the room]",
+	}
+	ROOM_PART_MSG []string = []string{
+		"[",
+		" left room ",
+		". There are ",
+		" users in the room]",
+	}
 	FORCE_KILL_MSG []string = []string{
 		"[",
 		" is disconnected. There are ",
 		" users in the chat room.]",
 	}
+	TIMEOUT_MSG []string = []string{
+		"[",
+		" timed out. There are ",
+		" users now]",
+	}
 
 	listener net.Listener
 
-	totalClientCount   int32                  = 0                            // shared variable, thus should be thread-safe
-	nicknameToSendChan map[string]chan string = make(map[string]chan string) // for broadcast, \dm called by other clients
-	nicknameToConn     map[string]net.Conn    = make(map[string]net.Conn)    // for \list called by other clients and server force stop
+	ACTION_NAMES   []string = []string{"none", "mask", "warn", "mute", "kick"}
+	LIMIT_NAMES    []string = []string{"msg", "dm", "cmd", "file"} // by LIMIT_MSG, LIMIT_DM, LIMIT_CMD and LIMIT_FILE
+	RESERVED_NICKS []string = []string{"admin", "server", "system", "root", "operator", "moderator", "everyone", "nobody"}
+
+	// reasons of "fail" file reply, forwarded to sender
+	FILE_FAIL_REASONS []string = []string{"invalid offer", "canceled by receiver", "receiver cannot save file",
+		"checksum mismatch", "too many chunks", "transfer error"}
+
+	serverCapacity, roomCapacity int
+	filterFile                   string
+	historySize                  int
+	historyDir                   string     // "" when history is not persisted
+	chatFilter                   *moderator = newModerator()
+	allUsers                     *room      // every connected user, for nickname, \dm, \list and admin
+	accountFile                  string
+	allowGuests                  bool
+	accounts                     *accountBook
+	logins                       *loginGuard = newLoginGuard()
+	hashSlots                    chan bool   = make(chan bool, HASH_MAX_CONCURRENT) // taken while hash is computed
+	errHashBusy                  error       = errors.New("server is busy")
+	banFile                      string
+	bans                         *banList
+	limits                       []rateLimit = []rateLimit{{2, 10}, {1, 5}, {2, 10}, {256, 512}} // by LIMIT_NAMES
+	floodWarnings, floodMutes    int
+	floodMute                    time.Duration
+	sendQueueSize                int
+	slowPolicy                   string
+	writeTimeout                 time.Duration
+	heartbeatInterval            time.Duration
+	peerTimeout                  time.Duration
+	resumeGrace                  time.Duration
+
+	opsMutex  sync.Mutex                                  // guards operators
+	operators map[string]string = make(map[string]string) // nickKey to nickname
+
+	sessionsMutex sync.Mutex                                    // guards sessions
+	sessions      map[string]*member = make(map[string]*member) // resume token to member
+
+	transfersMutex sync.Mutex                                        // guards transfers and what they have
+	transfers      map[string]*transfer = make(map[string]*transfer) // transferKey to transfer
+	relayedBytes   int64                = 0                          // file bytes relayed in total, atomic
+
+	offlineMutex    sync.Mutex                                          // guards offline dms and seenNicks, taken before room's own mutex
+	offlineDMs      map[string][]queuedDM = make(map[string][]queuedDM) // nickKey of receiver to its dms, oldest first
+	offlineCount    int                   = 0
+	offlineBySender map[string]int        = make(map[string]int)       // nickKey of sender to its dms in offlineDMs
+	seenNicks       map[string]time.Time  = make(map[string]time.Time) // nickKey to last time user has joined or left
+
+	adminSecret []byte   // nil when admin is disabled
+	draining    int32    = 0
+	dropped     int64    = 0 // messages dropped from send queues
+	slowKicks   int64    = 0 // users disconnected for slow send queue
+	logLevel    int32    = LOG_INFO
+	LOG_LEVELS  []string = []string{"quiet", "info", "debug"}
 
 	err error
 )
 
-func main() {
-	initCtrlCHandler()
+/**
+ * message to user. written is called(in new goroutine) after msg is written to connection.
+ */
+type outbound struct {
+	msg     string
+	written func()
+}
 
-	listener, err = net.Listen(CONN_TYPE, ":"+SERVER_PORT)
-	if err != nil {
-		fmt.Println(LISTENER_OPEN_ERR)
-		return
-	}
-	defer listener.Close()
+/**
+ * messages to one user, written by its sendHandler.
+ * it is bounded by sendQueueSize, and slowPolicy is applied when it is full(see deliverWithReceipt).
+ * ready has a value when items may not be empty.
+ */
+type sendQueue struct {
+	mutex   sync.Mutex
+	items   []outbound
+	ready   chan bool
+	dropped int        // messages dropped from this queue
+	killed  bool       // kill for slow user is queued, and nothing is queued after it
+	written int64      // messages written in this session, sequence number of last one
+	sentLog []outbound // last RESUME_LOG written messages, sent again on resume
+}
 
+func newSendQueue() *sendQueue {
+	return &sendQueue{ready: make(chan bool, 1)}
+}
+
+/**
+ * taking oldest message, waits until there is one.
+ * returns false when stop is closed.
+ */
+func (q *sendQueue) pop(stop <-chan bool) (outbound, bool) {
 	for {
-		conn, err := listener.Accept()
-		if err != nil || conn == nil {
-			fmt.Println(CONN_OPEN_ERR)
-		} else {
-			go serverTask(conn)
+		select {
+		case <-stop:
+			return outbound{}, false
+		default:
+		}
+
+		q.mutex.Lock()
+		if len(q.items) > 0 {
+			out := q.items[0]
+			q.items = q.items[1:]
+			if len(q.items) > 0 {
+				q.signal()
+			}
+			q.mutex.Unlock()
+			return out, true
+		}
+		q.mutex.Unlock()
+		select {
+		case <-q.ready:
+		case <-stop:
 		}
 	}
 }
 
-func serverTask(myConn net.Conn) { // main functionality of server
-	defer myConn.Close()
+/**
+ * dropping oldest droppable message(see isDroppable). returns false when there is none.
+ * mutex should be held.
+ */
+func (q *sendQueue) dropOldest() bool {
+	for i, out := range q.items {
+		if isDroppable(out.msg) {
+			q.items = append(q.items[:i:i], q.items[i+1:]...)
+			q.dropped++
+			atomic.AddInt64(&dropped, 1)
+			return true
+		}
+	}
+	return false
+}
 
-	buffer := make([]byte, 128)
-	bufferLen, err := myConn.Read(buffer)
-	if err != nil || bufferLen == 0 {
-		myConn.Write([]byte(CONN_REJECT + "receive error"))
-		myConn.Close()
-		return
+/**
+ * putting back message which is not written, to be written first.
+ */
+func (q *sendQueue) unpop(out outbound) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.items = append([]outbound{out}, q.items...)
+	q.signal()
+}
+
+/**
+ * counting written message, and keeping it for resume.
+ */
+func (q *sendQueue) sent(out outbound) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.written++
+	q.sentLog = append(q.sentLog, outbound{out.msg, nil}) // receipt is not sent again
+	if len(q.sentLog) > RESUME_LOG {
+		q.sentLog = q.sentLog[len(q.sentLog)-RESUME_LOG:]
 	}
+}
 
-	myNickname := string(buffer[1:bufferLen])
-	if atomic.LoadInt32(&totalClientCount) == 8 { // reject because room is full
-		myConn.Write([]byte(CONN_REJECT + REJECT_MSG_ROMM_FULL))
-		myConn.Close()
-		return
-	} else if _, exist := nicknameToSendChan[myNickname]; exist == true { // reject because nickname is already in use
-		myConn.Write([]byte(CONN_REJECT + REJECT_MSG_NICKNAME_DUP))
-		myConn.Close()
-		return
-	} else { // accept, and get into chatting room
-		tmpCnt := atomic.AddInt32(&totalClientCount, 1)
-		welcomeMsg := WELCOME_MSG[0] + myNickname +
-			WELCOME_MSG[1] + myConn.LocalAddr().String() +
-			WELCOME_MSG[2] + fmt.Sprint(tmpCnt) + WELCOME_MSG[3]
-		serverMsg := CONN_SERVER_MSG[0] + myNickname + CONN_SERVER_MSG[1] + myConn.RemoteAddr().String() +
-			CONN_SERVER_MSG[2] + fmt.Sprint(tmpCnt) + CONN_SERVER_MSG[3]
-		myConn.Write([]byte(CONN_REQUSET + welcomeMsg))
-		fmt.Println(serverMsg)
+/**
+ * queueing messages after received(the number of messages client has received in this session)
+ * before messages not written yet. messages older than sentLog are lost, and client is told about them.
+ * returns the number of messages sent again.
+ */
+func (q *sendQueue) resume(received int64) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	received = max(0, min(received, q.written))
+	first := q.written - int64(len(q.sentLog)) + 1 // sequence number of sentLog[0]
+	replay := append([]outbound{}, q.sentLog[max(0, received-first+1):]...)
+	if lost := first - 1 - received; lost > 0 {
+		replay = append([]outbound{{SERVER_BROADCAST + fmt.Sprintf("[%d messages are lost while disconnected]", lost), nil}}, replay...)
 	}
+	q.items = append(replay, q.items...)
+	q.written, q.sentLog = received, nil
+	q.signal()
+	return len(replay)
+}
 
-	myRecvChan := make(chan string)             // receive channel: from client to server
-	mySendChan := make(chan string)             // send channel: from server to client
-	nicknameToSendChan[myNickname] = mySendChan // register my nickname and channel pair
-	nicknameToConn[myNickname] = myConn         // register my nickname and connection pair
+/**
+ * waking up pop. mutex should be held.
+ */
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- true:
+	default: // already has value
+	}
+}
 
-	defer close(myRecvChan)
-	defer close(mySendChan)
+/**
+ * "queued=[n] dropped=[n]" for admin.
+ */
+func (q *sendQueue) String() string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return fmt.Sprintf("queued=%d dropped=%d", len(q.items), q.dropped)
+}
 
-	go recvHandler(myConn, myRecvChan) // from recvHandler, this goroutine gets message from client
-	go sendHandler(myConn, mySendChan) //to sendHandler, this goroutine sends message to client
+/**
+ * one user in chat room.
+ * messages to user go through queue, until done is closed by its serverTask.
+ * writeMutex keeps frames written by sendHandler, admin and shutdown from mixing.
+ * conn is changed when session is resumed, so it is taken by getConn.
+ */
+type member struct {
+	nickname   string
+	connMutex  sync.Mutex
+	conn       net.Conn
+	queue      *sendQueue
+	done       <-chan bool
+	writeMutex sync.Mutex
+	room       *room // current room, used by its serverTask only
+	flood      *floodGuard
+	lastRecv   int64     // unix nano of last message from user, atomic
+	timedOut   int32     // 1 when connection is closed by heartbeat, atomic
+	parked     int32     // 1 while connection is lost and session waits for resume, atomic
+	kicked     chan bool // closed when user is kicked, session can't be resumed then
+	kickOnce   sync.Once
+	token      string             // resume token of session
+	resume     chan resumeRequest // new connection of session, taken by its serverTask
+	seenIDs    map[string]bool    // ids of recent client messages, used by its serverTask only
+	seenOrder  []string
+}
 
-	for {
-		recvMsg := <-myRecvChan
+/**
+ * connection of resume request, and the number of messages client has received.
+ */
+type resumeRequest struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	received int64
+}
 
-		if strings.HasPrefix(recvMsg, CONN_KILL) { // connection kill by client's \exit or ctrl_c
-			mySendChan <- CONN_KILL
-
-			tmpCnt := atomic.AddInt32(&totalClientCount, -1)
-			delete(nicknameToSendChan, myNickname)
-			delete(nicknameToConn, myNickname)
-			sendMsg := DISCONN_MSG[0] + myNickname + DISCONN_MSG[1] +
-				fmt.Sprint(tmpCnt) + DISCONN_MSG[2]
-			fmt.Println(sendMsg)
-			for _, otherChan := range nicknameToSendChan {
-				otherChan <- SERVER_BROADCAST + sendMsg
-			}
-			break
-		} else if strings.HasPrefix(recvMsg, CLIENT_BROADCAST) { // broadcasting message from client
-			sendToEverybodyMsg := recvMsg[1:]
-			for otherNickname, otherChan := range nicknameToSendChan {
-				if otherNickname != myNickname {
-					otherChan <- CLIENT_BROADCAST + myNickname + " " + sendToEverybodyMsg
-				}
-			}
+func (m *member) getConn() net.Conn {
+	m.connMutex.Lock()
+	defer m.connMutex.Unlock()
+	return m.conn
+}
 
-			if strings.Contains(strings.ToLower(sendToEverybodyMsg), BADWORD_STR) { // bad word detection
-				mySendChan <- CONN_KILL + BADWORD_KILL
-
-				tmpCnt := atomic.AddInt32(&totalClientCount, -1)
-				delete(nicknameToSendChan, myNickname)
-				delete(nicknameToConn, myNickname)
-				sendServerMsg := FORCE_KILL_MSG[0] + myNickname + FORCE_KILL_MSG[1] +
-					fmt.Sprint(tmpCnt) + FORCE_KILL_MSG[2]
-				fmt.Println(sendServerMsg)
-				for _, otherChan := range nicknameToSendChan {
-					otherChan <- SERVER_BROADCAST + sendServerMsg
-				}
-				break
-			}
-		} else if strings.HasPrefix(recvMsg, DIRECT_MESSAGE) { // dm from client to another client
-			idx := 1
-			for ; idx < len(recvMsg); idx++ {
-				if recvMsg[idx] == ' ' {
-					break
-				}
-			}
+func (m *member) setConn(conn net.Conn) {
+	m.connMutex.Lock()
+	defer m.connMutex.Unlock()
+	m.conn = conn
+}
 
-			receiver, sendMsg := recvMsg[1:idx], recvMsg[idx+1:]
-			if _, exist := nicknameToSendChan[receiver]; exist == true {
-				nicknameToSendChan[receiver] <- DIRECT_MESSAGE + myNickname + " " + sendMsg
-			} else {
-				fmt.Println(INVALID_RECEIVER + receiver)
-			}
+/**
+ * disconnecting user with kill reason, and ending its session.
+ */
+func (m *member) kick(reason string) {
+	m.kickOnce.Do(func() { close(m.kicked) })
+	m.write(CONN_KILL + reason)
+	m.getConn().Close() // its recvHandler reports leaving to serverTask
+}
 
-			if strings.Contains(strings.ToLower(sendMsg), BADWORD_STR) { // bad word detection
-				mySendChan <- CONN_KILL + BADWORD_KILL
-
-				tmpCnt := atomic.AddInt32(&totalClientCount, -1)
-				delete(nicknameToSendChan, myNickname)
-				delete(nicknameToConn, myNickname)
-				sendMsg := FORCE_KILL_MSG[0] + myNickname + FORCE_KILL_MSG[1] +
-					fmt.Sprint(tmpCnt) + FORCE_KILL_MSG[2]
-				fmt.Println(sendMsg)
-				for _, otherChan := range nicknameToSendChan {
-					otherChan <- SERVER_BROADCAST + sendMsg
-				}
-				break
-			}
-		} else if strings.HasPrefix(recvMsg, GET_VERSION) { // \ver from client
-			mySendChan <- GET_VERSION + SERVER_VERSION
-		} else if strings.HasPrefix(recvMsg, USER_LIST) { // \list from client
-			sendMsg := USER_LIST
-			for name, otherConn := range nicknameToConn {
-				sendMsg += name + ": " + otherConn.RemoteAddr().String() + "\n"
+func (m *member) isKicked() bool {
+	select {
+	case <-m.kicked:
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+ * recording id of client message, and returns false when it is already handled.
+ * client sends unacknowledged messages again after resume(see resumeTask).
+ */
+func (m *member) firstSeen(id string) bool {
+	if m.seenIDs[id] {
+		return false
+	}
+	m.seenIDs[id] = true
+	m.seenOrder = append(m.seenOrder, id)
+	if len(m.seenOrder) > RESUME_LOG {
+		delete(m.seenIDs, m.seenOrder[0])
+		m.seenOrder = m.seenOrder[1:]
+	}
+	return true
+}
+
+/**
+ * sending last n broadcasts of current room to user.
+ * when always is false, nothing is sent for empty history.
+ */
+func sendHistory(m *member, n int, always bool) {
+	if entries := m.room.recent(n); len(entries) > 0 {
+		m.deliver(HISTORY + formatHistory(entries))
+	} else if always {
+		m.deliver(SERVER_BROADCAST + NO_HISTORY)
+	}
+}
+
+/**
+ * checks nickname policy, and returns reject reason or "" when it is allowed.
+ * NICK_MIN_LEN ~ NICK_MAX_LEN characters of letters, digits and NICK_EXTRA_CHARS,
+ * and not one of RESERVED_NICKS. letter or digit can have up to NICK_MAX_MARKS
+ * combining marks(e.g. vowel signs of Hindi and Thai). one name written in two ways
+ * is the same by nickKey.
+ */
+func checkNickname(nickname string) string {
+	if !utf8.ValidString(nickname) {
+		return REJECT_MSG_NICK_UTF8
+	}
+	length := utf8.RuneCountInString(nickname)
+	if length < NICK_MIN_LEN {
+		return REJECT_MSG_NICK_SHORT
+	} else if length > NICK_MAX_LEN {
+		return REJECT_MSG_NICK_LONG
+	}
+	marks := -1 // combining marks after last letter or digit, -1 when there is none
+	for _, c := range nickname {
+		if unicode.IsMark(c) {
+			if marks < 0 || marks >= NICK_MAX_MARKS {
+				return REJECT_MSG_NICK_MARK
 			}
-			mySendChan <- sendMsg
-		} else if strings.HasPrefix(recvMsg, GET_RTT) { // \rtt from client
-			mySendChan <- GET_RTT
+			marks++
+		} else if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			marks = 0
+		} else if strings.ContainsRune(NICK_EXTRA_CHARS, c) {
+			marks = -1
 		} else {
-			fmt.Println(INTERPRET_FAIL)
+			return REJECT_MSG_NICK_CHAR
+		}
+	}
+	for _, reserved := range RESERVED_NICKS {
+		if nickKey(nickname) == nickKey(reserved) {
+			return REJECT_MSG_NICK_RESERVE
 		}
 	}
+	return ""
 }
 
-func recvHandler(conn net.Conn, ch chan<- string) {
-	buffer := make([]byte, BUFFER_SIZE)
-	var err error
+/**
+ * key for nickname uniqueness, NFKC normalized and case folded(NFKC_Casefold like),
+ * e.g. "Alice", "ALICE" and "Ａｌｉｃｅ" have same key, and so do "é" written
+ * in one character and "e" with combining accent.
+ * folding can make unnormalized string, so it is normalized again.
+ */
+func nickKey(nickname string) string {
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(nickname)))
+}
 
-	for {
-		bufferLen := 0
-		for bufferLen == 0 {
-			bufferLen, err = conn.Read(buffer)
-			if err != nil {
-				return
-			}
-		}
+/**
+ * sending direct message, or queueing it when receiver is not connected.
+ * returns ack code for the sender, and receipt is sent when dm is written.
+ * checking connection and queueing are done under offlineMutex,
+ * so the dm is not missed by receiver joining at the same time(see takeDMs).
+ */
+func sendDM(from *member, id, receiver, msg string) string {
+	if checkNickname(receiver) != "" {
+		logInfo(INVALID_RECEIVER + receiver)
+		return REJ_NO_USER
+	}
+
+	offlineMutex.Lock()
+	other, online := allUsers.lookup(receiver)
+	if !online {
+		defer offlineMutex.Unlock()
+		return queueDM(receiver, queuedDM{time.Now(), id, from.nickname, msg})
+	}
+	offlineMutex.Unlock()
 
-		msg := string(buffer[0:bufferLen])
-		ch <- msg
-		time.Sleep(time.Millisecond * 10) // slow down, 'cause message are mixed up
+	if other.deliverWithReceipt(DIRECT_MESSAGE+from.nickname+" "+msg, dmReceipt(from.nickname, id, other.nickname)) {
+		return ACK_OK
+	}
+	offlineMutex.Lock() // receiver has left just now
+	defer offlineMutex.Unlock()
+	return queueDM(receiver, queuedDM{time.Now(), id, from.nickname, msg})
+}
 
-		if strings.HasPrefix(msg, CONN_KILL) {
-			break
+/**
+ * sending delivery receipt to sender, if it is connected.
+ */
+func dmReceipt(sender, id, receiver string) func() {
+	return func() {
+		if m, exist := allUsers.lookup(sender); exist {
+			m.deliver(RECEIPT + id + " " + receiver)
 		}
 	}
 }
 
-func sendHandler(conn net.Conn, ch <-chan string) {
-	for {
-		msg := <-ch // receive message from server thread
-		conn.Write([]byte(msg))
-		time.Sleep(time.Millisecond * 10) // slow down, 'cause message are mixed up
-
-		if strings.HasPrefix(msg, CONN_KILL) {
-			break
+/**
+ * receiver should be registered nickname, or nickname seen within OFFLINE_SEEN_AGE,
+ * so that dms are not queued for made-up nicknames.
+ * each sender can have OFFLINE_MAX_PER_SENDER dms in queue, so that one can't fill it.
+ * caller should hold offlineMutex.
+ */
+func queueDM(receiver string, dm queuedDM) string {
+	for key, dms := range offlineDMs { // dropping old ones first
+		for len(dms) > 0 && time.Since(dms[0].time) > OFFLINE_MAX_AGE {
+			unqueueDM(dms[0])
+			dms = dms[1:]
+		}
+		if len(dms) == 0 {
+			delete(offlineDMs, key)
+		} else {
+			offlineDMs[key] = dms
 		}
 	}
+
+	key := nickKey(receiver)
+	if seen, exist := seenNicks[key]; (!exist || time.Since(seen) > OFFLINE_SEEN_AGE) && !accounts.isRegistered(receiver) {
+		logInfo(UNKNOWN_RECEIVER + receiver)
+		return REJ_NO_USER
+	} else if offlineBySender[nickKey(dm.sender)] >= OFFLINE_MAX_PER_SENDER {
+		return REJ_SENDER_FULL
+	} else if len(offlineDMs[key]) >= OFFLINE_MAX_PER_USER || offlineCount >= OFFLINE_MAX_TOTAL {
+		return REJ_QUEUE_FULL
+	}
+	offlineDMs[key] = append(offlineDMs[key], dm)
+	offlineCount++
+	offlineBySender[nickKey(dm.sender)]++
+	logDebug("[dm from " + dm.sender + " to " + receiver + " is queued]")
+	return ACK_QUEUED
 }
 
-func initCtrlCHandler() {
-	ch := make(chan os.Signal)
-	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-ch
-		for _, conn := range nicknameToConn { // kill all client when server is died
-			conn.Write([]byte(CONN_KILL + SERVER_DOWN))
-			time.Sleep(time.Millisecond * 10) // slow down, 'cause message are mixed up
+/**
+ * counting dm out of offline queue. caller should hold offlineMutex.
+ */
+func unqueueDM(dm queuedDM) {
+	offlineCount--
+	key := nickKey(dm.sender)
+	if offlineBySender[key]--; offlineBySender[key] <= 0 {
+		delete(offlineBySender, key)
+	}
+}
+
+/**
+ * recording that user has joined or left now, so it can get offline dms.
+ */
+func markSeen(nickname string) {
+	offlineMutex.Lock()
+	defer offlineMutex.Unlock()
+	seeNick(nickKey(nickname))
+}
+
+/**
+ * recording nickKey in seenNicks. when it is full, nicknames seen before OFFLINE_SEEN_AGE
+ * are dropped, and then least recently seen one if still full.
+ * caller should hold offlineMutex.
+ */
+func seeNick(key string) {
+	if _, exist := seenNicks[key]; !exist && len(seenNicks) >= OFFLINE_MAX_SEEN {
+		oldest := ""
+		for nick, seen := range seenNicks {
+			if time.Since(seen) > OFFLINE_SEEN_AGE {
+				delete(seenNicks, nick)
+			} else if oldest == "" || seen.Before(seenNicks[oldest]) {
+				oldest = nick
+			}
 		}
-		for _, conn := range nicknameToConn {
-			conn.Close()
+		if len(seenNicks) >= OFFLINE_MAX_SEEN {
+			delete(seenNicks, oldest)
 		}
-		fmt.Println(EXIT_MSG)
-		os.Exit(0)
-	}()
+	}
+	seenNicks[key] = time.Now()
+}
+
+/**
+ * taking out dms queued for user, not older than OFFLINE_MAX_AGE.
+ * should be called after user is in allUsers. user is marked as seen too.
+ */
+func takeDMs(nickname string) []queuedDM {
+	offlineMutex.Lock()
+	defer offlineMutex.Unlock()
+
+	key := nickKey(nickname)
+	seeNick(key)
+	dms := offlineDMs[key]
+	delete(offlineDMs, key)
+	for _, dm := range dms {
+		unqueueDM(dm)
+	}
+	for len(dms) > 0 && time.Since(dms[0].time) > OFFLINE_MAX_AGE {
+		dms = dms[1:]
+	}
+	return dms
+}
+
+func queuedDMCount() int {
+	offlineMutex.Lock()
+	defer offlineMutex.Unlock()
+	return offlineCount
+}
+
+/**
+ * moves user from current room to named room, and tells both rooms.
+ * returns result message for the user, and whether user has moved.
+ */
+func moveRoom(m *member, name string) (string, bool) {
+	if len(name) == 0 || len(name) > MAX_ROOM_NAME || strings.ContainsAny(name, " \t\r\n") {
+		return INVALID_ROOM_NAME, false
+	} else if m.room.name == name {
+		return ALREADY_IN_ROOM, false
+	}
+
+	r, tmpCnt, reject := joinRoom(name, m)
+	if reject != "" {
+		return "[room " + name + " is full]", false
+	}
+	prev := m.room
+	m.room = r
+	prevCnt := partRoom(prev, m.nickname)
+	prev.broadcast(SERVER_BROADCAST+ROOM_PART_MSG[0]+m.nickname+ROOM_PART_MSG[1]+prev.name+
+		ROOM_PART_MSG[2]+fmt.Sprint(prevCnt)+ROOM_PART_MSG[3], "")
+	r.broadcast(SERVER_BROADCAST+ROOM_JOIN_MSG[0]+m.nickname+ROOM_JOIN_MSG[1]+name+
+		ROOM_JOIN_MSG[2]+fmt.Sprint(tmpCnt)+ROOM_JOIN_MSG[3], m.nickname)
+	logDebug("[" + m.nickname + " moved from " + prev.name + " to " + name + "]")
+
+	result := fmt.Sprintf("[you joined room %s. There are %d users in the room]", name, tmpCnt)
+	if topic := r.getTopic(); topic != "" {
+		result += "\n[topic: " + topic + "]"
+	}
+	return result, true
+}
+
+/**
+ * sends msg to member. returns false when member has already left.
+ */
+func (m *member) deliver(msg string) bool {
+	return m.deliverWithReceipt(msg, nil)
+}
+
+/**
+ * sends msg to member, and written is called after msg is written to its connection.
+ * it doesn't wait for slow member. when its queue is full, oldest droppable message is dropped
+ * with SLOW_DROP, and with SLOW_KICK queue is replaced by kill that closes connection.
+ * other messages are not dropped, and they can fill queue up to twice of sendQueueSize
+ * before user is disconnected with SLOW_DROP too.
+ */
+func (m *member) deliverWithReceipt(msg string, written func()) bool {
+	select {
+	case <-m.done:
+		return false
+	default:
+	}
+
+	q := m.queue
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	parked := atomic.LoadInt32(&m.parked) == 1 // parked one is waited
+	if q.killed {
+		return false
+	} else if len(q.items) >= sendQueueSize && slowPolicy == SLOW_KICK && !parked {
+		m.killSlow()
+		return false
+	} else if len(q.items) >= sendQueueSize && !q.dropOldest() {
+		if isDroppable(msg) { // newest one is dropped instead
+			q.dropped++
+			atomic.AddInt64(&dropped, 1)
+			return true
+		} else if len(q.items) >= 2*sendQueueSize && !parked {
+			m.killSlow()
+			return false
+		}
+	}
+	q.items = append(q.items, outbound{msg, written})
+	q.signal()
+	return true
+}
+
+/**
+ * replacing queue with kill that closes connection. queue mutex should be held.
+ */
+func (m *member) killSlow() {
+	q := m.queue
+	q.dropped += len(q.items) + 1
+	atomic.AddInt64(&dropped, int64(len(q.items)+1))
+	atomic.AddInt64(&slowKicks, 1)
+	q.items = []outbound{{CONN_KILL + SLOW_KILL, func() { m.getConn().Close() }}} // recvHandler reports leaving to serverTask
+	m.kickOnce.Do(func() { close(m.kicked) })
+	q.killed = true
+	q.signal()
+	logInfo("[" + m.nickname + " is disconnected for slow connection]")
+}
+
+/**
+ * broadcasts, notices and history can be dropped for slow user.
+ * control, ack, receipt, dm and file frames are not, since losing them breaks client's state.
+ */
+func isDroppable(msg string) bool {
+	return strings.HasPrefix(msg, CLIENT_BROADCAST) || strings.HasPrefix(msg, SERVER_BROADCAST) ||
+		strings.HasPrefix(msg, HISTORY)
+}
+
+/**
+ * writes one framed message to member's connection, failing after writeTimeout.
+ */
+func (m *member) write(msg string) error {
+	m.writeMutex.Lock()
+	defer m.writeMutex.Unlock()
+	conn := m.getConn()
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writeFrame(conn, msg)
+}
+
+/**
+ * direct message waiting for its receiver to join.
+ */
+type queuedDM struct {
+	time   time.Time
+	id     string
+	sender string
+	msg    string
+}
+
+/**
+ * one moderation rule. word rule is also compiled to case-insensitive pattern.
+ */
+type filterRule struct {
+	action  int
+	pattern *regexp.Regexp
+}
+
+/**
+ * moderation filter with per-user state. rules and settings are replaced by
+ * loadFilter, while strikes, mutes and kicks are kept. keys are nickKey,
+ * and kicked addresses are stored as "ip:"[address].
+ */
+type moderator struct {
+	mutex      sync.Mutex
+	rules      []filterRule
+	maxStrikes int
+	muteTime   time.Duration
+	cooldown   time.Duration
+	strikes    map[string]int
+	mutedUntil map[string]time.Time
+	kickedTill map[string]time.Time
+}
+
+func newModerator() *moderator {
+	return &moderator{
+		rules:      []filterRule{{ACTION_KICK, regexp.MustCompile("(?i)" + regexp.QuoteMeta(BADWORD_STR))}},
+		maxStrikes: FILTER_STRIKES, muteTime: FILTER_MUTE, cooldown: FILTER_COOLDOWN,
+		strikes:    make(map[string]int),
+		mutedUntil: make(map[string]time.Time),
+		kickedTill: make(map[string]time.Time),
+	}
+}
+
+/**
+ * reading filter file. one rule or setting per line, '#' starts comment.
+ *   [action] word [words]      case-insensitive words, e.g. "kick word i hate professor"
+ *   [action] regex [pattern]   Go regular expression, e.g. "mask regex (?i)\bdumb\w*"
+ *   strikes [n]                warned, muted or kicked messages before user is kicked
+ *   mute [seconds]             how long mute action lasts
+ *   cooldown [seconds]         how long kicked user can't connect again
+ * [action] is mask(replaced with '*'), warn(not delivered), mute(not delivered,
+ * and user can't talk for a while) or kick. most severe one of matched rules is done.
+ * on any error, current rules are kept.
+ */
+func (f *moderator) loadFilter(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	rules := []filterRule{}
+	maxStrikes, muteTime, cooldown := FILTER_STRIKES, FILTER_MUTE, FILTER_COOLDOWN
+	for num, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		lineErr := fmt.Errorf("%s:%d: wrong rule", path, num+1)
+
+		if len(fields) == 2 { // setting
+			value, err := strconv.Atoi(fields[1])
+			if err != nil || value < 0 {
+				return lineErr
+			}
+			switch fields[0] {
+			case "strikes":
+				maxStrikes = value
+			case "mute":
+				muteTime = time.Duration(value) * time.Second
+			case "cooldown":
+				cooldown = time.Duration(value) * time.Second
+			default:
+				return lineErr
+			}
+			continue
+		}
+
+		action := ACTION_NONE
+		for i, name := range ACTION_NAMES {
+			if len(fields) == 3 && fields[0] == name {
+				action = i
+			}
+		}
+		if action == ACTION_NONE {
+			return lineErr
+		}
+		var pattern *regexp.Regexp
+		if fields[1] == "word" {
+			pattern, err = regexp.Compile("(?i)" + regexp.QuoteMeta(strings.TrimSpace(fields[2])))
+		} else if fields[1] == "regex" {
+			pattern, err = regexp.Compile(fields[2])
+		} else {
+			return lineErr
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, num+1, err)
+		}
+		rules = append(rules, filterRule{action, pattern})
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rules, f.maxStrikes, f.muteTime, f.cooldown = rules, maxStrikes, muteTime, cooldown
+	return nil
+}
+
+/**
+ * checking message of user before delivery.
+ * returns action to do, and message to deliver(masked) when action is under ACTION_WARN.
+ * warn, mute and kick give a strike, and user reaching maxStrikes is kicked.
+ * message of muted user is ACTION_MUTE without new strike.
+ */
+func (f *moderator) check(nickname, msg string) (int, string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := nickKey(nickname)
+	if time.Now().Before(f.mutedUntil[key]) {
+		return ACTION_MUTE, msg
+	}
+
+	action := ACTION_NONE
+	for _, rule := range f.rules {
+		if !rule.pattern.MatchString(msg) {
+			continue
+		}
+		if rule.action > action {
+			action = rule.action
+		}
+		if rule.action == ACTION_MASK {
+			msg = rule.pattern.ReplaceAllStringFunc(msg, func(word string) string {
+				return strings.Repeat("*", utf8.RuneCountInString(word))
+			})
+		}
+	}
+	if action < ACTION_WARN {
+		return action, msg
+	}
+
+	f.strikes[key]++
+	if f.maxStrikes > 0 && f.strikes[key] >= f.maxStrikes {
+		action = ACTION_KICK
+	}
+	if action == ACTION_MUTE {
+		f.mutedUntil[key] = time.Now().Add(f.muteTime)
+	}
+	return action, msg
+}
+
+/**
+ * remaining mute time of user.
+ */
+func (f *moderator) mutedFor(nickname string) time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return time.Until(f.mutedUntil[nickKey(nickname)])
+}
+
+func (f *moderator) strikeCount(nickname string) (int, int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.strikes[nickKey(nickname)], f.maxStrikes
+}
+
+/**
+ * recording kick of user. both nickname and address wait for cooldown,
+ * and strikes start again after it.
+ */
+func (f *moderator) kicked(nickname, ip string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := nickKey(nickname)
+	delete(f.strikes, key)
+	delete(f.mutedUntil, key)
+	f.kickedTill[key] = time.Now().Add(f.cooldown)
+	f.kickedTill["ip:"+ip] = time.Now().Add(f.cooldown)
+}
+
+/**
+ * muting user by operator, for d from now.
+ */
+func (f *moderator) mute(nickname string, d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.mutedUntil[nickKey(nickname)] = time.Now().Add(d)
+}
+
+/**
+ * ending mute of user, returns false when user is not muted.
+ */
+func (f *moderator) unmute(nickname string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	key := nickKey(nickname)
+	muted := time.Now().Before(f.mutedUntil[key])
+	delete(f.mutedUntil, key)
+	return muted
+}
+
+/**
+ * remaining cooldown of nickname or address, the longer one.
+ * expired records are removed here.
+ */
+func (f *moderator) cooldownFor(nickname, ip string) time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for key, till := range f.kickedTill {
+		if time.Now().After(till) {
+			delete(f.kickedTill, key)
+		}
+	}
+	return max(time.Until(f.kickedTill[nickKey(nickname)]), time.Until(f.kickedTill["ip:"+ip]))
+}
+
+func (f *moderator) ruleCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.rules)
+}
+
+/**
+ * filtering message of user, and telling user when it is not delivered.
+ * returns action, and message to deliver.
+ */
+func moderate(m *member, msg string) (int, string) {
+	action, msg := chatFilter.check(m.nickname, msg)
+	switch action {
+	case ACTION_WARN:
+		strikes, maxStrikes := chatFilter.strikeCount(m.nickname)
+		m.deliver(SERVER_BROADCAST + fmt.Sprintf("[your message is blocked. strike %d of %d]", strikes, maxStrikes))
+	case ACTION_MUTE:
+		m.deliver(SERVER_BROADCAST + fmt.Sprintf("[you are muted for %d seconds]", int(chatFilter.mutedFor(m.nickname).Seconds()+0.5)))
+	case ACTION_KICK:
+		ip, _, _ := net.SplitHostPort(m.getConn().RemoteAddr().String())
+		chatFilter.kicked(m.nickname, ip)
+		logInfo("[" + m.nickname + " is kicked by filter]")
+	}
+	return action, msg
+}
+
+/**
+ * rate of one kind of message, rate per second with burst. rate 0 is unlimited.
+ * given as "[rate]:[burst]" in flag, e.g. "2:10".
+ */
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+func (l *rateLimit) String() string {
+	return strconv.FormatFloat(l.rate, 'f', -1, 64) + ":" + strconv.FormatFloat(l.burst, 'f', -1, 64)
+}
+
+func (l *rateLimit) Set(value string) error {
+	rate, burst, _ := strings.Cut(value, ":")
+	r, err1 := strconv.ParseFloat(rate, 64)
+	b, err2 := strconv.ParseFloat(burst, 64)
+	if err1 != nil || err2 != nil || r < 0 || b < 1 {
+		return errors.New("should be [rate per second]:[burst], e.g. 2:10")
+	}
+	l.rate, l.burst = r, b
+	return nil
+}
+
+/**
+ * token bucket, filled by rate of limit up to its burst.
+ */
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(limit rateLimit, now time.Time) bool {
+	if limit.rate <= 0 {
+		return true
+	}
+	b.tokens = min(limit.burst, b.tokens+now.Sub(b.last).Seconds()*limit.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+/**
+ * flood state of one user, token bucket for each of LIMIT_NAMES.
+ * every message over limit is a warning, floodWarnings warnings are a mute,
+ * and user is kicked on mute after floodMutes ones.
+ * warnings and mutes are forgotten after FLOOD_FORGIVE without message over limit.
+ */
+type floodGuard struct {
+	mutex     sync.Mutex
+	buckets   []tokenBucket
+	warnings  int
+	mutes     int
+	limited   int // messages over limit in total
+	lastLimit time.Time
+}
+
+func newFloodGuard() *floodGuard {
+	g := &floodGuard{buckets: make([]tokenBucket, len(limits))}
+	for i := range g.buckets {
+		g.buckets[i] = tokenBucket{limits[i].burst, time.Now()}
+	}
+	return g
+}
+
+/**
+ * taking token for message of kind. returns ACTION_NONE, ACTION_WARN, ACTION_MUTE or
+ * ACTION_KICK, with warning count.
+ */
+func (g *floodGuard) check(kind int) (int, int) {
+	return g.checkAt(kind, time.Now())
+}
+
+func (g *floodGuard) checkAt(kind int, now time.Time) (int, int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.buckets[kind].take(limits[kind], now) {
+		return ACTION_NONE, 0
+	}
+	g.limited++
+	if now.Sub(g.lastLimit) > FLOOD_FORGIVE {
+		g.warnings, g.mutes = 0, 0
+	}
+	g.lastLimit = now
+
+	if g.warnings++; g.warnings < floodWarnings {
+		return ACTION_WARN, g.warnings
+	}
+	g.warnings = 0
+	if g.mutes++; g.mutes > floodMutes {
+		return ACTION_KICK, 0
+	}
+	return ACTION_MUTE, 0
+}
+
+/**
+ * "msg=[tokens] dm=[tokens] cmd=[tokens] file=[tokens] limited=[n] warnings=[n] mutes=[n]" for admin.
+ */
+func (g *floodGuard) String() string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var sb strings.Builder
+	for i, name := range LIMIT_NAMES {
+		fmt.Fprintf(&sb, "%s=%.1f ", name, min(limits[i].burst, g.buckets[i].tokens+time.Since(g.buckets[i].last).Seconds()*limits[i].rate))
+	}
+	fmt.Fprintf(&sb, "limited=%d warnings=%d mutes=%d", g.limited, g.warnings, g.mutes)
+	return sb.String()
+}
+
+/**
+ * kind of client message for rate limit.
+ */
+func limitKind(msg string) int {
+	if strings.HasPrefix(msg, CLIENT_BROADCAST) {
+		return LIMIT_MSG
+	} else if strings.HasPrefix(msg, DIRECT_MESSAGE) {
+		return LIMIT_DM
+	} else if strings.HasPrefix(msg, FILE_CHUNK) || strings.HasPrefix(msg, FILE_REPLY) {
+		return LIMIT_FILE
+	}
+	return LIMIT_CMD
+}
+
+/**
+ * checking rate of user's message, and telling user when it is over limit.
+ * returns action, message is not handled unless it is ACTION_NONE.
+ */
+func limitFlood(m *member, msg string) int {
+	action, warnings := m.flood.check(limitKind(msg))
+	switch action {
+	case ACTION_WARN:
+		m.deliver(SERVER_BROADCAST + fmt.Sprintf("[you are sending too fast. warning %d of %d]", warnings, floodWarnings))
+	case ACTION_MUTE:
+		chatFilter.mute(m.nickname, floodMute)
+		m.deliver(SERVER_BROADCAST + "[you are muted for " + floodMute.String() + " for flooding]")
+		logInfo("[" + m.nickname + " is muted for flooding]")
+	case ACTION_KICK:
+		logInfo("[" + m.nickname + " is kicked for flooding]")
+	}
+	return action
+}
+
+/**
+ * rate limits, send queues and their state of every user, for admin.
+ */
+func userStatus() string {
+	var sb strings.Builder
+	sb.WriteString("rate limits:")
+	for i, name := range LIMIT_NAMES {
+		sb.WriteString(" " + name + "=" + limits[i].String())
+	}
+	fmt.Fprintf(&sb, ", warnings = %d, mutes = %d, mute = %s\n", floodWarnings, floodMutes, floodMute)
+	fmt.Fprintf(&sb, "send queue = %d, slow policy = %s, write timeout = %s, dropped = %d, slow kicks = %d\n",
+		sendQueueSize, slowPolicy, writeTimeout, atomic.LoadInt64(&dropped), atomic.LoadInt64(&slowKicks))
+	for _, m := range allUsers.snapshot() {
+		sb.WriteString(m.nickname + ": " + m.flood.String() + " " + m.queue.String() + "\n")
+	}
+	return sb.String()
+}
+
+/**
+ * registered nickname. hash is HASH_NAME of password with salt,
+ * iterations are kept per account so that HASH_ITERATIONS can be raised later.
+ */
+type account struct {
+	nickname   string
+	iterations int
+	salt       []byte
+	hash       []byte
+}
+
+/**
+ * registered nicknames, keyed by nickKey, stored in file of path.
+ * file has one "[nickname] [hash name] [iterations] [hex salt] [hex hash]" per line,
+ * and it is rewritten on every registration. registration is disabled when path is "".
+ */
+type accountBook struct {
+	mutex    sync.Mutex
+	path     string
+	accounts map[string]account
+}
+
+/**
+ * reading account file of path. file not existing yet is same as empty one.
+ */
+func loadAccounts(path string) (*accountBook, error) {
+	b := &accountBook{path: path, accounts: make(map[string]account)}
+	if path == "" {
+		return b, nil
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for num, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		lineErr := fmt.Errorf("%s:%d: wrong account", path, num+1)
+		if len(fields) != 5 || fields[1] != HASH_NAME {
+			return nil, lineErr
+		}
+		iterations, err1 := strconv.Atoi(fields[2])
+		salt, err2 := hex.DecodeString(fields[3])
+		hash, err3 := hex.DecodeString(fields[4])
+		if err1 != nil || err2 != nil || err3 != nil || iterations < 1 || len(hash) == 0 {
+			return nil, lineErr
+		}
+		b.accounts[nickKey(fields[0])] = account{fields[0], iterations, salt, hash}
+	}
+	return b, nil
+}
+
+func (b *accountBook) isRegistered(nickname string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, exist := b.accounts[nickKey(nickname)]
+	return exist
+}
+
+func (b *accountBook) count() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.accounts)
+}
+
+/**
+ * checking password of registered nickname.
+ * hash is computed without mutex, because it is slow on purpose.
+ * returns errHashBusy when password can't be checked now(see hashPassword).
+ */
+func (b *accountBook) verify(nickname, password string) (bool, error) {
+	b.mutex.Lock()
+	a, exist := b.accounts[nickKey(nickname)]
+	b.mutex.Unlock()
+	if !exist {
+		return false, nil
+	}
+	hash, err := hashPassword(password, a.salt, a.iterations, len(a.hash))
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal(hash, a.hash), nil
+}
+
+/**
+ * pbkdf2 hash of password. at most HASH_MAX_CONCURRENT hashes are computed at once,
+ * so that logins can't take every cpu. when no slot is free for HASH_WAIT, errHashBusy is returned.
+ */
+func hashPassword(password string, salt []byte, iterations, size int) ([]byte, error) {
+	timer := time.NewTimer(HASH_WAIT)
+	defer timer.Stop()
+	select {
+	case hashSlots <- true:
+	case <-timer.C:
+		return nil, errHashBusy
+	}
+	defer func() { <-hashSlots }()
+	return pbkdf2.Key(sha256.New, password, salt, iterations, size)
+}
+
+/**
+ * registering nickname with password, and saving account file.
+ */
+func (b *accountBook) register(nickname, password string) error {
+	if b.path == "" {
+		return errors.New("registration is disabled")
+	} else if len(password) < PASSWORD_MIN_LEN || len(password) > PASSWORD_MAX_LEN {
+		return fmt.Errorf("password should be %d ~ %d bytes", PASSWORD_MIN_LEN, PASSWORD_MAX_LEN)
+	} else if b.isRegistered(nickname) { // checked again below, this is just to skip slow hash
+		return errors.New("nickname is already registered")
+	}
+
+	salt := make([]byte, HASH_SALT_SIZE)
+	rand.Read(salt)
+	hash, err := hashPassword(password, salt, HASH_ITERATIONS, HASH_SIZE)
+	if err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := nickKey(nickname)
+	if _, exist := b.accounts[key]; exist {
+		return errors.New("nickname is already registered")
+	}
+	b.accounts[key] = account{nickname, HASH_ITERATIONS, salt, hash}
+	if err := b.save(); err != nil {
+		delete(b.accounts, key)
+		logInfo("cannot save accounts:", err)
+		return errors.New("cannot save account")
+	}
+	return nil
+}
+
+/**
+ * writing every account to temporary file, and replacing account file with it,
+ * so that file is not left half written. mutex should be held.
+ */
+func (b *accountBook) save() error {
+	keys := make([]string, 0, len(b.accounts))
+	for key := range b.accounts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var content strings.Builder
+	for _, key := range keys {
+		a := b.accounts[key]
+		fmt.Fprintf(&content, "%s %s %d %s %s\n", a.nickname, HASH_NAME, a.iterations,
+			hex.EncodeToString(a.salt), hex.EncodeToString(a.hash))
+	}
+	tmpPath := b.path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(content.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, b.path)
+}
+
+/**
+ * checking connection request before user joins.
+ * password is used when withPassword is true, and registering is checked by register later.
+ * password of nickname or address failing too often is not checked for a while(see loginGuard).
+ * returns reject reason or "".
+ */
+func authenticate(nickname, ip, password string, withPassword, registering bool) string {
+	registered := accounts.isRegistered(nickname)
+	if registering {
+		if registered {
+			return REJECT_MSG_REGISTER + "nickname is already registered"
+		} else if !withPassword {
+			return INTERPRET_FAIL
+		}
+	} else if withPassword {
+		if !registered {
+			return REJECT_MSG_NOT_OWNED
+		} else if wait := logins.waitFor(nickname, ip); wait > 0 {
+			return REJECT_MSG_LOGIN_WAIT + wait.Round(time.Second).String()
+		}
+		ok, err := accounts.verify(nickname, password)
+		if err != nil {
+			logInfo("[login of " + nickname + " is not checked: " + err.Error() + "]")
+			return REJECT_MSG_BUSY
+		} else if !ok {
+			logins.failed(nickname, ip)
+			logInfo("[login of " + nickname + " from " + ip + " failed]")
+			return REJECT_MSG_LOGIN_FAIL
+		}
+		logins.succeeded(nickname)
+	} else if registered {
+		return REJECT_MSG_NICK_OWNED
+	} else if !allowGuests {
+		return REJECT_MSG_GUESTS_OFF
+	}
+	return ""
+}
+
+/**
+ * failed logins, keyed by "nick:"[nickKey] and "ip:"[address].
+ * after LOGIN_FREE_FAILS failures, next login should wait for LOGIN_BACKOFF,
+ * doubled on each failure up to LOGIN_BACKOFF_MAX, so that passwords can't be guessed fast
+ * from one address, or for one nickname from many addresses.
+ */
+type loginGuard struct {
+	mutex sync.Mutex
+	fails map[string]loginFails
+}
+
+type loginFails struct {
+	count int
+	last  time.Time
+}
+
+func newLoginGuard() *loginGuard {
+	return &loginGuard{fails: make(map[string]loginFails)}
+}
+
+func loginKeys(nickname, ip string) []string {
+	return []string{"nick:" + nickKey(nickname), "ip:" + ip}
+}
+
+/**
+ * time to wait before password of nickname from ip is checked, 0 when it can be now.
+ */
+func (g *loginGuard) waitFor(nickname, ip string) time.Duration {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var wait time.Duration
+	for _, key := range loginKeys(nickname, ip) {
+		if f, exist := g.fails[key]; exist && f.count >= LOGIN_FREE_FAILS {
+			backoff := LOGIN_BACKOFF_MAX
+			if shift := f.count - LOGIN_FREE_FAILS; shift < 32 {
+				backoff = min(LOGIN_BACKOFF<<shift, LOGIN_BACKOFF_MAX)
+			}
+			wait = max(wait, time.Until(f.last.Add(backoff)))
+		}
+	}
+	return wait
+}
+
+/**
+ * recording failed login. failures older than LOGIN_FAIL_RESET are dropped here.
+ */
+func (g *loginGuard) failed(nickname, ip string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for key, f := range g.fails {
+		if time.Since(f.last) > LOGIN_FAIL_RESET {
+			delete(g.fails, key)
+		}
+	}
+	for _, key := range loginKeys(nickname, ip) {
+		g.fails[key] = loginFails{g.fails[key].count + 1, time.Now()}
+	}
+}
+
+/**
+ * forgetting failures of nickname. those of address are kept,
+ * so that logging into own account doesn't let others be guessed.
+ */
+func (g *loginGuard) succeeded(nickname string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.fails, "nick:"+nickKey(nickname))
+}
+
+/**
+ * ban of nickname or address. zero until is permanent.
+ */
+type ban struct {
+	until  time.Time
+	reason string
+}
+
+/**
+ * bans by operators, keyed by banKey, stored in file of path.
+ * file has one "[key] [until unix seconds, 0 for permanent] [quoted reason]" per line,
+ * and it is rewritten on every change. bans are not persisted when path is "".
+ */
+type banList struct {
+	mutex sync.Mutex
+	path  string
+	bans  map[string]ban
+}
+
+/**
+ * key of ban target, "ip:"[address] for address and "nick:"[nickKey] for nickname.
+ */
+func banKey(target string) string {
+	if ip := net.ParseIP(target); ip != nil {
+		return "ip:" + ip.String()
+	}
+	return "nick:" + nickKey(target)
+}
+
+/**
+ * reading ban file of path. file not existing yet is same as empty one.
+ */
+func loadBans(path string) (*banList, error) {
+	b := &banList{path: path, bans: make(map[string]ban)}
+	if path == "" {
+		return b, nil
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for num, line := range strings.Split(string(content), "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		lineErr := fmt.Errorf("%s:%d: wrong ban", path, num+1)
+		if len(fields) != 3 {
+			return nil, lineErr
+		}
+		sec, err1 := strconv.ParseInt(fields[1], 10, 64)
+		reason, err2 := strconv.Unquote(fields[2])
+		if err1 != nil || err2 != nil {
+			return nil, lineErr
+		}
+		var until time.Time
+		if sec != 0 {
+			until = time.Unix(sec, 0)
+		}
+		if nickname, isNick := strings.CutPrefix(fields[0], "nick:"); isNick {
+			fields[0] = "nick:" + nickKey(nickname) // may be written by older nickKey
+		}
+		b.bans[fields[0]] = ban{until, reason}
+	}
+	return b, nil
+}
+
+/**
+ * finding ban of nickname or address. expired bans are removed here.
+ */
+func (b *banList) check(nickname, ip string) (ban, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for key, entry := range b.bans {
+		if !entry.until.IsZero() && time.Now().After(entry.until) {
+			delete(b.bans, key)
+		}
+	}
+	if entry, exist := b.bans[banKey(nickname)]; exist {
+		return entry, true
+	}
+	entry, exist := b.bans[banKey(ip)]
+	return entry, exist
+}
+
+func (b *banList) add(target string, until time.Time, reason string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.bans[banKey(target)] = ban{until, reason}
+	return b.save()
+}
+
+/**
+ * removing ban of target, returns false when there is no such ban.
+ */
+func (b *banList) remove(target string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, exist := b.bans[banKey(target)]; !exist {
+		return false, nil
+	}
+	delete(b.bans, banKey(target))
+	return true, b.save()
+}
+
+func (b *banList) count() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.bans)
+}
+
+/**
+ * writing every ban to temporary file, and replacing ban file with it. mutex should be held.
+ */
+func (b *banList) save() error {
+	if b.path == "" {
+		return nil
+	}
+	keys := make([]string, 0, len(b.bans))
+	for key := range b.bans {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var content strings.Builder
+	for _, key := range keys {
+		var sec int64
+		if !b.bans[key].until.IsZero() {
+			sec = b.bans[key].until.Unix()
+		}
+		fmt.Fprintf(&content, "%s %d %s\n", key, sec, strconv.Quote(b.bans[key].reason))
+	}
+	tmpPath := b.path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(content.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, b.path)
+}
+
+/**
+ * reject reason for banned user.
+ */
+func banReject(entry ban) string {
+	reject := REJECT_MSG_BANNED
+	if !entry.until.IsZero() {
+		reject += " until " + entry.until.Format("2006-01-02 15:04:05")
+	}
+	if entry.reason != "" {
+		reject += " (" + entry.reason + ")"
+	}
+	return reject + ". cannot connect"
+}
+
+/**
+ * granting or taking operator role. role works only for registered nickname,
+ * so that guest can't take it.
+ */
+func setOperator(nickname string, op bool) {
+	opsMutex.Lock()
+	defer opsMutex.Unlock()
+	if op {
+		operators[nickKey(nickname)] = nickname
+	} else {
+		delete(operators, nickKey(nickname))
+	}
+}
+
+func isOperator(nickname string) bool {
+	opsMutex.Lock()
+	_, op := operators[nickKey(nickname)]
+	opsMutex.Unlock()
+	return op && accounts.isRegistered(nickname)
+}
+
+/**
+ * "[nickname] [nickname] ..." of operators, sorted.
+ */
+func operatorList() string {
+	opsMutex.Lock()
+	defer opsMutex.Unlock()
+	names := make([]string, 0, len(operators))
+	for _, nickname := range operators {
+		names = append(names, nickname)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+/**
+ * disconnecting user with kill reason. returns false when there is no such user.
+ */
+func kickUser(nickname, reason string) bool {
+	user, exist := allUsers.lookup(nickname)
+	if !exist {
+		return false
+	}
+	user.kick(reason)
+	return true
+}
+
+/**
+ * parsing duration of ban and mute, e.g. "90s", "10m", "2h". "perm" is permanent(zero).
+ */
+func parseDuration(arg string, permAllowed bool) (time.Duration, bool) {
+	if arg == "perm" {
+		return 0, permAllowed
+	}
+	d, err := time.ParseDuration(arg)
+	return d, err == nil && d > 0
+}
+
+/**
+ * operator commands, sent as "J"[command]:
+ * kick [nickname] [reason]
+ * ban [nickname or ip] [duration or perm] [reason]   connected users of it are kicked
+ * unban [nickname or ip]
+ * mute [nickname] [duration]
+ * unmute [nickname]
+ * operators can't be target. every action is told to all users with SERVER_BROADCAST,
+ * and returned string is for operator, "" when notice is broadcast.
+ */
+func handleOperator(op *member, data string) string {
+	if !isOperator(op.nickname) {
+		return NOT_OPERATOR
+	}
+	args := strings.Fields(data)
+	if len(args) < 2 {
+		return OPERATOR_USAGE
+	} else if isOperator(args[1]) {
+		return "[operator can't be target]"
+	}
+	target, by := args[1], " by "+op.nickname
+
+	var notice, result string // result is told to operator only
+	switch args[0] {
+	case "kick":
+		reason := strings.Join(args[2:], " ")
+		if !kickUser(target, withReason("[you are kicked"+by, reason)+"]") {
+			return NO_SUCH_USER
+		}
+		notice = withReason("["+target+" is kicked"+by, reason) + "]"
+	case "ban":
+		d, ok := time.Duration(0), len(args) >= 3
+		if ok {
+			d, ok = parseDuration(args[2], true)
+		}
+		if !ok {
+			return OPERATOR_USAGE
+		}
+		var until time.Time
+		if d > 0 {
+			until = time.Now().Add(d)
+		}
+		reason := strings.Join(args[3:], " ")
+		if err := bans.add(target, until, reason); err != nil { // ban is in effect anyway
+			logInfo("cannot save bans:", err)
+			result = BAN_NOT_SAVED
+		}
+		for _, m := range allUsers.snapshot() { // target may be nickname or address of users
+			ip, _, _ := net.SplitHostPort(m.getConn().RemoteAddr().String())
+			if (banKey(m.nickname) == banKey(target) || banKey(ip) == banKey(target)) && !isOperator(m.nickname) {
+				kickUser(m.nickname, withReason("[you are banned"+by, reason)+"]")
+			}
+		}
+		if d > 0 {
+			notice = withReason("["+target+" is banned for "+d.String()+by, reason) + "]"
+		} else {
+			notice = withReason("["+target+" is banned"+by, reason) + "]"
+		}
+	case "unban":
+		if removed, err := bans.remove(target); !removed {
+			return "[" + target + " is not banned]"
+		} else if err != nil {
+			logInfo("cannot save bans:", err)
+			result = BAN_NOT_SAVED
+		}
+		notice = "[" + target + " is unbanned" + by + "]"
+	case "mute":
+		d, ok := time.Duration(0), len(args) == 3
+		if ok {
+			d, ok = parseDuration(args[2], false)
+		}
+		if !ok {
+			return OPERATOR_USAGE
+		}
+		chatFilter.mute(target, d)
+		notice = "[" + target + " is muted for " + d.String() + by + "]"
+	case "unmute":
+		if !chatFilter.unmute(target) {
+			return "[" + target + " is not muted]"
+		}
+		notice = "[" + target + " is unmuted" + by + "]"
+	default:
+		return OPERATOR_USAGE
+	}
+	logInfo(notice)
+	allUsers.broadcast(SERVER_BROADCAST+notice, "")
+	return result
+}
+
+/**
+ * appending ": [reason]" when reason is given.
+ */
+func withReason(msg, reason string) string {
+	if reason == "" {
+		return msg
+	}
+	return msg + ": " + reason
+}
+
+/**
+ * admin authentication state of one admin connection.
+ * challenge is issued by "AUTH", and consumed by "AUTH <response>".
+ */
+type adminSession struct {
+	challenge string
+	authed    bool
+}
+
+func main() {
+	flag.IntVar(&serverCapacity, "capacity", SERVER_CAPACITY, "max number of users on server")
+	flag.IntVar(&roomCapacity, "room-capacity", ROOM_CAPACITY, "max number of users in each room except "+DEFAULT_ROOM)
+	flag.StringVar(&filterFile, "filter", FILTER_FILE, "moderation filter file")
+	flag.IntVar(&historySize, "history", HISTORY_SIZE, "number of broadcasts kept in each room, 0 for none")
+	flag.StringVar(&historyDir, "history-dir", "", "directory to persist history, not persisted when empty")
+	flag.StringVar(&accountFile, "accounts", ACCOUNT_FILE, "file of registered nicknames, registration is disabled when empty")
+	flag.BoolVar(&allowGuests, "guests", true, "allow unregistered nicknames")
+	opList := flag.String("ops", "", "comma separated operator nicknames, they should be registered")
+	flag.StringVar(&banFile, "bans", BAN_FILE, "file to persist bans, not persisted when empty")
+	flag.Var(&limits[LIMIT_MSG], "msg-limit", "[rate per second]:[burst] of broadcasts of each user, rate 0 for no limit")
+	flag.Var(&limits[LIMIT_DM], "dm-limit", "[rate per second]:[burst] of dms of each user, rate 0 for no limit")
+	flag.Var(&limits[LIMIT_CMD], "cmd-limit", "[rate per second]:[burst] of other commands of each user, rate 0 for no limit")
+	flag.Var(&limits[LIMIT_FILE], "file-limit", "[rate per second]:[burst] of file chunks and replies of each user, rate 0 for no limit")
+	flag.IntVar(&floodWarnings, "flood-warnings", FLOOD_WARNINGS, "messages over limit before mute")
+	flag.IntVar(&floodMutes, "flood-mutes", FLOOD_MUTES, "mutes for flooding before kick")
+	flag.DurationVar(&floodMute, "flood-mute", FLOOD_MUTE, "how long user is muted for flooding")
+	flag.IntVar(&sendQueueSize, "send-queue", SEND_QUEUE_SIZE, "max number of messages waiting to be sent to each user")
+	flag.StringVar(&slowPolicy, "slow-policy", SLOW_DROP, "when send queue is full, "+SLOW_DROP+" oldest broadcast or "+SLOW_KICK+" user")
+	flag.DurationVar(&writeTimeout, "write-timeout", WRITE_TIMEOUT, "user is disconnected when writing to it takes longer")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", HEARTBEAT_INTERVAL, "interval of pinging users")
+	flag.DurationVar(&peerTimeout, "peer-timeout", PEER_TIMEOUT, "user sending nothing for this time is disconnected")
+	flag.DurationVar(&resumeGrace, "resume-grace", RESUME_GRACE, "how long session of lost connection is kept, 0 for none")
+	flag.Parse()
+	if serverCapacity < 1 || roomCapacity < 1 || historySize < 0 || flag.NArg() > 0 ||
+		floodWarnings < 1 || floodMutes < 0 || floodMute <= 0 ||
+		sendQueueSize < 1 || (slowPolicy != SLOW_DROP && slowPolicy != SLOW_KICK) || writeTimeout <= 0 ||
+		heartbeatInterval <= 0 || peerTimeout <= heartbeatInterval || resumeGrace < 0 ||
+		(accountFile == "" && !allowGuests) { // nobody could connect
+		flag.Usage()
+		return
+	}
+	if accounts, err = loadAccounts(accountFile); err != nil {
+		fmt.Println("cannot load accounts:", err)
+		return
+	}
+	if bans, err = loadBans(banFile); err != nil {
+		fmt.Println("cannot load bans:", err)
+		return
+	}
+	for _, nickname := range strings.Split(*opList, ",") {
+		if nickname = strings.TrimSpace(nickname); nickname != "" {
+			setOperator(nickname, true)
+		}
+	}
+	allUsers = newRoom("", serverCapacity)
+	rooms = map[string]*room{DEFAULT_ROOM: newRoom(DEFAULT_ROOM, serverCapacity)}
+	if historyDir != "" {
+		if err := os.MkdirAll(historyDir, 0755); err != nil {
+			fmt.Println("cannot make history dir:", err)
+			return
+		}
+	}
+	rooms[DEFAULT_ROOM].openHistory()
+	if err := chatFilter.loadFilter(filterFile); err != nil { // default rule is kept
+		fmt.Println("cannot load filter:", err)
+	}
+
+	initCtrlCHandler()
+	initReloadHandler()
+	if secret := os.Getenv(ADMIN_SECRET_ENV); secret != "" {
+		adminSecret = []byte(secret)
+	}
+
+	listener, err = net.Listen(CONN_TYPE, ":"+SERVER_PORT)
+	if err != nil {
+		fmt.Println(LISTENER_OPEN_ERR)
+		return
+	}
+	defer listener.Close()
+	go serveDiscovery()
+	go heartbeat()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil || conn == nil {
+			fmt.Println(CONN_OPEN_ERR)
+		} else {
+			go serverTask(conn)
+		}
+	}
+}
+
+func serverTask(myConn net.Conn) { // main functionality of server
+	myReader := bufio.NewReader(myConn)
+	firstMsg, err := readFrame(myReader)
+	if err != nil || len(firstMsg) == 0 {
+		writeFrame(myConn, CONN_REJECT+"receive error")
+		myConn.Close()
+		return
+	}
+
+	if strings.HasPrefix(firstMsg, ADMIN_COMMAND) { // admin connection, not a chat user
+		adminTask(myConn, myReader, firstMsg)
+		myConn.Close()
+		return
+	} else if strings.HasPrefix(firstMsg, RESUME) { // connection of lost session, given to its serverTask
+		resumeTask(myConn, myReader, firstMsg[1:])
+		return
+	}
+
+	registering := strings.HasPrefix(firstMsg, REGISTER)
+	myNickname, password, withPassword := strings.Cut(firstMsg[1:], " ") // nickname has no space
+	if atomic.LoadInt32(&draining) == 1 {                                // reject because server is going down
+		writeFrame(myConn, CONN_REJECT+REJECT_MSG_DRAINING)
+		myConn.Close()
+		return
+	} else if reject := checkNickname(myNickname); reject != "" { // reject because nickname breaks policy
+		writeFrame(myConn, CONN_REJECT+reject)
+		myConn.Close()
+		return
+	}
+	ip, _, _ := net.SplitHostPort(myConn.RemoteAddr().String())
+	if wait := chatFilter.cooldownFor(myNickname, ip); wait > 0 { // reject because user was kicked by filter
+		writeFrame(myConn, CONN_REJECT+REJECT_MSG_COOLDOWN+wait.Round(time.Second).String())
+		myConn.Close()
+		return
+	} else if entry, banned := bans.check(myNickname, ip); banned { // reject because user is banned by operator
+		writeFrame(myConn, CONN_REJECT+banReject(entry))
+		myConn.Close()
+		return
+	} else if reject := authenticate(myNickname, ip, password, withPassword, registering); reject != "" { // reject by account
+		writeFrame(myConn, CONN_REJECT+reject)
+		myConn.Close()
+		return
+	}
+
+	myRecvChan := make(chan string) // receive channel: from client to server
+	myDoneChan := make(chan bool)   // closed when this goroutine ends, so nobody sends to me anymore
+	me := &member{nickname: myNickname, conn: myConn, queue: newSendQueue(), done: myDoneChan, flood: newFloodGuard(),
+		lastRecv: time.Now().UnixNano(), kicked: make(chan bool), token: newToken(), resume: make(chan resumeRequest),
+		seenIDs: make(map[string]bool)}
+
+	if tmpCnt, reject := allUsers.join(me); reject != "" { // reject because server is full or nickname is in use
+		writeFrame(myConn, CONN_REJECT+reject)
+		myConn.Close()
+		return
+	} else if err := registerOnJoin(myNickname, password, registering); err != nil { // nickname is held while registering
+		allUsers.leave(myNickname)
+		writeFrame(myConn, CONN_REJECT+REJECT_MSG_REGISTER+err.Error())
+		myConn.Close()
+		return
+	} else { // accept, and get into chatting room
+		welcomeMsg := WELCOME_MSG[0] + myNickname +
+			WELCOME_MSG[1] + myConn.LocalAddr().String() +
+			WELCOME_MSG[2] + fmt.Sprint(tmpCnt) + WELCOME_MSG[3]
+		serverMsg := CONN_SERVER_MSG[0] + myNickname + CONN_SERVER_MSG[1] + myConn.RemoteAddr().String() +
+			CONN_SERVER_MSG[2] + fmt.Sprint(tmpCnt) + CONN_SERVER_MSG[3]
+		me.write(CONN_REQUSET + welcomeMsg)
+		me.write(SESSION + me.token) // messages after it are counted for resume
+		addSession(me)
+		logInfo(serverMsg)
+
+		var lobbyCnt int
+		me.room, lobbyCnt, _ = joinRoom(DEFAULT_ROOM, me) // DEFAULT_ROOM is as large as server
+		me.room.broadcast(SERVER_BROADCAST+ROOM_JOIN_MSG[0]+myNickname+ROOM_JOIN_MSG[1]+DEFAULT_ROOM+
+			ROOM_JOIN_MSG[2]+fmt.Sprint(lobbyCnt)+ROOM_JOIN_MSG[3], myNickname)
+	}
+
+	// channels of current connection, made again when session is resumed
+	myStopChan := make(chan bool)   // closed to stop sendHandler when connection is lost
+	mySentChan := make(chan bool)   // closed by sendHandler after last message(CONN_KILL) is written, or stopped
+	myClosedChan := make(chan bool) // closed by recvHandler after reading ends
+	defer func() { lingerClose(me.getConn(), myClosedChan) }()
+	defer close(myDoneChan)
+	defer removeSession(me)
+	defer cancelTransfers(myNickname)
+	defer checkDrained()
+	defer func() { <-mySentChan }() // kill reason should be written before connection is closed
+
+	go recvHandler(myReader, myRecvChan, myDoneChan, myClosedChan) // from recvHandler, this goroutine gets message from client
+	go sendHandler(me, myStopChan, mySentChan)                     //to sendHandler, this goroutine sends message to client
+	sendHistory(me, HISTORY_ON_JOIN, false)                        // scrollback of DEFAULT_ROOM after welcome
+	for _, dm := range takeDMs(myNickname) {                       // dms sent while user was not connected
+		me.deliverWithReceipt(DIRECT_MESSAGE+dm.sender+" [offline "+dm.time.Format("15:04:05")+"] "+dm.msg,
+			dmReceipt(dm.sender, dm.id, myNickname))
+	}
+
+	for {
+		recvMsg := <-myRecvChan
+		atomic.StoreInt64(&me.lastRecv, time.Now().UnixNano())
+		logDebug(myNickname + ": " + recvMsg)
+
+		if recvMsg == CONN_LOST && !me.isKicked() && resumeGrace > 0 { // wait for client to resume session
+			close(myStopChan)
+			<-mySentChan
+			me.getConn().Close()
+			<-myClosedChan
+			req, resumed := parkSession(me)
+			if !resumed && me.isKicked() {
+				me.deliver(CONN_KILL) // not written, but sendHandler ends by it
+				leaveRoom(me, DISCONN_MSG)
+				break
+			} else if !resumed {
+				me.deliver(CONN_KILL)
+				leaveRoom(me, TIMEOUT_MSG)
+				break
+			}
+			myReader = req.reader
+			myStopChan, mySentChan, myClosedChan = make(chan bool), make(chan bool), make(chan bool)
+			go recvHandler(myReader, myRecvChan, myDoneChan, myClosedChan)
+			go sendHandler(me, myStopChan, mySentChan)
+		} else if recvMsg == CONN_LOST && atomic.LoadInt32(&me.timedOut) == 1 { // connection closed by heartbeat
+			me.deliver(CONN_KILL) // not written, but sendHandler ends by it
+			leaveRoom(me, TIMEOUT_MSG)
+			break
+		} else if strings.HasPrefix(recvMsg, CONN_KILL) || recvMsg == CONN_LOST { // connection kill by client's \exit or ctrl_c, or lost without resume
+			me.deliver(CONN_KILL)
+			leaveRoom(me, DISCONN_MSG)
+			break
+		} else if isResent(me, recvMsg) { // handled before resume, and its ack is already queued
+			continue
+		} else if action := limitFlood(me, recvMsg); action == ACTION_KICK { // checked before any other message
+			me.deliver(CONN_KILL + FLOOD_KILL)
+			leaveRoom(me, FORCE_KILL_MSG)
+			break
+		} else if action != ACTION_NONE {
+			if id, _, ok := splitMsgID(recvMsg[1:]); ok && (limitKind(recvMsg) == LIMIT_MSG || limitKind(recvMsg) == LIMIT_DM) {
+				me.deliver(ACK + id + " " + REJ_RATE)
+			}
+		} else if strings.HasPrefix(recvMsg, CLIENT_BROADCAST) { // broadcasting message from client
+			id, text, ok := splitMsgID(recvMsg[1:])
+			if !ok {
+				logInfo(INTERPRET_FAIL)
+				continue
+			}
+			action, sendToEverybodyMsg := moderate(me, text) // checked before delivery
+			if action == ACTION_KICK {
+				me.deliver(CONN_KILL + BADWORD_KILL)
+				leaveRoom(me, FORCE_KILL_MSG)
+				break
+			} else if action < ACTION_WARN {
+				me.room.record(myNickname, sendToEverybodyMsg)
+				me.room.broadcast(CLIENT_BROADCAST+myNickname+" "+sendToEverybodyMsg, myNickname)
+			}
+			me.deliver(ACK + id + " " + ackCode(action, ACK_OK))
+		} else if strings.HasPrefix(recvMsg, DIRECT_MESSAGE) { // dm from client to another client
+			id, text, ok := splitMsgID(recvMsg[1:])
+			if !ok {
+				logInfo(INTERPRET_FAIL)
+				continue
+			}
+			receiver, dm, _ := strings.Cut(text, " ")
+			action, sendMsg := moderate(me, dm) // checked before delivery
+			if action == ACTION_KICK {
+				me.deliver(CONN_KILL + BADWORD_KILL)
+				leaveRoom(me, FORCE_KILL_MSG)
+				break
+			} else if action >= ACTION_WARN {
+				me.deliver(ACK + id + " " + ackCode(action, ""))
+				continue
+			}
+			me.deliver(ACK + id + " " + sendDM(me, id, receiver, sendMsg))
+		} else if strings.HasPrefix(recvMsg, PING) { // heartbeat of client
+			me.deliver(PONG)
+		} else if strings.HasPrefix(recvMsg, PONG) { // answer of heartbeat, lastRecv is enough
+		} else if strings.HasPrefix(recvMsg, GET_VERSION) { // \ver from client
+			me.deliver(GET_VERSION + SERVER_VERSION)
+		} else if strings.HasPrefix(recvMsg, USER_LIST) { // \list from client
+			me.deliver(USER_LIST + allUsers.list())
+		} else if strings.HasPrefix(recvMsg, GET_RTT) { // \rtt from client
+			me.deliver(GET_RTT)
+		} else if strings.HasPrefix(recvMsg, JOIN_ROOM) { // \join from client
+			result, moved := moveRoom(me, recvMsg[1:])
+			me.deliver(SERVER_BROADCAST + result)
+			if moved {
+				sendHistory(me, HISTORY_ON_JOIN, false)
+			}
+		} else if strings.HasPrefix(recvMsg, PART_ROOM) { // \part from client
+			result, moved := moveRoom(me, DEFAULT_ROOM)
+			me.deliver(SERVER_BROADCAST + result)
+			if moved {
+				sendHistory(me, HISTORY_ON_JOIN, false)
+			}
+		} else if strings.HasPrefix(recvMsg, ROOM_LIST) { // \rooms from client
+			me.deliver(ROOM_LIST + roomList())
+		} else if strings.HasPrefix(recvMsg, ROOM_WHO) { // \who from client
+			if len(recvMsg) == 1 {
+				me.deliver(ROOM_WHO + me.room.list())
+			} else if r, exist := findRoom(recvMsg[1:]); exist {
+				me.deliver(ROOM_WHO + r.list())
+			} else {
+				me.deliver(SERVER_BROADCAST + NO_SUCH_ROOM)
+			}
+		} else if strings.HasPrefix(recvMsg, HISTORY) { // \history from client
+			n, err := strconv.Atoi(recvMsg[1:])
+			if err != nil || n < 1 {
+				n = HISTORY_ON_JOIN
+			}
+			sendHistory(me, n, true)
+		} else if strings.HasPrefix(recvMsg, ROOM_TOPIC) { // \topic from client
+			action, topic := moderate(me, recvMsg[1:])
+			if action == ACTION_KICK {
+				me.deliver(CONN_KILL + BADWORD_KILL)
+				leaveRoom(me, FORCE_KILL_MSG)
+				break
+			} else if action < ACTION_WARN {
+				me.room.setTopic(topic)
+				me.room.broadcast(SERVER_BROADCAST+"["+myNickname+" set topic of "+me.room.name+": "+topic+"]", "")
+			}
+		} else if strings.HasPrefix(recvMsg, REGISTER) { // \register from client
+			if err := accounts.register(myNickname, recvMsg[1:]); err != nil {
+				me.deliver(SERVER_BROADCAST + "[" + REJECT_MSG_REGISTER + err.Error() + "]")
+			} else {
+				me.deliver(SERVER_BROADCAST + REGISTERED_MSG)
+				logInfo("[" + myNickname + " is registered]")
+			}
+		} else if strings.HasPrefix(recvMsg, OPERATOR) { // \kick, \ban, \unban, \mute, \unmute from client
+			if result := handleOperator(me, recvMsg[1:]); result != "" {
+				me.deliver(SERVER_BROADCAST + result)
+			}
+		} else if strings.HasPrefix(recvMsg, FILE_OFFER) { // \send from client
+			offerFile(me, recvMsg[1:])
+		} else if strings.HasPrefix(recvMsg, FILE_REPLY) { // \accept, \reject and progress of receiver
+			replyFile(me, recvMsg[1:])
+		} else if strings.HasPrefix(recvMsg, FILE_CHUNK) { // file data from sender
+			relayChunk(me, recvMsg[1:])
+		} else if strings.HasPrefix(recvMsg, FILE_END) { // last chunk or \cancel of sender
+			endFile(me, recvMsg[1:])
+		} else {
+			logInfo(INTERPRET_FAIL)
+		}
+	}
+}
+
+/**
+ * file offered by sender to receiver. it is removed when receiver rejects, verifies or fails it,
+ * when sender cancels it, or when one of them leaves.
+ */
+type transfer struct {
+	id       string
+	sender   string
+	receiver string
+	size     int64
+	relayed  int64 // bytes of chunks relayed
+	acked    int64 // bytes receiver has written
+	accepted bool  // receiver has accepted relay
+	direct   bool  // receiver is connected to sender, not relayed
+	ended    bool  // sender has sent last chunk
+	offered  time.Time
+}
+
+func transferKey(sender, id string) string {
+	return nickKey(sender) + " " + id
+}
+
+/**
+ * "O" of sender. offer is sent to receiver, or fail reply to sender.
+ * unaccepted offers of sender older than FILE_OFFER_TIME are given up first.
+ */
+func offerFile(from *member, data string) {
+	id, rest, ok := splitMsgID(data)
+	args := strings.SplitN(rest, " ", 5) // receiver, size, sha256, direct port, name
+	if !ok || len(args) != 5 {
+		logInfo(INTERPRET_FAIL)
+		return
+	}
+	receiver, name := args[0], args[4]
+	size, err := strconv.ParseInt(args[1], 10, 64)
+	reject := ""
+	if err != nil || size < 0 || len(args[2]) != 2*sha256.Size || name == "" || len(name) > FILE_MAX_NAME ||
+		name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00\r\n") {
+		reject = "invalid file"
+	} else if size > FILE_MAX_SIZE {
+		reject = "file is larger than " + strconv.FormatInt(FILE_MAX_SIZE>>20, 10) + "MB"
+	} else if nickKey(receiver) == nickKey(from.nickname) {
+		reject = "you can't send file to yourself"
+	}
+
+	transfersMutex.Lock()
+	key, active := transferKey(from.nickname, id), 0
+	for k, t := range transfers {
+		if nickKey(t.sender) != nickKey(from.nickname) {
+			continue
+		} else if !t.accepted && !t.direct && time.Since(t.offered) > FILE_OFFER_TIME {
+			delete(transfers, k)
+			from.deliver(FILE_REPLY + t.receiver + " " + t.id + " fail offer expired")
+			if other, online := allUsers.lookup(t.receiver); online {
+				other.deliver(FILE_END + t.sender + " " + t.id + " cancel offer expired")
+			}
+		} else {
+			active++
+		}
+	}
+	other, online := allUsers.lookup(receiver)
+	_, inUse := transfers[key]
+	switch {
+	case reject != "": // invalid offer
+	case !online:
+		reject = "no such user"
+	case inUse:
+		reject = "file id is in use"
+	case active >= FILE_MAX_OFFERS:
+		reject = "too many files are being sent"
+	default:
+		transfers[key] = &transfer{id: id, sender: from.nickname, receiver: other.nickname, size: size, offered: time.Now()}
+	}
+	transfersMutex.Unlock()
+
+	if reject != "" {
+		from.deliver(FILE_REPLY + receiver + " " + id + " fail " + reject)
+		return
+	}
+	direct := directAddr(from.getConn().RemoteAddr(), args[3])
+	other.deliver(FILE_OFFER + from.nickname + " " + id + " " + args[1] + " " + args[2] + " " + direct + " " + name)
+	logInfo("[" + from.nickname + " offers " + name + " (" + args[1] + " bytes) to " + other.nickname + "]")
+}
+
+/**
+ * [directAddr] of offer, [directPort] of sender with its address seen by server.
+ * address of sender's own connection can be local one behind NAT, and it is not trusted
+ * so that receiver is not led to other host. returns "-" when direct transfer isn't offered.
+ */
+func directAddr(sender net.Addr, directPort string) string {
+	port, secret, _ := strings.Cut(directPort, "/")
+	host, _, err := net.SplitHostPort(sender.String())
+	if n, portErr := strconv.Atoi(port); err != nil || portErr != nil || n < 1 || n > 65535 || secret == "" {
+		return "-"
+	}
+	return net.JoinHostPort(host, port) + "/" + secret
+}
+
+/**
+ * "P" of receiver, sent to sender after transfer is updated.
+ * reply sent to sender is made by server from known tokens, not copied from receiver,
+ * and reason of "fail" is one of FILE_FAIL_REASONS, otherwise FILE_FAIL_OTHER.
+ */
+func replyFile(from *member, data string) {
+	args := strings.SplitN(data, " ", 3) // sender, id, reply
+	if len(args) != 3 {
+		logInfo(INTERPRET_FAIL)
+		return
+	}
+	reply, arg, _ := strings.Cut(args[2], " ")
+	forward := reply
+
+	transfersMutex.Lock()
+	key := transferKey(args[0], args[1])
+	t, exist := transfers[key]
+	if !exist || nickKey(t.receiver) != nickKey(from.nickname) {
+		transfersMutex.Unlock()
+		return
+	}
+	switch reply {
+	case "accept":
+		t.accepted = !t.direct
+	case "direct":
+		t.direct = !t.accepted
+	case "ack":
+		acked, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || acked <= t.acked || acked > t.relayed {
+			transfersMutex.Unlock()
+			return
+		}
+		t.acked = acked
+		forward = "ack " + strconv.FormatInt(acked, 10)
+	case "reject", "ok":
+		delete(transfers, key)
+	case "fail":
+		delete(transfers, key)
+		forward = "fail " + FILE_FAIL_OTHER
+		if slices.Contains(FILE_FAIL_REASONS, arg) {
+			forward = "fail " + arg
+		}
+	default:
+		transfersMutex.Unlock()
+		logInfo(INTERPRET_FAIL)
+		return
+	}
+	transfersMutex.Unlock()
+
+	if other, online := allUsers.lookup(t.sender); online {
+		other.deliver(FILE_REPLY + from.nickname + " " + t.id + " " + forward)
+	}
+	if reply != "ack" {
+		logInfo("[" + t.sender + " to " + t.receiver + " file " + t.id + ": " + forward + "]")
+	}
+}
+
+/**
+ * "Q" of sender, relayed to receiver. chunks should be in order, and at most FILE_WINDOW bytes
+ * can be relayed ahead of receiver's ack, so that chunks don't fill its send queue
+ * and messages of chatting are not dropped or delayed by file. otherwise transfer is canceled.
+ */
+func relayChunk(from *member, data string) {
+	id, rest, ok := splitMsgID(data)
+	offsetStr, chunk, _ := strings.Cut(rest, " ")
+	if !ok {
+		logInfo(INTERPRET_FAIL)
+		return
+	}
+	offset, err := strconv.ParseInt(offsetStr, 10, 64)
+	decoded, decodeErr := base64.StdEncoding.DecodeString(chunk)
+	size := int64(len(decoded))
+
+	transfersMutex.Lock()
+	key := transferKey(from.nickname, id)
+	t, exist := transfers[key]
+	if !exist {
+		transfersMutex.Unlock()
+		return
+	} else if err != nil || decodeErr != nil || !t.accepted || t.ended || offset != t.relayed ||
+		size == 0 || size > int64(FILE_CHUNK_SIZE) || t.relayed+size > t.size || t.relayed+size-t.acked > FILE_WINDOW {
+		delete(transfers, key)
+		transfersMutex.Unlock()
+		failTransfer(t, "invalid chunk")
+		return
+	}
+	t.relayed += size
+	transfersMutex.Unlock()
+
+	atomic.AddInt64(&relayedBytes, size)
+	if other, online := allUsers.lookup(t.receiver); online {
+		other.deliver(FILE_CHUNK + from.nickname + " " + id + " " + rest)
+	}
+}
+
+/**
+ * "R" of sender, sent to receiver. transfer is kept after "done", until receiver verifies it.
+ */
+func endFile(from *member, data string) {
+	id, result, ok := splitMsgID(data)
+	if !ok {
+		logInfo(INTERPRET_FAIL)
+		return
+	}
+
+	transfersMutex.Lock()
+	key := transferKey(from.nickname, id)
+	t, exist := transfers[key]
+	if !exist {
+		transfersMutex.Unlock()
+		return
+	} else if result == "done" && (!t.accepted || t.relayed != t.size) {
+		delete(transfers, key)
+		transfersMutex.Unlock()
+		failTransfer(t, "file is not complete")
+		return
+	} else if result == "done" {
+		t.ended = true
+	} else {
+		delete(transfers, key)
+		logInfo("[" + t.sender + " to " + t.receiver + " file " + t.id + ": " + result + "]")
+	}
+	transfersMutex.Unlock()
+
+	if other, online := allUsers.lookup(t.receiver); online {
+		other.deliver(FILE_END + from.nickname + " " + id + " " + result)
+	}
+}
+
+/**
+ * telling both sides that transfer is given up, after it is removed.
+ */
+func failTransfer(t *transfer, reason string) {
+	if m, online := allUsers.lookup(t.sender); online {
+		m.deliver(FILE_REPLY + t.receiver + " " + t.id + " fail " + reason)
+	}
+	if m, online := allUsers.lookup(t.receiver); online {
+		m.deliver(FILE_END + t.sender + " " + t.id + " cancel " + reason)
+	}
+	logInfo("[" + t.sender + " to " + t.receiver + " file " + t.id + " failed: " + reason + "]")
+}
+
+/**
+ * giving up transfers of user leaving.
+ */
+func cancelTransfers(nickname string) {
+	var canceled []*transfer
+	transfersMutex.Lock()
+	for key, t := range transfers {
+		if nickKey(t.sender) == nickKey(nickname) || nickKey(t.receiver) == nickKey(nickname) {
+			delete(transfers, key)
+			canceled = append(canceled, t)
+		}
+	}
+	transfersMutex.Unlock()
+
+	for _, t := range canceled {
+		failTransfer(t, nickname+" left")
+	}
+}
+
+func transferCount() int {
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+	return len(transfers)
+}
+
+/**
+ * registering nickname of "I" connection request, after user has joined.
+ */
+func registerOnJoin(nickname, password string, registering bool) error {
+	if !registering {
+		return nil
+	}
+	if err := accounts.register(nickname, password); err != nil {
+		return err
+	}
+	logInfo("[" + nickname + " is registered]")
+	return nil
+}
+
+/**
+ * random token for resuming session.
+ */
+func newToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+func addSession(m *member) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	sessions[m.token] = m
+}
+
+func removeSession(m *member) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	delete(sessions, m.token)
+}
+
+func findSession(token string) (*member, bool) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	m, exist := sessions[token]
+	return m, exist
+}
+
+/**
+ * waiting for resume of session whose connection is lost, at most resumeGrace.
+ * user stays in its room and gets messages meanwhile. on resume, welcome back message is
+ * written to new connection, and messages client hasn't received are queued again.
+ */
+func parkSession(me *member) (resumeRequest, bool) {
+	atomic.StoreInt32(&me.parked, 1)
+	defer atomic.StoreInt32(&me.parked, 0)
+	logInfo("[" + me.nickname + " lost connection, session is kept for " + resumeGrace.String() + "]")
+
+	select {
+	case req := <-me.resume:
+		me.setConn(req.conn)
+		replayed := me.queue.resume(req.received)
+		me.write(CONN_REQUSET + fmt.Sprintf("[welcome back %s. %d messages are sent again]", me.nickname, replayed))
+		atomic.StoreInt64(&me.lastRecv, time.Now().UnixNano())
+		atomic.StoreInt32(&me.timedOut, 0)
+		logInfo("[" + me.nickname + " resumed session from " + req.conn.RemoteAddr().String() + "]")
+		return req, true
+	case <-me.kicked:
+	case <-time.After(resumeGrace):
+	}
+	return resumeRequest{}, false
+}
+
+/**
+ * connection resuming session, "N"[token]" "[received].
+ * old connection is closed, because server may not have found it is lost yet,
+ * and new one is given to serverTask of session.
+ */
+func resumeTask(conn net.Conn, reader *bufio.Reader, data string) {
+	token, count, _ := strings.Cut(data, " ")
+	received, err := strconv.ParseInt(count, 10, 64)
+	m, exist := findSession(token)
+	if err != nil || !exist || m.isKicked() {
+		writeFrame(conn, CONN_REJECT+REJECT_MSG_NO_SESSION)
+		conn.Close()
+		return
+	}
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if entry, banned := bans.check(m.nickname, ip); banned {
+		writeFrame(conn, CONN_REJECT+banReject(entry))
+		conn.Close()
+		return
+	}
+
+	m.getConn().Close()
+	select {
+	case m.resume <- resumeRequest{conn, reader, received}:
+	case <-m.done:
+		writeFrame(conn, CONN_REJECT+REJECT_MSG_NO_SESSION)
+		conn.Close()
+	case <-time.After(RESUME_WAIT):
+		writeFrame(conn, CONN_REJECT+REJECT_MSG_NO_SESSION)
+		conn.Close()
+	}
+}
+
+/**
+ * checking whether client message with id is sent again after resume, and already handled.
+ */
+func isResent(m *member, msg string) bool {
+	if kind := limitKind(msg); kind != LIMIT_MSG && kind != LIMIT_DM {
+		return false
+	}
+	id, _, ok := splitMsgID(msg[1:])
+	return ok && !m.firstSeen(id)
+}
+
+/**
+ * splitting [msgID]" "[text] of client message.
+ */
+func splitMsgID(data string) (string, string, bool) {
+	id, text, ok := strings.Cut(data, " ")
+	return id, text, ok && len(id) > 0 && len(id) <= MAX_MSG_ID
+}
+
+/**
+ * ack code of message by filter action, accepted one is ok.
+ */
+func ackCode(action int, ok string) string {
+	switch action {
+	case ACTION_WARN, ACTION_KICK:
+		return REJ_BLOCKED
+	case ACTION_MUTE:
+		return REJ_MUTED
+	}
+	return ok
+}
+
+/**
+ * unregisters user, and tells the members of its room with leaving message.
+ * format is DISCONN_MSG or FORCE_KILL_MSG, with the number of users left in the room.
+ */
+func leaveRoom(m *member, format []string) {
+	allUsers.leave(m.nickname)
+	markSeen(m.nickname)
+	tmpCnt := partRoom(m.room, m.nickname)
+	sendMsg := format[0] + m.nickname + format[1] + fmt.Sprint(tmpCnt) + format[2]
+	logInfo(sendMsg)
+	m.room.broadcast(SERVER_BROADCAST+sendMsg, "")
+}
+
+/**
+ * reading client messages to ch, and closing closed when reading ends.
+ * after server task has ended, messages are read and dropped until connection is closed(see lingerClose).
+ */
+func recvHandler(reader *bufio.Reader, ch chan<- string, done <-chan bool, closed chan<- bool) {
+	defer close(closed)
+	for {
+		msg, err := readFrame(reader)
+		if err != nil { // connection closed without CONN_KILL(or kicked), session may be resumed
+			select {
+			case ch <- CONN_LOST:
+			case <-done:
+			}
+			return
+		} else if strings.HasPrefix(msg, CONN_LOST) { // not from client
+			continue
+		}
+
+		select {
+		case ch <- msg:
+		case <-done: // server task has already ended
+			continue
+		}
+
+		if strings.HasPrefix(msg, CONN_KILL) {
+			break
+		}
+	}
+}
+
+/**
+ * closing connection after kill reason is written. unread messages of client(e.g. flood)
+ * make close reset the connection, and kill reason can be lost before client reads it.
+ * so writing side is closed first, and messages are dropped by recvHandler
+ * until client closes connection or LINGER_TIME passes.
+ */
+func lingerClose(conn net.Conn, closed <-chan bool) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(LINGER_TIME))
+	<-closed
+	conn.Close()
+}
+
+func sendHandler(m *member, stop <-chan bool, sent chan<- bool) {
+	defer close(sent)
+	for {
+		out, ok := m.queue.pop(stop) // receive message from server thread
+		if !ok {                     // connection is lost
+			return
+		}
+		if err := m.write(out.msg); err != nil { // recvHandler gets error from closed connection
+			if !errors.Is(err, net.ErrClosed) { // not closed by server itself(kick, timeout)
+				logInfo("[cannot send to " + m.nickname + ": " + err.Error() + "]")
+			}
+			m.queue.unpop(out) // written after resume
+			m.getConn().Close()
+			return
+		}
+		m.queue.sent(out)
+		if out.written != nil {
+			go out.written() // it may deliver to another user, whose sendHandler may be delivering to this one
+		}
+
+		if strings.HasPrefix(out.msg, CONN_KILL) { // last message, nothing is written after kill reason
+			return
+		}
+	}
+}
+
+/**
+ * reads one message framed as [length][message].
+ * message longer than MAX_FRAME_SIZE is an error, not to allocate for it.
+ */
+func readFrame(reader *bufio.Reader) (string, error) {
+	header := make([]byte, FRAME_HEADER)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > uint32(MAX_FRAME_SIZE) {
+		return "", errors.New(FRAME_TOO_LARGE)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(reader, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+/**
+ * writes one message framed as [length][message], with single Write call.
+ */
+func writeFrame(conn net.Conn, msg string) error {
+	frame := make([]byte, FRAME_HEADER+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[FRAME_HEADER:], msg)
+	_, err := conn.Write(frame)
+	return err
+}
+
+/**
+ * answering LAN discovery query, so that clients can find this server.
+ * query: "DISCOVER"[" "<service type>], padded to DISCOVERY_QUERY_SIZE bytes
+ * reply: "SERVICE "<service type>" "<version>" "<port>" "<instance id>
+ * multicast listener shares the port with other servers on the same host,
+ * and receives broadcast query too. short query is ignored, not to be reflected.
+ */
+func serveDiscovery() {
+	pc, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(DISCOVERY_GROUP), Port: DISCOVERY_PORT})
+	if err != nil {
+		fmt.Println("Discovery is not available:", err)
+		return
+	}
+	defer pc.Close()
+
+	instanceID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	announce := []byte(DISCOVERY_REPLY + " " + SERVICE_TYPE + " " + SERVER_VERSION + " " + SERVER_PORT + " " + instanceID)
+	buf := make([]byte, DISCOVERY_QUERY_SIZE)
+	for {
+		cnt, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := strings.Fields(string(buf[:cnt]))
+		if cnt < DISCOVERY_QUERY_SIZE || len(query) == 0 || query[0] != DISCOVERY_QUERY ||
+			(len(query) > 1 && query[1] != SERVICE_TYPE) {
+			continue
+		}
+		pc.WriteTo(announce, addr)
+	}
+}
+
+/**
+ * admin connection. every message is "9"[adminCommand],
+ * and connection ends on any other message or error.
+ */
+func adminTask(conn net.Conn, reader *bufio.Reader, msg string) {
+	var admin adminSession
+	var err error
+	for strings.HasPrefix(msg, ADMIN_COMMAND) {
+		writeFrame(conn, ADMIN_COMMAND+handleAdmin(msg[1:], &admin))
+
+		if msg, err = readFrame(reader); err != nil {
+			return
+		}
+	}
+}
+
+/**
+ * admin commands:
+ * AUTH                returns "CHALLENGE "[nonce]
+ * AUTH [response]     response = hex(HMAC-SHA256(secret, nonce)), returns OK or ERR
+ * STATS               returns server statistics, users, rooms, and flood and send queue state of users
+ * KICK [nickname]     disconnects the user
+ * DRAIN               rejects new users, and stops server after the last one leaves
+ * SHUTDOWN            stops server now
+ * LOGLEVEL [level]    quiet, info or debug
+ * RELOAD              reads filter file again
+ * OP [nickname]       grants operator role, until server restarts
+ * DEOP [nickname]     takes operator role
+ * admin is disabled when ADMIN_SECRET_ENV is not set.
+ */
+func handleAdmin(data string, admin *adminSession) string {
+	if adminSecret == nil {
+		return ADMIN_ERR_DISABLED
+	}
+	args := strings.Fields(data)
+	if len(args) == 0 {
+		return ADMIN_ERR_FORMAT
+	}
+
+	if strings.ToUpper(args[0]) == "AUTH" {
+		if len(args) == 1 { // new challenge, previous one can't be used anymore
+			nonce := make([]byte, 16)
+			rand.Read(nonce)
+			admin.challenge, admin.authed = hex.EncodeToString(nonce), false
+			return "CHALLENGE " + admin.challenge
+		}
+		h := hmac.New(sha256.New, adminSecret)
+		h.Write([]byte(admin.challenge))
+		admin.authed = admin.challenge != "" && hmac.Equal([]byte(args[1]), []byte(hex.EncodeToString(h.Sum(nil))))
+		admin.challenge = "" // one response for one challenge
+		if !admin.authed {
+			logInfo("[admin authentication failed]")
+			return ADMIN_ERR_AUTH
+		}
+		logInfo("[admin authenticated]")
+		return ADMIN_OK
+	} else if !admin.authed {
+		return ADMIN_ERR_AUTH
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "STATS":
+		stats := fmt.Sprintf("version = %s, users = %d, draining = %t, log level = %s, filter rules = %d, queued dms = %d, accounts = %d, bans = %d, "+
+			"file transfers = %d, relayed bytes = %d\n",
+			SERVER_VERSION, allUsers.count(), atomic.LoadInt32(&draining) == 1,
+			LOG_LEVELS[atomic.LoadInt32(&logLevel)], chatFilter.ruleCount(), queuedDMCount(), accounts.count(), bans.count(),
+			transferCount(), atomic.LoadInt64(&relayedBytes))
+		return stats + "operators: " + operatorList() + "\n" + allUsers.list() + "rooms:\n" + roomList() + userStatus()
+	case "KICK":
+		if len(args) != 2 {
+			return ADMIN_ERR_FORMAT
+		}
+		if !kickUser(args[1], KICK_MSG) {
+			return "ERR no such user"
+		}
+		logInfo("[" + args[1] + " is kicked by admin]")
+		return ADMIN_OK
+	case "DRAIN":
+		atomic.StoreInt32(&draining, 1)
+		logInfo("[server is draining]")
+		go checkDrained()
+		return ADMIN_OK
+	case "SHUTDOWN":
+		logInfo("[shutdown by admin]")
+		go func() {
+			time.Sleep(time.Second) // let reply be sent
+			shutdownServer()
+		}()
+		return ADMIN_OK
+	case "LOGLEVEL":
+		for level, name := range LOG_LEVELS {
+			if len(args) == 2 && strings.ToLower(args[1]) == name {
+				atomic.StoreInt32(&logLevel, int32(level))
+				return ADMIN_OK
+			}
+		}
+		return ADMIN_ERR_FORMAT
+	case "RELOAD":
+		if err := chatFilter.loadFilter(filterFile); err != nil {
+			return "ERR " + err.Error()
+		}
+		logInfo("[filter reloaded by admin]")
+		return ADMIN_OK
+	case "OP", "DEOP":
+		if len(args) != 2 {
+			return ADMIN_ERR_FORMAT
+		}
+		setOperator(args[1], strings.ToUpper(args[0]) == "OP")
+		notice := "[" + args[1] + " is operator now]"
+		if strings.ToUpper(args[0]) == "DEOP" {
+			notice = "[" + args[1] + " is not operator anymore]"
+		}
+		logInfo(notice)
+		allUsers.broadcast(SERVER_BROADCAST+notice, "")
+		if strings.ToUpper(args[0]) == "OP" && !accounts.isRegistered(args[1]) {
+			return ADMIN_OK + " (role works after nickname is registered)"
+		}
+		return ADMIN_OK
+	}
+	return ADMIN_ERR_FORMAT
+}
+
+/**
+ * pinging every user by heartbeatInterval, and closing connection of user
+ * who has sent nothing(even pong) for peerTimeout. its recvHandler reports it
+ * to serverTask, and others are told it has timed out unless session is resumed.
+ */
+func heartbeat() {
+	for range time.Tick(heartbeatInterval) {
+		for _, m := range allUsers.snapshot() {
+			if atomic.LoadInt32(&m.parked) == 1 { // connection is already lost
+				continue
+			} else if time.Since(time.Unix(0, atomic.LoadInt64(&m.lastRecv))) > peerTimeout {
+				if atomic.CompareAndSwapInt32(&m.timedOut, 0, 1) {
+					logDebug("[" + m.nickname + " sent nothing for " + peerTimeout.String() + "]")
+					m.getConn().Close()
+				}
+			} else {
+				m.deliver(PING)
+			}
+		}
+	}
+}
+
+/**
+ * stops server when it is draining and nobody is left.
+ */
+func checkDrained() {
+	if atomic.LoadInt32(&draining) == 1 && allUsers.count() == 0 {
+		time.Sleep(time.Second) // let last replies be sent
+		shutdownServer()
+	}
+}
+
+/**
+ * logging by level. join and leave messages are info, and received messages are debug.
+ */
+func logInfo(a ...any) {
+	if atomic.LoadInt32(&logLevel) >= LOG_INFO {
+		fmt.Println(a...)
+	}
+}
+
+func logDebug(a ...any) {
+	if atomic.LoadInt32(&logLevel) >= LOG_DEBUG {
+		fmt.Println(a...)
+	}
+}
+
+func initCtrlCHandler() {
+	ch := make(chan os.Signal)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		shutdownServer()
+	}()
+}
+
+/**
+ * reading filter file again on SIGHUP.
+ */
+func initReloadHandler() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := chatFilter.loadFilter(filterFile); err != nil {
+				fmt.Println("cannot reload filter:", err)
+			} else {
+				logInfo("[filter reloaded]")
+			}
+		}
+	}()
+}
+
+func shutdownServer() {
+	members := allUsers.snapshot()
+	for _, m := range members { // kill all client when server is died
+		m.write(CONN_KILL + SERVER_DOWN)
+	}
+	for _, m := range members {
+		m.getConn().Close()
+	}
+	fmt.Println(EXIT_MSG)
+	os.Exit(0)
 }
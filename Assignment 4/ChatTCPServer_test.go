@@ -0,0 +1,638 @@
+package main
+
+/**
+ * 20170454 Yi Changmin
+ *
+ * tests of nickname policy, nickname key, offline dm queue, login guard, flood guard,
+ * file replies and send queue.
+ * go test ChatTCPServer.go ChatRoom.go ChatRoom_test.go ChatTCPServer_test.go
+ */
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckNickname(t *testing.T) {
+	tests := []struct {
+		nickname, reject string
+	}{
+		{"alice", ""},
+		{"user_1.x-y", ""},
+		{"Ａｌｉｃｅ", ""},
+		{"José", ""},
+		{"Jose\u0301", ""}, // combining acute accent
+		{"नमस्ते", ""},     // virama and vowel sign
+		{"สวัสดี", ""},     // thai vowel marks
+		{"ﾃｽﾄ", ""},        // halfwidth katakana
+		{"a", REJECT_MSG_NICK_SHORT},
+		{"abcdefghijklmnopq", REJECT_MSG_NICK_LONG},
+		{"\xffab", REJECT_MSG_NICK_UTF8},
+		{"a b", REJECT_MSG_NICK_CHAR},
+		{"a!b", REJECT_MSG_NICK_CHAR},
+		{"\u0301ab", REJECT_MSG_NICK_MARK},
+		{"a_\u0301b", REJECT_MSG_NICK_MARK},
+		{"ab\u0301\u0301\u0301\u0301\u0301", REJECT_MSG_NICK_MARK},
+		{"ADMIN", REJECT_MSG_NICK_RESERVE},
+		{"ＡＤＭＩＮ", REJECT_MSG_NICK_RESERVE},
+	}
+	for _, test := range tests {
+		if reject := checkNickname(test.nickname); reject != test.reject {
+			t.Errorf("checkNickname(%q) = %q, want %q", test.nickname, reject, test.reject)
+		}
+	}
+}
+
+func TestNickKey(t *testing.T) {
+	same := [][]string{
+		{"alice", "Alice", "ALICE", "Ａｌｉｃｅ"},
+		{"José", "Jose\u0301", "JOSÉ", "JOSE\u0301"},
+		{"straße", "STRASSE", "strasse"},
+		{"ﬁle", "file"},
+		{"ΣΊΣΥΦΟΣ", "σίσυφος", "σίσυφοσ"},
+		{"नमस्ते", "नमस्ते"},
+	}
+	for _, names := range same {
+		for _, name := range names[1:] {
+			if nickKey(name) != nickKey(names[0]) {
+				t.Errorf("nickKey(%q) = %q, differs from nickKey(%q) = %q", name, nickKey(name), names[0], nickKey(names[0]))
+			}
+		}
+	}
+
+	different := [][2]string{{"alice", "alicia"}, {"jose", "josé"}, {"สวัสดี", "สวสด"}}
+	for _, names := range different {
+		if nickKey(names[0]) == nickKey(names[1]) {
+			t.Errorf("nickKey(%q) and nickKey(%q) are same", names[0], names[1])
+		}
+	}
+}
+
+/**
+ * clears offline dm queue and accounts, and restores them after test.
+ */
+func setupOffline(t *testing.T) {
+	prevAccounts, prevDMs, prevCount, prevBySender, prevSeen := accounts, offlineDMs, offlineCount, offlineBySender, seenNicks
+	accounts, _ = loadAccounts("")
+	offlineDMs, offlineCount = make(map[string][]queuedDM), 0
+	offlineBySender, seenNicks = make(map[string]int), make(map[string]time.Time)
+	t.Cleanup(func() {
+		accounts, offlineDMs, offlineCount, offlineBySender, seenNicks = prevAccounts, prevDMs, prevCount, prevBySender, prevSeen
+	})
+}
+
+func queueTestDM(sender, receiver string) string {
+	offlineMutex.Lock()
+	defer offlineMutex.Unlock()
+	return queueDM(receiver, queuedDM{time.Now(), "1", sender, "hi"})
+}
+
+func TestQueueDMReceiver(t *testing.T) {
+	setupOffline(t)
+	accounts.accounts[nickKey("Carol")] = account{nickname: "Carol"}
+	markSeen("Bob")
+
+	tests := []struct {
+		receiver, code string
+	}{
+		{"nobody1", REJ_NO_USER}, // never seen
+		{"bob", ACK_QUEUED},      // seen guest
+		{"ＢＯＢ", ACK_QUEUED},
+		{"carol", ACK_QUEUED}, // registered
+	}
+	for _, test := range tests {
+		if code := queueTestDM("alice", test.receiver); code != test.code {
+			t.Errorf("dm to %s = %s, want %s", test.receiver, code, test.code)
+		}
+	}
+
+	offlineMutex.Lock()
+	seenNicks[nickKey("Bob")] = time.Now().Add(-OFFLINE_SEEN_AGE - time.Minute)
+	offlineMutex.Unlock()
+	if code := queueTestDM("alice", "bob"); code != REJ_NO_USER {
+		t.Errorf("dm to guest seen long ago = %s, want %s", code, REJ_NO_USER)
+	}
+}
+
+func TestSeenNicksCap(t *testing.T) {
+	setupOffline(t)
+	markSeen("first")
+	offlineMutex.Lock()
+	seenNicks[nickKey("first")] = time.Now().Add(-time.Hour) // least recently seen
+	seenNicks[nickKey("expired")] = time.Now().Add(-OFFLINE_SEEN_AGE - time.Minute)
+	offlineMutex.Unlock()
+	for i := 0; len(seenNicks) < OFFLINE_MAX_SEEN; i++ {
+		markSeen(fmt.Sprint("user", i))
+	}
+
+	markSeen("user0") // seen again, nothing is dropped
+	if len(seenNicks) != OFFLINE_MAX_SEEN {
+		t.Fatalf("seen nicknames = %d, want %d", len(seenNicks), OFFLINE_MAX_SEEN)
+	}
+	markSeen("new1") // expired one is dropped
+	if _, exist := seenNicks[nickKey("expired")]; exist || len(seenNicks) != OFFLINE_MAX_SEEN {
+		t.Fatalf("expired nickname is kept, seen nicknames = %d", len(seenNicks))
+	}
+	markSeen("new2") // least recently seen one is dropped
+	if _, exist := seenNicks[nickKey("first")]; exist || len(seenNicks) != OFFLINE_MAX_SEEN {
+		t.Errorf("least recently seen nickname is kept, seen nicknames = %d", len(seenNicks))
+	}
+	if code := queueTestDM("alice", "new2"); code != ACK_QUEUED {
+		t.Errorf("dm to newly seen guest = %s, want %s", code, ACK_QUEUED)
+	}
+}
+
+func TestQueueDMLimits(t *testing.T) {
+	setupOffline(t)
+	receivers := OFFLINE_MAX_PER_SENDER/OFFLINE_MAX_PER_USER + 1
+	for i := 0; i < receivers; i++ {
+		markSeen(fmt.Sprint("user", i))
+	}
+
+	sent := 0
+	for i := 0; i < receivers && sent < OFFLINE_MAX_PER_SENDER; i++ {
+		for j := 0; j < OFFLINE_MAX_PER_USER && sent < OFFLINE_MAX_PER_SENDER; j++ {
+			if code := queueTestDM("alice", fmt.Sprint("user", i)); code != ACK_QUEUED {
+				t.Fatalf("dm %d = %s, want %s", sent, code, ACK_QUEUED)
+			}
+			sent++
+		}
+	}
+	if code := queueTestDM("alice", fmt.Sprint("user", receivers-1)); code != REJ_SENDER_FULL {
+		t.Errorf("dm over sender limit = %s, want %s", code, REJ_SENDER_FULL)
+	}
+	if code := queueTestDM("bob", "user0"); code != REJ_QUEUE_FULL {
+		t.Errorf("dm over receiver limit = %s, want %s", code, REJ_QUEUE_FULL)
+	}
+	if code := queueTestDM("bob", fmt.Sprint("user", receivers-1)); code != ACK_QUEUED {
+		t.Errorf("dm of other sender = %s, want %s", code, ACK_QUEUED)
+	}
+
+	if dms := takeDMs("user0"); len(dms) != OFFLINE_MAX_PER_USER {
+		t.Errorf("user0 got %d dms, want %d", len(dms), OFFLINE_MAX_PER_USER)
+	}
+	if code := queueTestDM("alice", "user0"); code != ACK_QUEUED {
+		t.Errorf("dm after receiver has taken dms = %s, want %s", code, ACK_QUEUED)
+	}
+	if cnt := queuedDMCount(); cnt != OFFLINE_MAX_PER_SENDER-OFFLINE_MAX_PER_USER+2 {
+		t.Errorf("queued dms = %d, want %d", cnt, OFFLINE_MAX_PER_SENDER-OFFLINE_MAX_PER_USER+2)
+	}
+}
+
+func TestLoginGuard(t *testing.T) {
+	g := newLoginGuard()
+	for i := 0; i < LOGIN_FREE_FAILS; i++ {
+		if wait := g.waitFor("alice", "10.0.0.1"); wait > 0 {
+			t.Fatalf("wait after %d failures = %v", i, wait)
+		}
+		g.failed("alice", "10.0.0.1")
+	}
+
+	tests := []struct {
+		nickname, ip string
+		waits        bool
+	}{
+		{"alice", "10.0.0.1", true},
+		{"ALICE", "10.0.0.2", true}, // same nickname from other address
+		{"bob", "10.0.0.1", true},   // other nickname from same address
+		{"bob", "10.0.0.2", false},
+	}
+	for _, test := range tests {
+		if wait := g.waitFor(test.nickname, test.ip); (wait > 0) != test.waits || wait > LOGIN_BACKOFF {
+			t.Errorf("waitFor(%s, %s) = %v", test.nickname, test.ip, wait)
+		}
+	}
+
+	g.failed("alice", "10.0.0.3")
+	if wait := g.waitFor("alice", "10.0.0.4"); wait <= LOGIN_BACKOFF {
+		t.Errorf("wait after one more failure = %v, should be doubled", wait)
+	}
+	for i := 0; i < 40; i++ {
+		g.failed("alice", "10.0.0.3")
+	}
+	if wait := g.waitFor("alice", "10.0.0.4"); wait <= 0 || wait > LOGIN_BACKOFF_MAX {
+		t.Errorf("wait after many failures = %v, want up to %v", wait, LOGIN_BACKOFF_MAX)
+	}
+
+	g.succeeded("alice")
+	if wait := g.waitFor("alice", "10.0.0.4"); wait > 0 {
+		t.Errorf("wait after success = %v", wait)
+	}
+	if wait := g.waitFor("alice", "10.0.0.1"); wait <= 0 {
+		t.Error("success should not clear failures of address")
+	}
+}
+
+/**
+ * hash waits while every slot is taken, and is computed when one is free.
+ */
+func TestHashPasswordSlots(t *testing.T) {
+	for i := 0; i < HASH_MAX_CONCURRENT; i++ {
+		hashSlots <- true
+	}
+	done := make(chan error)
+	go func() {
+		_, err := hashPassword("password", []byte("salt"), 1, HASH_SIZE)
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("hash is computed while every slot is taken")
+	case <-time.After(100 * time.Millisecond):
+	}
+	<-hashSlots
+	if err := <-done; err != nil {
+		t.Errorf("hash after slot is free = %v", err)
+	}
+	for i := 1; i < HASH_MAX_CONCURRENT; i++ {
+		<-hashSlots
+	}
+}
+
+func TestLimitKind(t *testing.T) {
+	tests := []struct {
+		msg  string
+		kind int
+	}{
+		{CLIENT_BROADCAST + "hi", LIMIT_MSG},
+		{DIRECT_MESSAGE + "bob hi", LIMIT_DM},
+		{FILE_CHUNK + "1 0 AAAA", LIMIT_FILE},
+		{FILE_REPLY + "bob 1 ack 3", LIMIT_FILE},
+		{USER_LIST, LIMIT_CMD},
+	}
+	for _, test := range tests {
+		if kind := limitKind(test.msg); kind != test.kind {
+			t.Errorf("limitKind(%q) = %s, want %s", test.msg, LIMIT_NAMES[kind], LIMIT_NAMES[test.kind])
+		}
+	}
+}
+
+func TestDirectAddr(t *testing.T) {
+	sender := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	tests := []struct {
+		directPort, directAddr string
+	}{
+		{"5000/abcd", "203.0.113.7:5000/abcd"},
+		{"-", "-"},
+		{"10.0.0.1:5000/abcd", "-"}, // host is given by server only
+		{"0/abcd", "-"},
+		{"70000/abcd", "-"},
+		{"5000/", "-"},
+	}
+	for _, test := range tests {
+		if addr := directAddr(sender, test.directPort); addr != test.directAddr {
+			t.Errorf("directAddr(%q) = %q, want %q", test.directPort, addr, test.directAddr)
+		}
+	}
+	if addr := directAddr(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, "5000/abcd"); addr != "[2001:db8::1]:5000/abcd" {
+		t.Errorf("directAddr of ipv6 sender = %q", addr)
+	}
+}
+
+/**
+ * reply forwarded to sender is made of known tokens, whatever receiver has sent.
+ */
+func TestReplyFile(t *testing.T) {
+	setupRooms(t, 0)
+	prevUsers, prevTransfers := allUsers, transfers
+	allUsers, transfers = newRoom("", 2), make(map[string]*transfer)
+	t.Cleanup(func() { allUsers, transfers = prevUsers, prevTransfers })
+	sender, receiver := newTestMember(t, "alice"), newTestMember(t, "bob")
+	allUsers.join(sender)
+	allUsers.join(receiver)
+
+	tests := []struct {
+		reply, forward string
+	}{
+		{"ack 100", "ack 100"},
+		{"ack +0200", "ack 200"},
+		{"ack 100 and text", ""},
+		{"ack 50", ""},  // not over last ack
+		{"ack 300", ""}, // over relayed bytes
+		{"hello everyone", ""},
+		{"fail checksum mismatch", "fail checksum mismatch"},
+		{"fail visit http://example.com", "fail " + FILE_FAIL_OTHER},
+	}
+	for _, test := range tests {
+		transfers[transferKey("alice", "1")] = &transfer{id: "1", sender: "alice", receiver: "bob", size: 300, relayed: 200, acked: 50}
+		before := len(queued(sender))
+		replyFile(receiver, "alice 1 "+test.reply)
+		msgs := queued(sender)
+		forward := ""
+		if len(msgs) > before {
+			forward = strings.TrimPrefix(msgs[len(msgs)-1], FILE_REPLY+"bob 1 ")
+		}
+		if forward != test.forward {
+			t.Errorf("reply %q is forwarded as %q, want %q", test.reply, forward, test.forward)
+		}
+	}
+
+	transfers[transferKey("alice", "1")] = &transfer{id: "1", sender: "alice", receiver: "bob"}
+	replyFile(sender, "alice 1 fail transfer error") // only receiver can reply
+	if _, exist := transfers[transferKey("alice", "1")]; !exist {
+		t.Error("transfer is ended by reply of sender")
+	}
+}
+
+/**
+ * sets queue size and slow policy, and restores them after test.
+ */
+func setupQueue(t *testing.T, size int, policy string) {
+	prevSize, prevPolicy := sendQueueSize, slowPolicy
+	sendQueueSize, slowPolicy = size, policy
+	t.Cleanup(func() { sendQueueSize, slowPolicy = prevSize, prevPolicy })
+}
+
+func TestDeliverDrop(t *testing.T) {
+	setupQueue(t, 3, SLOW_DROP)
+	m := newTestMember(t, "alice")
+	prevDropped := atomic.LoadInt64(&dropped)
+
+	tests := []struct {
+		msg    string
+		queued []string
+	}{
+		{CLIENT_BROADCAST + "bob a", []string{CLIENT_BROADCAST + "bob a"}},
+		{ACK + "1 ok", []string{CLIENT_BROADCAST + "bob a", ACK + "1 ok"}},
+		{SERVER_BROADCAST + "[notice]", []string{CLIENT_BROADCAST + "bob a", ACK + "1 ok", SERVER_BROADCAST + "[notice]"}},
+		{FILE_CHUNK + "bob 1 AAAA", []string{ACK + "1 ok", SERVER_BROADCAST + "[notice]", FILE_CHUNK + "bob 1 AAAA"}},
+		{HISTORY + "old", []string{ACK + "1 ok", FILE_CHUNK + "bob 1 AAAA", HISTORY + "old"}},
+		{RECEIPT + "2 bob", []string{ACK + "1 ok", FILE_CHUNK + "bob 1 AAAA", RECEIPT + "2 bob"}},
+		{CLIENT_BROADCAST + "bob b", []string{ACK + "1 ok", FILE_CHUNK + "bob 1 AAAA", RECEIPT + "2 bob"}}, // newest is dropped
+		{DIRECT_MESSAGE + "bob hi", []string{ACK + "1 ok", FILE_CHUNK + "bob 1 AAAA", RECEIPT + "2 bob", DIRECT_MESSAGE + "bob hi"}},
+	}
+	for _, test := range tests {
+		if !m.deliver(test.msg) {
+			t.Fatalf("deliver(%q) = false", test.msg)
+		}
+		if got := queued(m); !slices.Equal(got, test.queued) {
+			t.Fatalf("queue after %q = %q, want %q", test.msg, got, test.queued)
+		}
+	}
+	if m.queue.dropped != 4 || atomic.LoadInt64(&dropped)-prevDropped != 4 {
+		t.Errorf("dropped = %d, total %d, want 4", m.queue.dropped, atomic.LoadInt64(&dropped)-prevDropped)
+	}
+
+	for len(queued(m)) < 2*sendQueueSize { // frames which can't be dropped fill up to twice of size
+		m.deliver(FILE_CHUNK + "bob 1 AAAA")
+	}
+	if m.deliver(ACK+"3 ok") || !m.isKicked() {
+		t.Error("user is not disconnected when queue is full of frames which can't be dropped")
+	}
+	if got := queued(m); len(got) != 1 || got[0] != CONN_KILL+SLOW_KILL {
+		t.Errorf("queue after kill = %q", got)
+	}
+}
+
+func TestDeliverKick(t *testing.T) {
+	setupQueue(t, 2, SLOW_KICK)
+	prevDropped, prevKicks := atomic.LoadInt64(&dropped), atomic.LoadInt64(&slowKicks)
+
+	parked := newTestMember(t, "bob") // waiting for resume, so old broadcast is dropped
+	atomic.StoreInt32(&parked.parked, 1)
+	for _, msg := range []string{"a", "b", "c"} {
+		if !parked.deliver(CLIENT_BROADCAST + "carol " + msg) {
+			t.Fatalf("parked user is kicked")
+		}
+	}
+	if got := queued(parked); len(got) != 2 || parked.queue.dropped != 1 {
+		t.Errorf("queue of parked user = %q, dropped %d", got, parked.queue.dropped)
+	}
+
+	m := newTestMember(t, "alice")
+	m.deliver(CLIENT_BROADCAST + "carol a")
+	m.deliver(ACK + "1 ok")
+	if m.deliver(CLIENT_BROADCAST+"carol b") || !m.isKicked() {
+		t.Fatal("user is not kicked when queue is full")
+	}
+	if got := queued(m); len(got) != 1 || got[0] != CONN_KILL+SLOW_KILL {
+		t.Errorf("queue after kick = %q", got)
+	}
+	if m.deliver(ACK + "2 ok") {
+		t.Error("message is queued after kill")
+	}
+	if m.queue.dropped != 3 || atomic.LoadInt64(&dropped)-prevDropped != 4 || atomic.LoadInt64(&slowKicks)-prevKicks != 1 {
+		t.Errorf("dropped = %d, total %d, kicks %d, want 3, 4 and 1", m.queue.dropped,
+			atomic.LoadInt64(&dropped)-prevDropped, atomic.LoadInt64(&slowKicks)-prevKicks)
+	}
+}
+
+/**
+ * queue which has written n messages "m1".."mn", and has "pending" not written yet.
+ */
+func writtenQueue(n int) *sendQueue {
+	q := newSendQueue()
+	for i := 1; i <= n; i++ {
+		q.sent(outbound{fmt.Sprint("m", i), nil})
+	}
+	q.items = []outbound{{"pending", nil}}
+	return q
+}
+
+func queueMsgs(q *sendQueue) []string {
+	msgs := []string{}
+	for _, out := range q.items {
+		msgs = append(msgs, out.msg)
+	}
+	return msgs
+}
+
+/**
+ * "m<from>".."m<to>".
+ */
+func msgRange(from, to int) []string {
+	msgs := []string{}
+	for i := from; i <= to; i++ {
+		msgs = append(msgs, fmt.Sprint("m", i))
+	}
+	return msgs
+}
+
+func lostNotice(n int) string {
+	return SERVER_BROADCAST + fmt.Sprintf("[%d messages are lost while disconnected]", n)
+}
+
+func TestSendQueueResume(t *testing.T) {
+	tests := []struct {
+		name              string
+		written, received int
+		replay            []string
+	}{
+		{"all received", 5, 5, nil},
+		{"more than written", 5, 9, nil},
+		{"inside log", 5, 2, msgRange(3, 5)},
+		{"nothing received", 3, 0, msgRange(1, 3)},
+		{"start of log", RESUME_LOG + 10, 10, msgRange(11, RESUME_LOG+10)},
+		{"older than log", RESUME_LOG + 10, 4, append([]string{lostNotice(6)}, msgRange(11, RESUME_LOG+10)...)},
+	}
+	for _, test := range tests {
+		q := writtenQueue(test.written)
+		if n := q.resume(int64(test.received)); n != len(test.replay) {
+			t.Errorf("%s: resume = %d, want %d", test.name, n, len(test.replay))
+		}
+		if got, want := queueMsgs(q), append(test.replay, "pending"); !slices.Equal(got, want) {
+			t.Errorf("%s: queue = %q, want %q", test.name, got, want)
+		}
+		if q.written != int64(min(test.received, test.written)) || len(q.sentLog) != 0 {
+			t.Errorf("%s: written = %d and log has %d messages after resume", test.name, q.written, len(q.sentLog))
+		}
+	}
+}
+
+/**
+ * connection is lost again while messages sent again are still in queue.
+ * queue has sent m6..m10 again after resume(5), and m6 is written to new connection.
+ */
+func TestSendQueueResumeAgain(t *testing.T) {
+	resumed := func() *sendQueue {
+		q := writtenQueue(10)
+		q.resume(5)
+		out, _ := q.pop(nil)
+		q.sent(out)
+		return q
+	}
+	rest := append(msgRange(7, 10), "pending")
+
+	tests := []struct {
+		received int
+		queue    []string
+	}{
+		{6, rest},
+		{5, append([]string{"m6"}, rest...)},
+		{3, append([]string{lostNotice(2), "m6"}, rest...)}, // m4 and m5 are not in log of new connection
+	}
+	for _, test := range tests {
+		q := resumed()
+		q.resume(int64(test.received))
+		if got := queueMsgs(q); !slices.Equal(got, test.queue) {
+			t.Errorf("queue after resume(%d) = %q, want %q", test.received, got, test.queue)
+		}
+	}
+
+	q := resumed() // twice before anything is written
+	q.resume(6)
+	q.resume(6)
+	if got := queueMsgs(q); !slices.Equal(got, rest) {
+		t.Errorf("queue after second resume(6) = %q, want %q", got, rest)
+	}
+}
+
+/**
+ * sets rate limits, warnings and mutes of flood guard as main does, and restores them after test.
+ */
+func setupFlood(t *testing.T, limit rateLimit, warnings, mutes int) {
+	prevLimits, prevWarnings, prevMutes, prevMute := limits, floodWarnings, floodMutes, floodMute
+	limits = []rateLimit{limit, limit, limit, limit}
+	floodWarnings, floodMutes, floodMute = warnings, mutes, FLOOD_MUTE
+	t.Cleanup(func() { limits, floodWarnings, floodMutes, floodMute = prevLimits, prevWarnings, prevMutes, prevMute })
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := tokenBucket{2, start}
+	limit := rateLimit{rate: 1, burst: 2}
+
+	steps := []struct {
+		after time.Duration
+		taken bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},
+		{500 * time.Millisecond, false},
+		{time.Second, true}, // 1.5 seconds after, one token is filled
+		{time.Second, false},
+		{time.Hour, true}, // filled only up to burst
+		{time.Hour, true},
+		{time.Hour, false},
+	}
+	for i, step := range steps {
+		if taken := b.take(limit, start.Add(step.after)); taken != step.taken {
+			t.Errorf("step %d: take %v after start = %t, want %t", i, step.after, taken, step.taken)
+		}
+	}
+	if !b.take(rateLimit{rate: 0, burst: 1}, start) {
+		t.Error("take without limit = false")
+	}
+}
+
+/**
+ * messages over limit are warned floodWarnings-1 times, then muted, and kicked
+ * on mute after floodMutes ones. strikes are forgiven after FLOOD_FORGIVE.
+ */
+func TestFloodGuard(t *testing.T) {
+	setupFlood(t, rateLimit{rate: 1, burst: 1}, 3, 1)
+	start := time.Now()
+	g := newFloodGuard()
+	for i := range g.buckets {
+		g.buckets[i].last = start
+	}
+
+	type result struct{ action, warnings int }
+	check := func(now time.Time) result {
+		action, warnings := g.checkAt(LIMIT_MSG, now)
+		return result{action, warnings}
+	}
+	if got := check(start); got.action != ACTION_NONE {
+		t.Fatalf("first message = %s", ACTION_NAMES[got.action])
+	}
+	want := []result{{ACTION_WARN, 1}, {ACTION_WARN, 2}, {ACTION_MUTE, 0}, {ACTION_WARN, 1}, {ACTION_WARN, 2}, {ACTION_KICK, 0}}
+	for i, w := range want {
+		if got := check(start); got != w {
+			t.Errorf("message %d over limit = %s %d, want %s %d", i+1, ACTION_NAMES[got.action], got.warnings,
+				ACTION_NAMES[w.action], w.warnings)
+		}
+	}
+	if g.limited != len(want) {
+		t.Errorf("limited = %d, want %d", g.limited, len(want))
+	}
+
+	// strikes are kept while user keeps hitting limit within FLOOD_FORGIVE
+	now := start.Add(FLOOD_FORGIVE / 2)
+	check(now) // token is filled, so it is not over limit
+	if got := check(now); got != (result{ACTION_WARN, 1}) {
+		t.Errorf("over limit within %v = %s %d, want warning 1", FLOOD_FORGIVE, ACTION_NAMES[got.action], got.warnings)
+	}
+	check(now) // second warning
+
+	now = now.Add(FLOOD_FORGIVE + time.Second)
+	check(now)
+	if got := check(now); got != (result{ACTION_WARN, 1}) {
+		t.Errorf("over limit after %v = %s %d, want warning 1", FLOOD_FORGIVE, ACTION_NAMES[got.action], got.warnings)
+	}
+	if g.warnings != 1 || g.mutes != 0 {
+		t.Errorf("warnings = %d, mutes = %d after forgiven, want 1 and 0", g.warnings, g.mutes)
+	}
+}
+
+/**
+ * user is told about warning and mute, and muted by filter.
+ */
+func TestLimitFlood(t *testing.T) {
+	setupFlood(t, rateLimit{rate: 0.001, burst: 1}, 2, 1)
+	setupQueue(t, 16, SLOW_DROP)
+	m := newTestMember(t, "flooder")
+	m.flood = newFloodGuard()
+	defer chatFilter.unmute(m.nickname)
+
+	actions := []int{ACTION_NONE, ACTION_WARN, ACTION_MUTE, ACTION_WARN, ACTION_KICK}
+	for i, want := range actions {
+		if action := limitFlood(m, CLIENT_BROADCAST+"1 spam"); action != want {
+			t.Errorf("message %d = %s, want %s", i, ACTION_NAMES[action], ACTION_NAMES[want])
+		}
+	}
+	if chatFilter.mutedFor(m.nickname) <= 0 {
+		t.Error("user is not muted by filter")
+	}
+	msgs := queued(m)
+	if len(msgs) != 3 || !strings.Contains(msgs[0], "warning 1 of 2") || !strings.Contains(msgs[1], "muted") ||
+		!strings.Contains(msgs[2], "warning 1 of 2") {
+		t.Errorf("messages to user = %q", msgs)
+	}
+}
@@ -0,0 +1,10 @@
+module chat
+
+go 1.26.0
+
+require (
+	golang.org/x/term v0.46.0
+	golang.org/x/text v0.42.0
+)
+
+require golang.org/x/sys v0.48.0 // indirect
@@ -29,6 +29,8 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"os"
@@ -66,10 +68,25 @@ const (
 
 	BOARD_SIZE int  = 10
 	EMPTY      byte = 0
+
+	// LAN discovery (see discoverServer)
+	DISCOVERY_GROUP      string        = "239.255.20.45"
+	DISCOVERY_PORT       int           = 20455
+	DISCOVERY_QUERY      string        = "DISCOVER"
+	DISCOVERY_REPLY      string        = "SERVICE"
+	DISCOVERY_QUERY_SIZE int           = 64
+	DISCOVERY_TIMEOUT    time.Duration = time.Second
+	SERVICE_TYPE         string        = "omok"
+	NO_SERVER_DISCOVERED string        = "no server discovered"
+	INVALID_SELECTION    string        = "invalid selection"
 )
 
 var (
+	DISCOVERY_TARGETS []string = []string{DISCOVERY_GROUP, "255.255.255.255", "127.255.255.255"}
+	discoverMode      bool
+
 	buffer          []byte         = make([]byte, BUFFER_SIZE)
+	stdin           *bufio.Scanner = bufio.NewScanner(os.Stdin) // only reader of keyboard, so no input is buffered away
 	tcpConn         net.Conn       = nil
 	udpConn         net.PacketConn = nil
 	opponentUDPAddr *net.UDPAddr
@@ -90,14 +107,24 @@ var (
 func main() {
 	initCtrlCHandler()
 
-	if len(os.Args) != 2 {
+	flag.BoolVar(&discoverMode, "d", false, "discover server on LAN, and select it")
+	flag.Parse()
+	if flag.NArg() != 1 {
 		fmt.Println("wrong argument")
 		return
 	} else {
-		myNickname = os.Args[1]
+		myNickname = flag.Arg(0)
+	}
+
+	serverAddr := SERVER_NAME + ":" + SERVER_PORT
+	if discoverMode {
+		if serverAddr, err = discoverServer(true); err != nil {
+			fmt.Println(err)
+			return
+		}
 	}
 
-	tcpConn, err = net.Dial(TCP_CONN_TYPE, SERVER_NAME+":"+SERVER_PORT)
+	tcpConn, err = net.Dial(TCP_CONN_TYPE, serverAddr)
 	if err != nil {
 		fmt.Println("no server found.")
 		return
@@ -150,15 +177,66 @@ func main() {
 	<-terminateChan
 }
 
+/**
+ * finds servers of SERVICE_TYPE on LAN and this host, and lets user pick one.
+ * query is sent to multicast group and broadcast addresses,
+ * and replies are collected for DISCOVERY_TIMEOUT.
+ * when pick is false, first found server is used. returns "host:port".
+**/
+func discoverServer(pick bool) (string, error) {
+	pc, err := net.ListenPacket("udp4", ":")
+	if err != nil {
+		return "", err
+	}
+	defer pc.Close()
+
+	query := DISCOVERY_QUERY + " " + SERVICE_TYPE
+	query += strings.Repeat(" ", DISCOVERY_QUERY_SIZE-len(query)) // server ignores query shorter than its reply
+	for _, target := range DISCOVERY_TARGETS {
+		pc.WriteTo([]byte(query), &net.UDPAddr{IP: net.ParseIP(target), Port: DISCOVERY_PORT}) // unreachable one is ignored
+	}
+
+	servers, seen := []string{}, map[string]bool{}
+	buf := make([]byte, BUFFER_SIZE)
+	pc.SetReadDeadline(time.Now().Add(DISCOVERY_TIMEOUT))
+	for {
+		cnt, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		reply := strings.Fields(string(buf[:cnt])) // "SERVICE" <type> <version> <port> <instance id>
+		if len(reply) != 5 || reply[0] != DISCOVERY_REPLY || reply[1] != SERVICE_TYPE || seen[reply[4]] {
+			continue
+		}
+		seen[reply[4]] = true // same server answers through every interface query has reached
+		servers = append(servers, net.JoinHostPort(addr.(*net.UDPAddr).IP.String(), reply[3]))
+		if pick {
+			fmt.Printf("%d) %s (version %s)\n", len(servers), servers[len(servers)-1], reply[2])
+		}
+	}
+
+	if len(servers) == 0 {
+		return "", errors.New(NO_SERVER_DISCOVERED)
+	} else if !pick {
+		return servers[0], nil
+	}
+	fmt.Print("Select server: ")
+	stdin.Scan()
+	idx, err := strconv.Atoi(strings.TrimSpace(stdin.Text()))
+	if err != nil || idx < 1 || idx > len(servers) {
+		return "", errors.New(INVALID_SELECTION)
+	}
+	return servers[idx-1], nil
+}
+
 /**
  * keyboard input and send handling goroutine
 **/
 func UDPSendHandler() {
 	var input string
-	scanner := *bufio.NewScanner(os.Stdin)
 	for {
-		scanner.Scan()
-		input = scanner.Text()
+		stdin.Scan()
+		input = stdin.Text()
 
 		if strings.HasPrefix(input, "\\") {
 			cmd := input[1:]
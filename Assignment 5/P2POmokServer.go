@@ -22,6 +22,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -37,6 +38,15 @@ const (
 	TCP_CONN_REJECT   string = "1"
 	TCP_OPPONENT_DATA string = "2"
 	TCP_CONN_QUIT     string = "3"
+
+	// LAN discovery (see serveDiscovery)
+	DISCOVERY_GROUP      string = "239.255.20.45"
+	DISCOVERY_PORT       int    = 20455
+	DISCOVERY_QUERY      string = "DISCOVER"
+	DISCOVERY_REPLY      string = "SERVICE"
+	DISCOVERY_QUERY_SIZE int    = 64
+	SERVICE_TYPE         string = "omok"
+	SERVICE_VERSION      string = "1.0.0"
 )
 
 var (
@@ -58,6 +68,7 @@ func main() {
 	initCtrlCHandler()
 
 	listener, _ = net.Listen(CONN_TYPE, ":"+SERVER_PORT)
+	go serveDiscovery()
 
 	for idx := 0; true; idx = (idx + 1) % 2 {
 		if atomic.LoadInt32(&connCnt) == 2 { // two users connected, pair each other and disconnect
@@ -141,6 +152,38 @@ func quitHandler(idx int, quitChan chan bool) {
 	}
 }
 
+/**
+ * answering LAN discovery query, so that clients can find this server.
+ * query: "DISCOVER"[" "<service type>], padded to DISCOVERY_QUERY_SIZE bytes
+ * reply: "SERVICE "<service type>" "<version>" "<port>" "<instance id>
+ * multicast listener shares the port with other servers on the same host,
+ * and receives broadcast query too. short query is ignored, not to be reflected.
+**/
+func serveDiscovery() {
+	pc, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(DISCOVERY_GROUP), Port: DISCOVERY_PORT})
+	if err != nil {
+		fmt.Println("Discovery is not available:", err)
+		return
+	}
+	defer pc.Close()
+
+	instanceID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	announce := []byte(DISCOVERY_REPLY + " " + SERVICE_TYPE + " " + SERVICE_VERSION + " " + SERVER_PORT + " " + instanceID)
+	buf := make([]byte, DISCOVERY_QUERY_SIZE)
+	for {
+		cnt, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := strings.Fields(string(buf[:cnt]))
+		if cnt < DISCOVERY_QUERY_SIZE || len(query) == 0 || query[0] != DISCOVERY_QUERY ||
+			(len(query) > 1 && query[1] != SERVICE_TYPE) {
+			continue
+		}
+		pc.WriteTo(announce, addr)
+	}
+}
+
 func initCtrlCHandler() {
 	ch := make(chan os.Signal)
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
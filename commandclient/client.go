@@ -0,0 +1,272 @@
+/**
+ * 20170454 YiChangmin
+ * client library of command service.
+ * (EasyTCPServer, EasyUDPServer, MultiClientTCPServer)
+**/
+
+/**
+ * Package commandclient sends requests of command service,
+ * and interprets its replies into Go types.
+ *
+ * request format = <command><data>, reply format = <data>
+ * one Client keeps one connection, and reuses it for every request.
+ * requests of one Client are serialized, 'cause reply has no request id.
+ * over udp, cookie handshake and optional signing are done by Client.
+**/
+package commandclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimeout time.Duration = 3 * time.Second
+	bufferSize     int           = 1024
+
+	// commands of request, Command of ReplyError is one of them
+	CmdUpper        byte   = '1'
+	CmdWhoAmI       byte   = '2'
+	CmdRequestCount byte   = '3'
+	CmdUptime       byte   = '4'
+	CmdDisconnect   byte   = '5'
+	wrongCommand    string = "Wrong command"
+)
+
+/**
+ * Client of command service. Network is "tcp" or "udp".
+ * fields should be set before first request.
+**/
+type Client struct {
+	Network string
+	Address string        // "host:port"
+	Timeout time.Duration // for each request, DefaultTimeout when zero
+	Key     []byte        // udp only: shared key of signed requests, nil when not signed
+
+	mu     sync.Mutex
+	conn   net.Conn
+	buffer []byte
+	closed bool
+
+	cookie     string // udp only
+	cookieTime time.Time
+}
+
+/**
+ * creates client. connection is made by first request.
+**/
+func New(network, address string) *Client {
+	return &Client{Network: network, Address: address}
+}
+
+/**
+ * command #1: returns upper-cased text.
+**/
+func (c *Client) Upper(ctx context.Context, text string) (string, error) {
+	return c.request(ctx, CmdUpper, text)
+}
+
+/**
+ * command #2: returns client's IP address and port number seen by server.
+**/
+func (c *Client) WhoAmI(ctx context.Context) (ip string, port int, err error) {
+	reply, err := c.request(ctx, CmdWhoAmI, "")
+	if err != nil {
+		return "", 0, err
+	}
+	ip, portStr, err := net.SplitHostPort(reply)
+	if err != nil {
+		return "", 0, &ReplyError{Command: CmdWhoAmI, Reply: reply}
+	}
+	if port, err = strconv.Atoi(portStr); err != nil {
+		return "", 0, &ReplyError{Command: CmdWhoAmI, Reply: reply}
+	}
+	return ip, port, nil
+}
+
+/**
+ * command #3: returns the number of requests served before this request.
+**/
+func (c *Client) RequestCount(ctx context.Context) (int, error) {
+	reply, err := c.request(ctx, CmdRequestCount, "")
+	if err != nil {
+		return 0, err
+	}
+	cnt, err := strconv.Atoi(reply)
+	if err != nil {
+		return 0, &ReplyError{Command: CmdRequestCount, Reply: reply}
+	}
+	return cnt, nil
+}
+
+/**
+ * command #4: returns server's running time, in seconds precision.
+**/
+func (c *Client) Uptime(ctx context.Context) (time.Duration, error) {
+	reply, err := c.request(ctx, CmdUptime, "")
+	if err != nil {
+		return 0, err
+	}
+	var hh, mm, ss int
+	if _, err := fmt.Sscanf(reply, "%d:%d:%d", &hh, &mm, &ss); err != nil {
+		return 0, &ReplyError{Command: CmdUptime, Reply: reply}
+	}
+	return time.Duration(hh)*time.Hour + time.Duration(mm)*time.Minute + time.Duration(ss)*time.Second, nil
+}
+
+/**
+ * command #5: sends disconnection message(tcp only), and closes connection.
+ * client can't be used after Close.
+**/
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+	if c.Network == "tcp" {
+		c.conn.Write([]byte{CmdDisconnect})
+	}
+	return c.conn.Close()
+}
+
+/**
+ * sends one request and returns its reply.
+ * connection is made when there is no one, and dropped after network error
+ * so that next request makes new connection.
+**/
+func (c *Client) request(ctx context.Context, cmd byte, data string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return "", ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if c.conn == nil {
+		if err := c.dial(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	// request is bounded by timeout, context deadline, and context cancellation.
+	// callback can run after c.conn is dropped, so it uses its own copy.
+	deadline := time.Now().Add(c.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn := c.conn
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0)) // wake up blocked read or write
+	})
+	defer stop()
+
+	var reply string
+	var err error
+	if c.Network == "udp" {
+		reply, err = c.udpRoundTrip(string(cmd) + data)
+	} else {
+		reply, err = c.roundTrip([]byte(string(cmd) + data))
+	}
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+		return "", &NetError{Op: "request " + string(cmd), Err: err}
+	}
+
+	if reply == wrongCommand {
+		return "", ErrWrongCommand
+	}
+	return reply, nil
+}
+
+/**
+ * makes connection with server.
+**/
+func (c *Client) dial(ctx context.Context) error {
+	if c.Network != "tcp" && c.Network != "udp" {
+		return fmt.Errorf("commandclient: unknown network %q", c.Network)
+	}
+	d := net.Dialer{Timeout: c.timeout()}
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return &NetError{Op: "dial", Err: err}
+	}
+	c.conn = conn
+	if c.buffer == nil {
+		c.buffer = make([]byte, bufferSize)
+	}
+	return nil
+}
+
+/**
+ * writes message, and reads one reply.
+**/
+func (c *Client) roundTrip(msg []byte) (string, error) {
+	if _, err := c.conn.Write(msg); err != nil {
+		return "", err
+	}
+	cnt, err := c.conn.Read(c.buffer)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(c.buffer[:cnt]), "\x00"), nil
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
+/**
+ * errors of commandclient.
+ * network errors are wrapped in NetError, and timeout can be
+ * checked by errors.Is(err, os.ErrDeadlineExceeded).
+**/
+var (
+	ErrClosed       = errors.New("commandclient: client is closed")
+	ErrWrongCommand = errors.New("commandclient: server doesn't know the command")
+	ErrNoCookie     = errors.New("commandclient: server didn't validate cookie")
+)
+
+/**
+ * error while sending request or receiving reply.
+**/
+type NetError struct {
+	Op  string
+	Err error
+}
+
+func (e *NetError) Error() string { return "commandclient: " + e.Op + ": " + e.Err.Error() }
+func (e *NetError) Unwrap() error { return e.Err }
+
+/**
+ * reply which can't be interpreted as result of the command.
+**/
+type ReplyError struct {
+	Command byte
+	Reply   string
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("commandclient: invalid reply of command %c: %q", e.Command, e.Reply)
+}
@@ -0,0 +1,346 @@
+package commandclient
+
+/**
+ * tests with fake servers speaking command service protocol.
+ * tcp one is like MultiClientTCPServer, and udp one checks cookie and signature like EasyUDPServer.
+**/
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/**
+ * reply of fake server to <command><data>, seen from addr.
+**/
+func fakeReply(msg []byte, addr net.Addr, served int) []byte {
+	switch msg[0] {
+	case CmdUpper:
+		return bytes.ToUpper(msg[1:])
+	case CmdWhoAmI:
+		return []byte(addr.String())
+	case CmdRequestCount:
+		return []byte(strconv.Itoa(served))
+	case CmdUptime:
+		return []byte("01:02:03")
+	}
+	return []byte(wrongCommand)
+}
+
+/**
+ * serving tcp clients until test ends. returns its address, and receives every disconnect command.
+**/
+func startTCPServer(t *testing.T) (string, <-chan bool) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	disconn := make(chan bool, 16)
+	var served int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buffer := make([]byte, bufferSize)
+				for {
+					cnt, err := conn.Read(buffer)
+					if err != nil {
+						return
+					} else if buffer[0] == CmdDisconnect {
+						disconn <- true
+						return
+					}
+					conn.Write(fakeReply(buffer[:cnt], conn.RemoteAddr(), int(atomic.AddInt32(&served, 1)-1)))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), disconn
+}
+
+/**
+ * udp server. key is shared key of signed requests, or nil.
+ * cookie is "cookie0001"... changed by rotate, and old one is answered with cookieNeeded.
+**/
+type fakeUDPServer struct {
+	conn    net.PacketConn
+	key     []byte
+	mutex   sync.Mutex
+	cookie  string
+	cookies int // cookie requests
+	rotated int
+}
+
+func startUDPServer(t *testing.T, key []byte) *fakeUDPServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &fakeUDPServer{conn: conn, key: key}
+	s.rotate()
+	go s.serve()
+	return s
+}
+
+func (s *fakeUDPServer) rotate() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rotated++
+	s.cookie = "cookie" + strconv.Itoa(1000+s.rotated)
+}
+
+func (s *fakeUDPServer) cookieRequests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cookies
+}
+
+func (s *fakeUDPServer) serve() {
+	buffer := make([]byte, bufferSize)
+	served := 0
+	for {
+		cnt, addr, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		msg := buffer[:cnt]
+		if s.key != nil { // "S"<timestamp><mac><rest>
+			if len(msg) < 81 || msg[0] != 'S' {
+				continue
+			}
+			h := hmac.New(sha256.New, s.key)
+			h.Write(msg[1:17])
+			h.Write(msg[81:])
+			if !hmac.Equal(msg[17:81], []byte(hex.EncodeToString(h.Sum(nil)))) {
+				continue
+			}
+			msg = msg[81:]
+		}
+
+		s.mutex.Lock()
+		cookie := s.cookie
+		if msg[0] == '0' {
+			s.cookies++
+		}
+		s.mutex.Unlock()
+
+		var reply []byte
+		if msg[0] == '0' && cnt >= cookieRequestSize {
+			reply = []byte(cookieReply + cookie)
+		} else if msg[0] != 'C' || !bytes.HasPrefix(msg[1:], []byte(cookie)) {
+			reply = []byte(cookieNeeded)
+		} else {
+			reply = fakeReply(msg[1+len(cookie):], addr, served)
+			served++
+		}
+		s.conn.WriteTo(reply, addr)
+	}
+}
+
+func TestTCPCommands(t *testing.T) {
+	addr, disconn := startTCPServer(t)
+	c := New("tcp", addr)
+	ctx := context.Background()
+
+	if reply, err := c.Upper(ctx, "hello?"); err != nil || reply != "HELLO?" {
+		t.Errorf("Upper = %q, %v", reply, err)
+	}
+	if ip, port, err := c.WhoAmI(ctx); err != nil || ip != "127.0.0.1" || port == 0 {
+		t.Errorf("WhoAmI = %s, %d, %v", ip, port, err)
+	}
+	if cnt, err := c.RequestCount(ctx); err != nil || cnt != 2 {
+		t.Errorf("RequestCount = %d, %v", cnt, err)
+	}
+	if d, err := c.Uptime(ctx); err != nil || d != time.Hour+2*time.Minute+3*time.Second {
+		t.Errorf("Uptime = %v, %v", d, err)
+	}
+	if _, err := c.request(ctx, '8', ""); !errors.Is(err, ErrWrongCommand) {
+		t.Errorf("unknown command error = %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+	select {
+	case <-disconn:
+	case <-time.After(time.Second):
+		t.Error("server didn't get disconnect command")
+	}
+	if _, err := c.Upper(ctx, "x"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Upper after Close = %v", err)
+	}
+	if err := c.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("second Close = %v", err)
+	}
+}
+
+func TestUDPCookie(t *testing.T) {
+	s := startUDPServer(t, nil)
+	c := New("udp", s.conn.LocalAddr().String())
+	defer c.Close()
+	ctx := context.Background()
+
+	for _, text := range []string{"hello", "?", ""} { // reply can look like anything but cookieNeeded
+		if reply, err := c.Upper(ctx, text); err != nil || reply != string(bytes.ToUpper([]byte(text))) {
+			t.Errorf("Upper(%q) = %q, %v", text, reply, err)
+		}
+	}
+	if n := s.cookieRequests(); n != 1 {
+		t.Errorf("cookie is requested %d times, want 1", n)
+	}
+
+	s.rotate() // old cookie is rejected, and new one is fetched
+	if reply, err := c.Upper(ctx, "again"); err != nil || reply != "AGAIN" {
+		t.Errorf("Upper after rotation = %q, %v", reply, err)
+	}
+	if n := s.cookieRequests(); n != 2 {
+		t.Errorf("cookie is requested %d times, want 2", n)
+	}
+}
+
+func TestUDPSigned(t *testing.T) {
+	s := startUDPServer(t, []byte("secret"))
+	c := New("udp", s.conn.LocalAddr().String())
+	c.Key = []byte("secret")
+	c.Timeout = 500 * time.Millisecond
+	defer c.Close()
+
+	if reply, err := c.Upper(context.Background(), "signed"); err != nil || reply != "SIGNED" {
+		t.Errorf("Upper = %q, %v", reply, err)
+	}
+
+	wrong := New("udp", s.conn.LocalAddr().String()) // unsigned request is not answered
+	wrong.Key = []byte("other")
+	wrong.Timeout = 200 * time.Millisecond
+	defer wrong.Close()
+	if _, err := wrong.Upper(context.Background(), "x"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Upper with wrong key = %v, want timeout", err)
+	}
+}
+
+func TestTimeoutAndCancel(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0") // never answers
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := New("udp", conn.LocalAddr().String())
+	c.Timeout = 100 * time.Millisecond
+	defer c.Close()
+	_, err = c.Upper(context.Background(), "x")
+	var netErr *NetError
+	if !errors.As(err, &netErr) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("timeout error = %v", err)
+	}
+
+	c.Timeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := c.Upper(ctx, "x"); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled error = %v", err)
+	} else if time.Since(start) > 5*time.Second {
+		t.Errorf("cancel took %v", time.Since(start))
+	}
+}
+
+/**
+ * context canceled by request checking it after failure, like one canceled from other goroutine
+ * right after connection is dropped. callback of cancellation runs before request returns.
+**/
+type cancelOnErrContext struct {
+	context.Context
+	done chan struct{}
+	errs int32
+}
+
+func (ctx *cancelOnErrContext) Done() <-chan struct{} { return ctx.done }
+
+func (ctx *cancelOnErrContext) Err() error {
+	switch atomic.AddInt32(&ctx.errs, 1) {
+	case 1: // check before request
+		return nil
+	case 2: // check after connection is dropped
+		close(ctx.done)
+		time.Sleep(50 * time.Millisecond)
+	}
+	return context.Canceled
+}
+
+func TestCancelWhileFailing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	c := New("tcp", l.Addr().String())
+	defer c.Close()
+	ctx := &cancelOnErrContext{Context: context.Background(), done: make(chan struct{})}
+	if _, err := c.Upper(ctx, "x"); !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want canceled", err)
+	}
+}
+
+/**
+ * requests of one client from many goroutines are serialized, so each gets its own reply.
+**/
+func TestConcurrentRequests(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			addr := ""
+			if network == "tcp" {
+				addr, _ = startTCPServer(t)
+			} else {
+				addr = startUDPServer(t, nil).conn.LocalAddr().String()
+			}
+			c := New(network, addr)
+			defer c.Close()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 20; j++ {
+						text := "msg" + strconv.Itoa(i) + "-" + strconv.Itoa(j)
+						if reply, err := c.Upper(context.Background(), text); err != nil || reply != string(bytes.ToUpper([]byte(text))) {
+							t.Errorf("Upper(%q) = %q, %v", text, reply, err)
+							return
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
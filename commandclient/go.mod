@@ -0,0 +1,3 @@
+module commandclient
+
+go 1.21
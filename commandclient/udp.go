@@ -0,0 +1,82 @@
+package commandclient
+
+/**
+ * udp request of command service is wrapped for EasyUDPServer's
+ * source validation and authentication.
+ * ["S"<timestamp: 16 hex><HMAC-SHA256(key, timestamp + rest): 64 hex>]"C"<cookie><command><data>
+ * reply larger than request is served only with valid cookie,
+ * and cookie is requested by "0" padded to cookieRequestSize bytes.
+**/
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	cookieMaxAge      time.Duration = 25 * time.Second // server's cookie is valid for at least 30 seconds
+	cookieRequestSize int           = 32
+	cookieReply       string        = "0cookie:"
+	cookieNeeded      string        = "\xff" // not UTF-8, so no reply of command can be it
+)
+
+/**
+ * sends request with cookie, and returns its reply.
+ * when cookie is old or rejected, new cookie is fetched and request is sent again once.
+ * caller should hold c.mu.
+**/
+func (c *Client) udpRoundTrip(msg string) (string, error) {
+	for try := 0; try < 2; try++ {
+		if c.cookie == "" || time.Since(c.cookieTime) > cookieMaxAge {
+			if err := c.fetchCookie(); err != nil {
+				return "", err
+			}
+		}
+
+		reply, err := c.roundTrip(c.sign("C" + c.cookie + msg))
+		if err != nil {
+			return "", err
+		}
+		if reply != cookieNeeded {
+			return reply, nil
+		}
+		c.cookie = ""
+	}
+	return "", ErrNoCookie
+}
+
+/**
+ * requests cookie. replies of earlier timed out requests are skipped.
+**/
+func (c *Client) fetchCookie() error {
+	if _, err := c.conn.Write(c.sign("0" + strings.Repeat(" ", cookieRequestSize-1))); err != nil {
+		return err
+	}
+	for {
+		cnt, err := c.conn.Read(c.buffer)
+		if err != nil {
+			return err
+		}
+		if reply := string(c.buffer[:cnt]); strings.HasPrefix(reply, cookieReply) {
+			c.cookie, c.cookieTime = reply[len(cookieReply):], time.Now()
+			return nil
+		}
+	}
+}
+
+/**
+ * signing message with shared key, when it is set.
+**/
+func (c *Client) sign(msg string) []byte {
+	if c.Key == nil {
+		return []byte(msg)
+	}
+	ts := fmt.Sprintf("%016x", time.Now().UnixNano())
+	h := hmac.New(sha256.New, c.Key)
+	h.Write([]byte(ts + msg))
+	return []byte("S" + ts + hex.EncodeToString(h.Sum(nil)) + msg)
+}